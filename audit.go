@@ -0,0 +1,110 @@
+package caddy_writable_file_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Serialize the writes to the audit logs, shared by every instance of the handler like
+// the locks so that a config reload does not interleave lines
+var auditMu sync.Mutex
+
+// A line of the audit log
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Id          string    `json:"id"`
+	RemoteIP    string    `json:"remote_ip"`
+	User        string    `json:"user,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Append a line describing a completed write request to AuditLog. The file is opened
+// for each line so that it can be rotated by moving it away. Failures are logged but
+// do not fail the request, which is already applied.
+func (wfs *WritableFileServer) writeAudit(id string, r *http.Request, destination string, bytes int64, status int, err *ErrorDeployement) {
+	if wfs.AuditLog == "" {
+		return
+	}
+
+	entry := auditEntry{
+		Time:        time.Now().UTC(),
+		Id:          id,
+		RemoteIP:    clientIP(r),
+		User:        wfs.authUser(r),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Destination: destination,
+		Status:      status,
+		Bytes:       bytes,
+	}
+	if err != nil {
+		entry.Status = err.StatusCode
+		entry.Error = err.Private.Error()
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK // Nothing written yet
+	}
+
+	if errAudit := appendAudit(wfs.AuditLog, entry); errAudit != nil {
+		wfs.logger.Log(zapcore.ErrorLevel, "failed to write audit log", zap.String("id", id), zap.String("audit_log", wfs.AuditLog), zap.Error(errAudit))
+	}
+}
+
+func appendAudit(path string, entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %w", err)
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	// A single write of the whole line to a file opened in append mode is never
+	// interleaved with the lines of other processes
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, FILE_PERM)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Return the IP of the client of r, as determined by the trusted proxies of Caddy
+func clientIP(r *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Return the user authenticated by the Caddy authentication handler, as given by
+// UserPlaceholder, or an empty string
+func (wfs *WritableFileServer) authUser(r *http.Request) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	return repl.ReplaceAll(wfs.UserPlaceholder, "")
+}
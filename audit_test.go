@@ -0,0 +1,156 @@
+package caddy_writable_file_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Return the entries of the audit log at path
+func readAudit(t *testing.T, path string) []auditEntry {
+	file, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer file.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+
+	repl := caddy.NewReplacer()
+	repl.Set("http.auth.user.id", "deployer")
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.RemoteAddr = "192.0.2.1:4321"
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	// Failures are recorded too
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	assert.Error(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	entries := readAudit(t, wfs.AuditLog)
+	if !assert.Len(t, entries, 2) {
+		return
+	}
+
+	info, err := os.Stat(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entries[0].Id)
+	assert.Equal(t, "192.0.2.1", entries[0].RemoteIP)
+	assert.Equal(t, "deployer", entries[0].User)
+	assert.Equal(t, "PUT", entries[0].Method)
+	assert.Equal(t, "/test.txt", entries[0].Path)
+	assert.Equal(t, http.StatusCreated, entries[0].Status)
+	assert.Equal(t, info.Size(), entries[0].Bytes)
+	assert.Empty(t, entries[0].Error)
+	assert.WithinDuration(t, time.Now(), entries[0].Time, time.Minute)
+
+	assert.Equal(t, "DELETE", entries[1].Method)
+	assert.Equal(t, "/missing.txt", entries[1].Path)
+	assert.Equal(t, http.StatusNotFound, entries[1].Status)
+	assert.NotEmpty(t, entries[1].Error)
+}
+
+func TestAuditLogRotated(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	// The next line goes to a new file once the log is moved away
+	assert.NoError(t, os.Rename(wfs.AuditLog, wfs.AuditLog+".1"))
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	assert.Len(t, readAudit(t, wfs.AuditLog+".1"), 1)
+	assert.Len(t, readAudit(t, wfs.AuditLog), 1)
+}
+
+func TestUserPlaceholder(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	wfs.UserPlaceholder = "{http.auth.user.email}"
+	core, logs := observer.New(zapcore.DebugLevel)
+	wfs.logger = zap.New(core)
+
+	repl := caddy.NewReplacer()
+	repl.Set("http.auth.user.id", "1234")
+	repl.Set("http.auth.user.email", "deployer@example.com")
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+	assert.Error(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	entries := readAudit(t, wfs.AuditLog)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "deployer@example.com", entries[0].User)
+	}
+	warnings := logs.FilterLevelExact(zapcore.WarnLevel).All()
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, "deployer@example.com", warnings[0].ContextMap()["user"])
+	}
+}
+
+func TestDeployLogs(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	core, logs := observer.New(zapcore.DebugLevel)
+	wfs.logger = zap.New(core)
+
+	for i := 0; i < 2; i++ {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+		r.Header.Add("Content-Type", "application/x-tar")
+		assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	}
+	w, err := deletePath(wfs, "/site/", map[string]string{"X-Recursive": "true"})
+	assert.NoError(t, err)
+
+	for _, entry := range logs.All() {
+		for _, placeholder := range []string{"fucking", "line 198", "line 238", "errExtract"} {
+			assert.NotContains(t, entry.Message, placeholder)
+		}
+	}
+
+	succeeded := logs.FilterMessage("deploy succeeded").All()
+	if assert.Len(t, succeeded, 3) {
+		fields := succeeded[2].ContextMap()
+		assert.Equal(t, zapcore.InfoLevel, succeeded[2].Level)
+		assert.Equal(t, w.Header().Get("X-Deploy-Id"), fields["id"])
+		assert.Equal(t, "DELETE", fields["method"])
+		assert.Equal(t, wfs.Root+"/site/", fields["target"])
+		assert.Equal(t, int64(http.StatusNoContent), fields["status"])
+	}
+	assert.Len(t, logs.FilterMessage("backup removed").All(), 1)
+	assert.Len(t, logs.FilterMessage("target deleted").All(), 1)
+	extracted := logs.FilterMessage("extracted upload").All()
+	if assert.Len(t, extracted, 2) {
+		assert.Equal(t, int64(7), extracted[0].ContextMap()["entries"])
+	}
+}
@@ -0,0 +1,178 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Layout of the timestamp of retained backups. It sorts chronologically.
+const BACKUP_TIME_LAYOUT = "20060102T150405.000000000Z"
+
+// Directory of the retained backups of a root
+const BACKUPS_DIR = ".backups"
+
+// Return the directory of the retained backups of root
+func (wfs *WritableFileServer) backupsPath(root string) string {
+	return filepath.Join(root, BACKUPS_DIR)
+}
+
+// Return the path of a backup of target retained after a successful deploy at t.
+//
+// It has the same path relative to the backups directory as target to root, like in
+// the trash, so that it is never served. Its suffix differs from the one of getBackupPath
+// so that it is never taken for the leftover of an interrupted deploy. The backups of
+// the root itself cannot be inside it, they stay next to it.
+func (wfs *WritableFileServer) retainedBackupPath(root string, target string, t time.Time) string {
+	return wfs.retainedBackupPrefix(root, target) + t.UTC().Format(BACKUP_TIME_LAYOUT)
+}
+
+func (wfs *WritableFileServer) retainedBackupPrefix(root string, target string) string {
+	root, target = filepath.Clean(root), filepath.Clean(target)
+	if target == root {
+		return target + ".backup-"
+	}
+	rel, _ := filepath.Rel(root, target)
+	return filepath.Join(wfs.backupsPath(root), rel) + ".backup-"
+}
+
+// Return the retained backups of target, oldest first
+func (wfs *WritableFileServer) listRetainedBackups(root string, target string) ([]string, error) {
+	prefix := wfs.retainedBackupPrefix(root, target)
+	dir := filepath.Dir(prefix)
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, entry := range entries {
+		timestamp, ok := strings.CutPrefix(entry.Name(), filepath.Base(prefix))
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(BACKUP_TIME_LAYOUT, timestamp); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, entry.Name()))
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// Keep backup as the newest retained backup of target and remove the oldest ones so
+// that at most KeepBackups remain.
+func (wfs *WritableFileServer) retainBackup(root string, backup string, target string) error {
+	retained := wfs.retainedBackupPath(root, target, time.Now())
+	if err := os.MkdirAll(filepath.Dir(retained), wfs.dirPerm); err != nil {
+		return fmt.Errorf("failed to create backups directory for %s: %w", retained, err)
+	}
+	if err := rename(backup, retained); err != nil {
+		return fmt.Errorf("failed to retain backup %s: %w", backup, err)
+	}
+
+	backups, err := wfs.listRetainedBackups(root, target)
+	if err != nil {
+		return fmt.Errorf("failed to list backups of %s: %w", target, err)
+	}
+	for len(backups) > wfs.KeepBackups {
+		if err := os.RemoveAll(backups[0]); err != nil {
+			return fmt.Errorf("failed to prune backup %s: %w", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Swap the newest retained backup of target back into place, discarding the current
+// version of target. Return an error wrapping os.ErrNotExist if there is no backup.
+func (wfs *WritableFileServer) RestorePath(id string, root string, target string) error {
+	backups, err := wfs.listRetainedBackups(root, target)
+	if err != nil {
+		return fmt.Errorf("failed to list backups of %s: %w", target, err)
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("no backup of %s: %w", target, os.ErrNotExist)
+	}
+	newest := backups[len(backups)-1]
+
+	// The current version is set aside until the backup is in place
+	if errStaging := wfs.createStaging(root); errStaging != nil {
+		return errStaging.Private
+	}
+	current := wfs.backupPath(id, root, target)
+	_, err = os.Lstat(target)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not stat target: %w", err)
+	}
+	if exists {
+		if err := rename(filepath.Clean(target), filepath.Clean(current)); err != nil {
+			return fmt.Errorf("failed to set aside target %s: %w", target, err)
+		}
+	}
+
+	if err := rename(newest, filepath.Clean(target)); err != nil {
+		err = fmt.Errorf("failed to restore backup %s: %w", newest, err)
+		if errRollback := rollback(current, target); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return err
+	}
+
+	if exists && filepath.Clean(target) == filepath.Clean(root) {
+		if err := wfs.carryOverReserved(root, current); err != nil {
+			return fmt.Errorf("failed to carry over the directories of the handler, the previous version is kept at %s: %w", current, err)
+		}
+	}
+	if exists {
+		if err := os.RemoveAll(current); err != nil {
+			return fmt.Errorf("failed to remove previous version %s: %w", current, err)
+		}
+	}
+	return nil
+}
+
+// Roll target back to its newest retained backup when a PUT has the `restore=1` query,
+// or bring it back from the trash with `restore=trash`. On success it returns 204 No
+// Content, or 201 Created from the trash.
+func (wfs *WritableFileServer) HandleRestore(id string, root string, target string, r *http.Request) (int, *ErrorDeployement) {
+	switch source := r.URL.Query().Get("restore"); source {
+	case "1":
+	case "trash":
+		return wfs.restoreTrashed(id, root, target)
+	default:
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid restore query: %s", source),
+			"invalid restore query: must be '1' or 'trash'",
+		}
+	}
+
+	err := wfs.RestorePath(id, root, target)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to restore a target without backup: %w", err),
+			"no backup to restore",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	wfs.logger.Log(zapcore.InfoLevel, "restored backup", zap.String("target", target))
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,219 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Upload content to path
+func putContent(t *testing.T, wfs *WritableFileServer, path string, content string) {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path, bytes.NewBufferString(content))
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+}
+
+func TestKeepBackups(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 2
+
+	for i := 1; i <= 4; i++ {
+		putContent(t, wfs, "/test.txt", fmt.Sprintf("version %d", i))
+	}
+
+	backups, err := wfs.listRetainedBackups(wfs.Root, wfs.Root+"/test.txt")
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 2) {
+		for i, backup := range backups {
+			data, err := os.ReadFile(backup)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("version %d", i+2), string(data))
+		}
+	}
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 4", string(data))
+}
+
+func TestKeepBackupsDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 1
+
+	for i := 0; i < 3; i++ {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+		r.Header.Add("Content-Type", "application/x-tar")
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		assert.NoError(t, err)
+	}
+
+	backups, err := wfs.listRetainedBackups(wfs.Root, wfs.Root+"/site/")
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assertFileExist(t, backups[0]+"/tested/with-file/deep.txt")
+	}
+}
+
+func TestNoBackupsByDefault(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	putContent(t, wfs, "/test.txt", "version 1")
+	putContent(t, wfs, "/test.txt", "version 2")
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestRestorePath(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 3
+
+	putContent(t, wfs, "/test.txt", "version 1")
+	putContent(t, wfs, "/test.txt", "version 2")
+	putContent(t, wfs, "/test.txt", "version 3")
+
+	for _, expected := range []string{"version 2", "version 1"} {
+		assert.NoError(t, wfs.RestorePath(GetId(), wfs.Root, wfs.Root+"/test.txt"))
+
+		data, err := os.ReadFile(wfs.Root + "/test.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	err := wfs.RestorePath(GetId(), wfs.Root, wfs.Root+"/test.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assertDirectoryEmpty(t, wfs.Root+"/"+BACKUPS_DIR)
+}
+
+// Send a restore request for path and return the response
+func restore(t *testing.T, wfs *WritableFileServer, path string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path+"?restore=1", nil)
+
+	w := httptest.NewRecorder()
+	return w, wfs.ServeHTTP(w, r, &MockHandler{})
+}
+
+func TestRestoreEndpoint(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 1
+
+	putContent(t, wfs, "/test.txt", "version 1")
+	putContent(t, wfs, "/test.txt", "version 2")
+
+	w, err := restore(t, wfs, "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", string(data))
+}
+
+func TestRestoreEndpointDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 1
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	_, err := restore(t, wfs, "/site/")
+	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt")
+
+	_, err = os.Stat(wfs.Root + "/site/index.html")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRestoreEndpointWithoutBackup(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	putContent(t, wfs, "/test.txt", "version 1")
+
+	_, err := restore(t, wfs, "/test.txt")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", string(data))
+}
+
+func TestKeepBackupsHidden(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 1
+	wfs.EnableRead = true
+
+	putContent(t, wfs, "/dir/test.txt", "version 1")
+	putContent(t, wfs, "/dir/test.txt", "version 2")
+
+	// Backups are kept out of the served tree
+	entries, err := os.ReadDir(wfs.Root + "/dir")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	backups, err := wfs.listRetainedBackups(wfs.Root, wfs.Root+"/dir/test.txt")
+	assert.NoError(t, err)
+	if !assert.Len(t, backups, 1) {
+		return
+	}
+	assert.Equal(t, wfs.Root+"/"+BACKUPS_DIR+"/dir", filepath.Dir(backups[0]))
+
+	rel, err := filepath.Rel(wfs.Root, backups[0])
+	assert.NoError(t, err)
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/"+filepath.ToSlash(rel), nil)
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, errHandler.StatusCode)
+}
+
+func TestKeepBackupsNotCounted(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 100)
+	wfs.KeepBackups = 1
+
+	// The retained previous version does not use the quota of the site
+	putContent(t, wfs, "/big.bin", "small")
+	putContent(t, wfs, "/test.txt", strings.Repeat("a", 1000))
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
@@ -0,0 +1,479 @@
+package caddy_writable_file_server
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parseCaddyfile parses the writable_file_server directive.
+// See UnmarshalCaddyfile for the syntax.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	wfs := new(WritableFileServer)
+	err := wfs.UnmarshalCaddyfile(h.Dispenser)
+	return wfs, err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	writable_file_server [<matcher>] {
+//	    root        <path>
+//	    base_root   <path>
+//	    max_size_mb <size>
+//	    allow_empty_upload <true|false>
+//	    max_uncompressed_mb <size>
+//	    max_entries <count>
+//	    max_file_size_mb <size>
+//	    max_path_depth <count>
+//	    progress_log_mb <size>
+//	    strip_components <count>
+//	    flatten
+//	    include <glob>...
+//	    exclude <glob>...
+//	    require_files <path>...
+//	    protected_paths <glob>...
+//	    denied_extensions <ext>...
+//	    sanitize_entry_names
+//	    normalize_unicode
+//	    reject_nested_archives
+//	    dir_perm    <octal>
+//	    file_perm   <octal>
+//	    umask       <octal>
+//	    file_owner  <user>
+//	    file_group  <group>
+//	    preserve_archive_modes
+//	    preserve_mtimes
+//	    allow_symlinks
+//	    validate_archive
+//	    memory_buffer_mb <size>
+//	    deploy_mode replace|merge
+//	    fsync
+//	    precompress_gzip
+//	    precompress_brotli
+//	    brotli_quality <level>
+//	    precompress_types <media type>...
+//	    generate_manifest
+//	    manifest_file <path>
+//	    enable_read
+//	    health_path <path>
+//	    allowed_methods <method>...
+//	    allow_origins <origin>...
+//	    webhook <url>
+//	    audit_log <path>
+//	    user_placeholder <placeholder>
+//	    success_template <template>
+//	    keep_backups <count>
+//	    quota_mb <size>
+//	    read_timeout <duration>
+//	    max_deploy_timeout <duration>
+//	    max_lock_wait <duration>
+//	    idempotency_ttl <duration>
+//	    staging_dir <path>
+//	    trash_dir <path>
+//	    trash_keep <count>
+//	    trash_max_age <duration>
+//	}
+func (wfs *WritableFileServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "root":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.Root = d.Val()
+
+		case "base_root":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.BaseRoot = d.Val()
+
+		case "max_size_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_size_mb '%s': %v", d.Val(), err)
+			}
+			wfs.MaxSizeMB = size
+
+		case "allow_empty_upload":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			allow, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("invalid allow_empty_upload '%s': %v", d.Val(), err)
+			}
+			wfs.AllowEmptyUpload = &allow
+
+		case "max_uncompressed_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_uncompressed_mb '%s': %v", d.Val(), err)
+			}
+			wfs.MaxUncompressedMB = size
+
+		case "max_entries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_entries '%s': %v", d.Val(), err)
+			}
+			wfs.MaxEntries = count
+
+		case "max_file_size_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_file_size_mb '%s': %v", d.Val(), err)
+			}
+			wfs.MaxFileSizeMB = size
+
+		case "max_path_depth":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			depth, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_path_depth '%s': %v", d.Val(), err)
+			}
+			wfs.MaxPathDepth = depth
+
+		case "progress_log_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid progress_log_mb '%s': %v", d.Val(), err)
+			}
+			wfs.ProgressLogMB = size
+
+		case "strip_components":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid strip_components '%s': %v", d.Val(), err)
+			}
+			wfs.StripComponents = count
+
+		case "flatten":
+			wfs.Flatten = true
+
+		case "include":
+			patterns := d.RemainingArgs()
+			if len(patterns) == 0 {
+				return d.ArgErr()
+			}
+			wfs.Include = append(wfs.Include, patterns...)
+
+		case "exclude":
+			patterns := d.RemainingArgs()
+			if len(patterns) == 0 {
+				return d.ArgErr()
+			}
+			wfs.Exclude = append(wfs.Exclude, patterns...)
+
+		case "require_files":
+			files := d.RemainingArgs()
+			if len(files) == 0 {
+				return d.ArgErr()
+			}
+			wfs.RequireFiles = append(wfs.RequireFiles, files...)
+
+		case "protected_paths":
+			patterns := d.RemainingArgs()
+			if len(patterns) == 0 {
+				return d.ArgErr()
+			}
+			wfs.ProtectedPaths = append(wfs.ProtectedPaths, patterns...)
+
+		case "denied_extensions":
+			extensions := d.RemainingArgs()
+			if len(extensions) == 0 {
+				return d.ArgErr()
+			}
+			wfs.DeniedExtensions = append(wfs.DeniedExtensions, extensions...)
+
+		case "dir_perm":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.DirPerm = d.Val()
+
+		case "file_perm":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.FilePerm = d.Val()
+
+		case "umask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.Umask = d.Val()
+
+		case "file_owner":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.FileOwner = d.Val()
+
+		case "file_group":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.FileGroup = d.Val()
+
+		case "preserve_archive_modes":
+			wfs.PreserveArchiveModes = true
+
+		case "preserve_mtimes":
+			wfs.PreserveMTimes = true
+
+		case "fsync":
+			wfs.Fsync = true
+
+		case "precompress_gzip":
+			wfs.PrecompressGzip = true
+
+		case "precompress_brotli":
+			wfs.PrecompressBrotli = true
+
+		case "brotli_quality":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			quality, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid brotli_quality '%s': %v", d.Val(), err)
+			}
+			wfs.BrotliQuality = quality
+
+		case "precompress_types":
+			types := d.RemainingArgs()
+			if len(types) == 0 {
+				return d.ArgErr()
+			}
+			wfs.PrecompressTypes = append(wfs.PrecompressTypes, types...)
+
+		case "generate_manifest":
+			wfs.GenerateManifest = true
+
+		case "manifest_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.ManifestFile = d.Val()
+
+		case "allow_symlinks":
+			wfs.AllowSymlinks = true
+
+		case "sanitize_entry_names":
+			wfs.SanitizeEntryNames = true
+
+		case "normalize_unicode":
+			wfs.NormalizeUnicode = true
+
+		case "reject_nested_archives":
+			wfs.RejectNestedArchives = true
+
+		case "deploy_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.DeployMode = d.Val()
+
+		case "allowed_methods":
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				return d.ArgErr()
+			}
+			wfs.AllowedMethods = append(wfs.AllowedMethods, methods...)
+
+		case "allow_origins":
+			origins := d.RemainingArgs()
+			if len(origins) == 0 {
+				return d.ArgErr()
+			}
+			wfs.AllowOrigins = append(wfs.AllowOrigins, origins...)
+
+		case "validate_archive":
+			wfs.ValidateArchive = true
+
+		case "memory_buffer_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid memory_buffer_mb '%s': %v", d.Val(), err)
+			}
+			wfs.MemoryBufferMB = size
+
+		case "enable_read":
+			wfs.EnableRead = true
+
+		case "health_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.HealthPath = d.Val()
+
+		case "quota_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid quota_mb '%s': %v", d.Val(), err)
+			}
+			wfs.QuotaMB = size
+
+		case "staging_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.StagingDir = d.Val()
+
+		case "trash_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.TrashDir = d.Val()
+
+		case "trash_keep":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid trash_keep '%s': %v", d.Val(), err)
+			}
+			wfs.TrashKeep = count
+
+		case "trash_max_age":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			age, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid trash_max_age '%s': %v", d.Val(), err)
+			}
+			wfs.TrashMaxAge = caddy.Duration(age)
+
+		case "read_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid read_timeout '%s': %v", d.Val(), err)
+			}
+			wfs.ReadTimeout = caddy.Duration(timeout)
+
+		case "max_deploy_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_deploy_timeout '%s': %v", d.Val(), err)
+			}
+			wfs.MaxDeployTimeout = caddy.Duration(timeout)
+
+		case "max_lock_wait":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wait, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_lock_wait '%s': %v", d.Val(), err)
+			}
+			wfs.MaxLockWait = caddy.Duration(wait)
+
+		case "idempotency_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid idempotency_ttl '%s': %v", d.Val(), err)
+			}
+			wfs.IdempotencyTTL = caddy.Duration(ttl)
+
+		case "partial_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid partial_ttl '%s': %v", d.Val(), err)
+			}
+			wfs.PartialTTL = caddy.Duration(ttl)
+
+		case "webhook":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.Webhook = d.Val()
+
+		case "audit_log":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.AuditLog = d.Val()
+
+		case "user_placeholder":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.UserPlaceholder = d.Val()
+
+		case "success_template":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wfs.SuccessTemplate = d.Val()
+
+		case "keep_backups":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid keep_backups '%s': %v", d.Val(), err)
+			}
+			wfs.KeepBackups = count
+
+		default:
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package caddy_writable_file_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	writable_file_server {
+		root /srv/www
+		base_root /srv
+		max_size_mb 64
+		allow_empty_upload false
+		max_uncompressed_mb 256
+		max_entries 1000
+		max_file_size_mb 16
+		max_path_depth 8
+		progress_log_mb 100
+		dir_perm 0755
+		file_perm 0644
+		umask 0027
+		file_owner www-data
+		file_group 33
+		fsync
+		precompress_gzip
+		precompress_brotli
+		brotli_quality 9
+		precompress_types text/html image/svg+xml
+		generate_manifest
+		manifest_file .integrity/SHA256SUMS
+		enable_read
+		health_path /.health
+		allowed_methods PUT DELETE
+		allow_origins https://a.example.com https://b.example.com
+		webhook https://example.com/hook
+		audit_log /var/log/caddy/audit.log
+		user_placeholder {http.auth.user.email}
+		success_template "\{\"url\": \"https://{http.request.host}{deploy.path}\"\}"
+		preserve_mtimes
+		allow_symlinks
+		sanitize_entry_names
+		normalize_unicode
+		reject_nested_archives
+		validate_archive
+		memory_buffer_mb 8
+		keep_backups 3
+		quota_mb 512
+		read_timeout 30s
+		max_deploy_timeout 10m
+		max_lock_wait 5s
+		idempotency_ttl 1h
+		partial_ttl 2h
+		staging_dir .deploy-staging
+		trash_dir .deleted
+		trash_keep 5
+		trash_max_age 720h
+		strip_components 1
+		flatten
+		include *.html docs/*
+		exclude .git
+		require_files index.html 404.html
+		protected_paths robots.txt .well-known/
+		denied_extensions .php CGI
+	}`)
+
+	wfs := WritableFileServer{}
+	err := wfs.UnmarshalCaddyfile(d)
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/www", wfs.Root)
+	assert.Equal(t, "/srv", wfs.BaseRoot)
+	assert.Equal(t, 64, wfs.MaxSizeMB)
+	assert.False(t, *wfs.AllowEmptyUpload)
+	assert.Equal(t, 256, wfs.MaxUncompressedMB)
+	assert.Equal(t, 1000, wfs.MaxEntries)
+	assert.Equal(t, 16, wfs.MaxFileSizeMB)
+	assert.Equal(t, 8, wfs.MaxPathDepth)
+	assert.Equal(t, 100, wfs.ProgressLogMB)
+	assert.Equal(t, "0755", wfs.DirPerm)
+	assert.Equal(t, "0644", wfs.FilePerm)
+	assert.Equal(t, "0027", wfs.Umask)
+	assert.Equal(t, "www-data", wfs.FileOwner)
+	assert.Equal(t, "33", wfs.FileGroup)
+	assert.True(t, wfs.Fsync)
+	assert.True(t, wfs.PrecompressGzip)
+	assert.True(t, wfs.PrecompressBrotli)
+	assert.Equal(t, 9, wfs.BrotliQuality)
+	assert.Equal(t, []string{"text/html", "image/svg+xml"}, wfs.PrecompressTypes)
+	assert.True(t, wfs.GenerateManifest)
+	assert.Equal(t, ".integrity/SHA256SUMS", wfs.ManifestFile)
+	assert.True(t, wfs.EnableRead)
+	assert.Equal(t, "/.health", wfs.HealthPath)
+	assert.Equal(t, []string{"PUT", "DELETE"}, wfs.AllowedMethods)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, wfs.AllowOrigins)
+	assert.Equal(t, "https://example.com/hook", wfs.Webhook)
+	assert.Equal(t, "/var/log/caddy/audit.log", wfs.AuditLog)
+	assert.Equal(t, "{http.auth.user.email}", wfs.UserPlaceholder)
+	assert.Equal(t, `\{"url": "https://{http.request.host}{deploy.path}"\}`, wfs.SuccessTemplate)
+	assert.True(t, wfs.AllowSymlinks)
+	assert.True(t, wfs.SanitizeEntryNames)
+	assert.True(t, wfs.NormalizeUnicode)
+	assert.True(t, wfs.RejectNestedArchives)
+	assert.True(t, wfs.PreserveMTimes)
+	assert.True(t, wfs.ValidateArchive)
+	assert.Equal(t, 8, wfs.MemoryBufferMB)
+	assert.Equal(t, 3, wfs.KeepBackups)
+	assert.Equal(t, 512, wfs.QuotaMB)
+	assert.Equal(t, caddy.Duration(30*time.Second), wfs.ReadTimeout)
+	assert.Equal(t, caddy.Duration(10*time.Minute), wfs.MaxDeployTimeout)
+	assert.Equal(t, caddy.Duration(5*time.Second), wfs.MaxLockWait)
+	assert.Equal(t, caddy.Duration(time.Hour), wfs.IdempotencyTTL)
+	assert.Equal(t, caddy.Duration(2*time.Hour), wfs.PartialTTL)
+	assert.Equal(t, ".deploy-staging", wfs.StagingDir)
+	assert.Equal(t, ".deleted", wfs.TrashDir)
+	assert.Equal(t, 5, wfs.TrashKeep)
+	assert.Equal(t, caddy.Duration(720*time.Hour), wfs.TrashMaxAge)
+	assert.Equal(t, 1, wfs.StripComponents)
+	assert.True(t, wfs.Flatten)
+	assert.Equal(t, []string{"*.html", "docs/*"}, wfs.Include)
+	assert.Equal(t, []string{".git"}, wfs.Exclude)
+	assert.Equal(t, []string{"index.html", "404.html"}, wfs.RequireFiles)
+	assert.Equal(t, []string{".php", "CGI"}, wfs.DeniedExtensions)
+	assert.Equal(t, []string{"robots.txt", ".well-known/"}, wfs.ProtectedPaths)
+}
+
+func TestUnmarshalCaddyfileInvalid(t *testing.T) {
+	var tests = map[string]string{
+		"inline argument":           `writable_file_server /srv/www`,
+		"missing root":              "writable_file_server {\n root\n}",
+		"too many arguments":        "writable_file_server {\n root /srv/www /srv/other\n}",
+		"invalid size":              "writable_file_server {\n max_size_mb big\n}",
+		"invalid allow_empty":       "writable_file_server {\n allow_empty_upload maybe\n}",
+		"invalid uncompressed size": "writable_file_server {\n max_uncompressed_mb big\n}",
+		"unknown option":            "writable_file_server {\n unknown 1\n}",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := WritableFileServer{}
+			err := wfs.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+			assert.Error(t, err)
+		})
+	}
+}
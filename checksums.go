@@ -0,0 +1,57 @@
+package caddy_writable_file_server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Name of the checksum manifest written by GenerateManifest when ManifestFile is not set
+const MANIFEST_FILE = "SHA256SUMS"
+
+// Write the SHA-256 of the extracted files of target in the manifest ManifestFile, in
+// the format of `sha256sum` so that `sha256sum -c` checks the deploy. The names are
+// relative to target and sorted.
+func (wfs *WritableFileServer) writeChecksumManifest(target string, sums map[string][]byte) *ErrorDeployement {
+	manifest := filepath.Join(target, wfs.ManifestFile)
+
+	// It would list itself, or be written through a symlink of the archive
+	if _, err := os.Lstat(manifest); err == nil {
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("archive has an entry at the checksum manifest %s", manifest),
+			fmt.Sprintf("invalid archive: an entry is named like the checksum manifest %s", filepath.ToSlash(wfs.ManifestFile)),
+		}
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var content strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&content, "%s  %s\n", hex.EncodeToString(sums[name]), name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(manifest), wfs.dirPerm); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create the parent of the checksum manifest %s: %w", manifest, err),
+			"",
+		}
+	}
+	if err := os.WriteFile(manifest, []byte(content.String()), wfs.filePerm); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to write the checksum manifest %s: %w", manifest, err),
+			"",
+		}
+	}
+	return nil
+}
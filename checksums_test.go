@@ -0,0 +1,91 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return the hex SHA-256 of content
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGenerateManifest(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.GenerateManifest = true
+	wfs.AllowSymlinks = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html>"},
+		tarEntry{&tar.Header{Name: "css/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "css/style.css", Typeflag: tar.TypeReg, Mode: 0644}, "body {}"},
+		tarEntry{&tar.Header{Name: "home.html", Typeflag: tar.TypeLink, Linkname: "index.html"}, ""},
+		tarEntry{&tar.Header{Name: "latest", Typeflag: tar.TypeSymlink, Linkname: "css"}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+
+	manifest, err := os.ReadFile(wfs.Root + "/site/SHA256SUMS")
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex("body {}")+"  css/style.css\n"+
+		sha256Hex("<html>")+"  home.html\n"+
+		sha256Hex("<html>")+"  index.html\n", string(manifest))
+}
+
+func TestGenerateManifestFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.GenerateManifest = true
+	wfs.ManifestFile = ".integrity/sums.txt"
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html>"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+
+	manifest, err := os.ReadFile(wfs.Root + "/site/.integrity/sums.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex("<html>")+"  index.html\n", string(manifest))
+	assert.NoFileExists(t, wfs.Root+"/site/SHA256SUMS")
+
+	// An entry at the path of the manifest would be replaced
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/other/", newTarWith(
+		tarEntry{&tar.Header{Name: ".integrity/sums.txt", Typeflag: tar.TypeReg, Mode: 0644}, "forged"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.NoDirExists(t, wfs.Root+"/other")
+}
+
+func TestGenerateManifestDisabled(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, wfs.Root+"/site/SHA256SUMS")
+}
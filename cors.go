@@ -0,0 +1,39 @@
+package caddy_writable_file_server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Headers of responses that browsers hide from scripts unless they are exposed
+var corsExposedHeaders = []string{"ETag", "Idempotent-Replayed", "Location", "Range", "X-Deploy-Id"}
+
+// Add the CORS headers to the response when the `Origin` of the request is allowed.
+// Preflight requests also get the allowed methods and headers.
+func (wfs *WritableFileServer) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(wfs.AllowOrigins) == 0 {
+		return
+	}
+
+	header := w.Header()
+	// Caches must not serve the response of an origin to another one
+	header.Add("Vary", "Origin")
+
+	allowed := origin
+	if slices.Contains(wfs.AllowOrigins, "*") {
+		allowed = "*"
+	} else if !slices.Contains(wfs.AllowOrigins, origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", allowed)
+	header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		header.Set("Access-Control-Allow-Methods", strings.Join(wfs.allowedMethods(), ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		}
+	}
+}
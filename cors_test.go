@@ -0,0 +1,95 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSMatchingOrigin(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowOrigins = []string{"https://dashboard.example.com"}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Origin", "https://dashboard.example.com")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://dashboard.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "ETag, Idempotent-Replayed, Location, Range, X-Deploy-Id", w.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowOrigins = []string{"*"}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Origin", "https://anywhere.example.com")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSNonMatchingOrigin(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowOrigins = []string{"https://dashboard.example.com"}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Origin", "https://evil.example.com")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Expose-Headers"))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowOrigins = []string{"https://dashboard.example.com"}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "OPTIONS", "/test.txt", nil)
+	r.Header.Add("Origin", "https://dashboard.example.com")
+	r.Header.Add("Access-Control-Request-Method", "PUT")
+	r.Header.Add("Access-Control-Request-Headers", "content-type, x-deploy-mode")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://dashboard.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "OPTIONS, PUT, PATCH, DELETE, MOVE, COPY", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type, x-deploy-mode", w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestCORSDisabled(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "OPTIONS", "/test.txt", nil)
+	r.Header.Add("Origin", "https://dashboard.example.com")
+	r.Header.Add("Access-Control-Request-Method", "PUT")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+}
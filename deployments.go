@@ -0,0 +1,82 @@
+package caddy_writable_file_server
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Last deploy of each path, shared by every instance of the handler like the locks
+var deployments = newDeploymentLog()
+
+// Metadata of the last successful deploy of a path
+type deploymentInfo struct {
+	Id     string    `json:"id"`
+	Method string    `json:"method"`
+	Bytes  int64     `json:"bytes"`
+	Time   time.Time `json:"time"`
+}
+
+// Remember the last successful deploy of each target so that dashboards can show when
+// and how a site was last deployed. It is kept in memory and lost on restart.
+type deploymentLog struct {
+	mu      sync.Mutex
+	entries map[string]deploymentInfo
+}
+
+func newDeploymentLog() *deploymentLog {
+	return &deploymentLog{entries: map[string]deploymentInfo{}}
+}
+
+// Return the last deploy of target
+func (l *deploymentLog) get(target string) (deploymentInfo, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, ok := l.entries[filepath.Clean(target)]
+	return info, ok
+}
+
+// Record a successful deploy of target
+func (l *deploymentLog) record(target string, info deploymentInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[filepath.Clean(target)] = info
+}
+
+// Forget the deploys of target and of everything inside it, to be called once they
+// are removed
+func (l *deploymentLog) forget(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	target = filepath.Clean(target)
+	for path := range l.entries {
+		if isWithin(target, path) {
+			delete(l.entries, path)
+		}
+	}
+}
+
+// Answer a GET or HEAD request with the `deployment` query with the metadata of the
+// last deploy of target, as JSON
+func (wfs *WritableFileServer) HandleDeployment(target string, w http.ResponseWriter, r *http.Request) *ErrorDeployement {
+	info, ok := deployments.get(target)
+	if !ok {
+		return &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("no deployment recorded for %s", target),
+			"no deployment recorded for this path",
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	writeJSON(w, http.StatusOK, info)
+	return nil
+}
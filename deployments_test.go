@@ -0,0 +1,146 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a GET of the last deployment of path
+func getDeployment(wfs *WritableFileServer, path string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", path+"?deployment", nil)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestDeploymentMetadata(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	var previous deploymentInfo
+	for _, content := range []string{"first", "second deploy"} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", bytes.NewBufferString(content))
+		w := httptest.NewRecorder()
+		assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+
+		w, err := getDeployment(wfs, "/test.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var info deploymentInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		assert.Equal(t, "PUT", info.Method)
+		assert.Equal(t, int64(len(content)), info.Bytes)
+		assert.NotEmpty(t, info.Id)
+		assert.NotEqual(t, previous.Id, info.Id)
+		assert.WithinDuration(t, time.Now(), info.Time, time.Minute)
+		previous = info
+	}
+}
+
+func TestDeploymentMetadataForgottenOnDelete(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	w, err := getDeployment(wfs, "/site/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/site/", nil)
+	r.Header.Add("X-Recursive", "true")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	_, err = getDeployment(wfs, "/site/")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+}
+
+// Assert that no deployment of path is recorded
+func assertNoDeployment(t *testing.T, wfs *WritableFileServer, path string) {
+	t.Helper()
+
+	_, err := getDeployment(wfs, path)
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok, path)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode, path)
+}
+
+func TestDeploymentMetadataForgottenOnReplace(t *testing.T) {
+	var tests = map[string]struct {
+		method string
+		path   string
+		query  string
+		kept   []string
+		gone   []string
+	}{
+		"glob":          {"DELETE", "/site/", "glob=*.txt", []string{"/site/", "/site/keep.html"}, []string{"/site/old.txt"}},
+		"contents only": {"DELETE", "/site/", "contents_only=1", nil, []string{"/site/", "/site/old.txt", "/site/keep.html"}},
+		"restore":       {"PUT", "/site/old.txt", "restore=1", []string{"/site/", "/site/keep.html"}, []string{"/site/old.txt"}},
+		"replace":       {"PUT", "/site/", "", []string{"/site/"}, []string{"/site/old.txt", "/site/keep.html"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.EnableRead = true
+			wfs.KeepBackups = 1
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+			r.Header.Add("Content-Type", "application/x-tar")
+			assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+			putContent(t, wfs, "/site/old.txt", "first")
+			putContent(t, wfs, "/site/old.txt", "second")
+			putContent(t, wfs, "/site/keep.html", "keep")
+
+			var body io.Reader
+			if test.method == "PUT" && test.query == "" {
+				body = newTar()
+			}
+			r, _ = http.NewRequestWithContext(ctx, test.method, test.path+"?"+test.query, body)
+			r.Header.Add("Content-Type", "application/x-tar")
+			r.Header.Add("X-Recursive", "true")
+			assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+			for _, path := range test.kept {
+				w, err := getDeployment(wfs, path)
+				assert.NoError(t, err, path)
+				assert.Equal(t, http.StatusOK, w.Code, path)
+			}
+			for _, path := range test.gone {
+				assertNoDeployment(t, wfs, path)
+			}
+		})
+	}
+}
+
+func TestDeploymentMetadataUnknownPath(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	w, err := getDeployment(wfs, "/missing.txt")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+	assert.Equal(t, "no deployment recorded for this path\n", w.Body.String())
+}
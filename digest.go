@@ -0,0 +1,97 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"md5":     md5.New,
+}
+
+// A digest of the request body announced by the client (RFC 3230)
+type digest struct {
+	algorithm string
+	expected  []byte
+	hash      hash.Hash
+}
+
+// Parse the `Digest` header, ignoring unsupported algorithms as long as at least
+// one of them is supported. Return nil if the header is empty.
+func parseDigestHeader(header string) ([]*digest, *ErrorDeployement) {
+	if header == "" {
+		return nil, nil
+	}
+
+	digests := []*digest{}
+	for _, value := range strings.Split(header, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+		if !ok {
+			return nil, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("malformed digest: %s", value),
+				"malformed Digest header",
+			}
+		}
+
+		algorithm = strings.ToLower(algorithm)
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("malformed %s digest: %w", algorithm, err),
+				"malformed Digest header",
+			}
+		}
+
+		digests = append(digests, &digest{algorithm, expected, newHash()})
+	}
+
+	if len(digests) == 0 {
+		return nil, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("no supported algorithm in digest: %s", header),
+			"unsupported Digest algorithm: only 'sha-256' and 'md5' are supported",
+		}
+	}
+
+	return digests, nil
+}
+
+// Return a writer feeding every digest
+func digestWriter(digests []*digest) io.Writer {
+	writers := make([]io.Writer, len(digests))
+	for i, d := range digests {
+		writers[i] = d.hash
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Compare the received body against every announced digest
+func verifyDigests(digests []*digest) *ErrorDeployement {
+	for _, d := range digests {
+		sum := d.hash.Sum(nil)
+		if !bytes.Equal(sum, d.expected) {
+			return &ErrorDeployement{
+				http.StatusUnprocessableEntity,
+				errors.New("digest mismatch: " + d.algorithm + "=" + base64.StdEncoding.EncodeToString(sum)),
+				"body does not match the Digest header",
+			}
+		}
+	}
+	return nil
+}
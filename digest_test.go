@@ -0,0 +1,122 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+const testContent = "Hi. What are you doing here?\n"
+
+func TestUploadFileWithDigest(t *testing.T) {
+	sha := sha256.Sum256([]byte(testContent))
+	md := md5.Sum([]byte(testContent))
+
+	var tests = map[string]string{
+		"sha-256":  "sha-256=" + base64.StdEncoding.EncodeToString(sha[:]),
+		"md5":      "MD5=" + base64.StdEncoding.EncodeToString(md[:]),
+		"multiple": "unixsum=30637, sha-256=" + base64.StdEncoding.EncodeToString(sha[:]),
+	}
+
+	for name, header := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+			r.Header.Add("Content-Type", "application/octet-stream")
+			r.Header.Add("Digest", header)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+			assertFileExist(t, wfs.Root+"/test.txt")
+		})
+	}
+}
+
+func TestUploadDirectoryWithDigest(t *testing.T) {
+	archive, err := os.ReadFile("tests/assets/test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(archive)
+
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sha[:]))
+
+	w := httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+}
+
+func TestUploadFileWithWrongDigest(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha := sha256.Sum256([]byte("something else"))
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sha[:]))
+
+	w := httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnprocessableEntity, errHandler.StatusCode)
+
+	// The live target and the root are untouched
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadFileWithUnsupportedDigest(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("Digest", "unixsum=30637")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+
+	_, err = os.Stat(wfs.Root + "/test.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,81 @@
+package caddy_writable_file_server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings decoded on file uploads (RFC 9110)
+const (
+	ENCODING_IDENTITY = "identity"
+	ENCODING_GZIP     = "gzip"
+	ENCODING_BROTLI   = "br"
+	ENCODING_ZSTD     = "zstd"
+)
+
+// Undo the content codings listed in the `Content-Encoding` header of a file upload so
+// that the decoded content is stored. Codings are removed in the reverse order of
+// their application and the result is capped like archives. The returned function
+// releases the decoders.
+func (wfs *WritableFileServer) decodeContent(reader io.Reader, header string) (io.Reader, func(), *ErrorDeployement) {
+	closers := []func(){}
+	release := func() {
+		for _, close := range slices.Backward(closers) {
+			close()
+		}
+	}
+
+	codings := strings.Split(header, ",")
+	decoded := false
+	for _, coding := range slices.Backward(codings) {
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "", ENCODING_IDENTITY:
+			continue
+		case ENCODING_GZIP, "x-gzip":
+			gzr, err := gzip.NewReader(reader)
+			if err != nil {
+				release()
+				return nil, nil, &ErrorDeployement{
+					http.StatusBadRequest,
+					fmt.Errorf("failed to wrap body in gzip reader: %w", err),
+					"invalid gzip content encoding",
+				}
+			}
+			closers = append(closers, func() { gzr.Close() })
+			reader = gzr
+		case ENCODING_BROTLI:
+			reader = brotli.NewReader(reader)
+		case ENCODING_ZSTD:
+			zr, err := wfs.newZstdReader(reader)
+			if err != nil {
+				release()
+				return nil, nil, &ErrorDeployement{
+					http.StatusInternalServerError,
+					fmt.Errorf("failed to wrap body in zstd reader: %w", err),
+					"",
+				}
+			}
+			closers = append(closers, zr.Close)
+			reader = zr
+		default:
+			release()
+			return nil, nil, &ErrorDeployement{
+				http.StatusUnsupportedMediaType,
+				fmt.Errorf("unsupported content-encoding: %s", header),
+				fmt.Sprintf("unsupported Content-Encoding: must be one of %s, %s or %s", ENCODING_GZIP, ENCODING_BROTLI, ENCODING_ZSTD),
+			}
+		}
+		decoded = true
+	}
+
+	if decoded {
+		reader = wfs.limitUncompressed(reader)
+	}
+	return reader, release, nil
+}
@@ -0,0 +1,125 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeContent(coding string, content []byte) io.Reader {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch coding {
+	case ENCODING_GZIP:
+		w = gzip.NewWriter(buf)
+	case ENCODING_BROTLI:
+		w = brotli.NewWriter(buf)
+	case ENCODING_ZSTD:
+		w, _ = zstd.NewWriter(buf)
+	}
+	if _, err := w.Write(content); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func TestUploadFileContentEncoding(t *testing.T) {
+	content := []byte("Hello, compressed world!\n")
+
+	for _, coding := range []string{ENCODING_GZIP, ENCODING_BROTLI, ENCODING_ZSTD} {
+		t.Run(coding, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", encodeContent(coding, content))
+			r.Header.Add("Content-Encoding", coding)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, w.Code)
+
+			data, err := os.ReadFile(wfs.Root + "/test.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+
+			sha := sha256.Sum256(content)
+			assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, w.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestUploadFileStackedContentEncoding(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	content := []byte("Hello, twice compressed world!\n")
+
+	body, _ := io.ReadAll(encodeContent(ENCODING_GZIP, content))
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", encodeContent(ENCODING_BROTLI, body))
+	r.Header.Add("Content-Encoding", "gzip, br")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestUploadFileUnsupportedContentEncoding(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Encoding", "compress")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnsupportedMediaType, errHandler.StatusCode)
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+}
+
+func TestUploadFileContentEncodingTooLarge(t *testing.T) {
+	for _, coding := range []string{ENCODING_GZIP, ENCODING_BROTLI, ENCODING_ZSTD} {
+		t.Run(coding, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.MaxUncompressedMB = 1
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", encodeContent(coding, make([]byte, 2<<20)))
+			r.Header.Add("Content-Encoding", coding)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, errHandler.StatusCode)
+			assert.NoFileExists(t, wfs.Root+"/test.txt")
+		})
+	}
+}
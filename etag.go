@@ -0,0 +1,53 @@
+package caddy_writable_file_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"sort"
+)
+
+// Format a content hash as a strong entity tag (RFC 9110 section 8.8.3)
+func formatETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// Hashes of the entries extracted from an archive, keyed by their slash separated path
+// relative to the extracted directory. Directories have a nil hash.
+type entryHashes map[string][]byte
+
+// Record a directory and all its parents
+func (h entryHashes) addDir(name string) {
+	for name != "." && name != "/" && name != "" {
+		if _, ok := h[name]; ok {
+			return
+		}
+		h[name] = nil
+		name = path.Dir(name)
+	}
+}
+
+// Record a file with the hash of its content, and all its parents
+func (h entryHashes) addFile(name string, sum []byte) {
+	h[name] = sum
+	h.addDir(path.Dir(name))
+}
+
+// Derive an entity tag from the sorted names and content hashes of the entries so that
+// identical trees always get the same tag, whatever the order of the archive.
+func (h entryHashes) etag() string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tree := sha256.New()
+	for _, name := range names {
+		tree.Write([]byte(name))
+		tree.Write([]byte{0})
+		tree.Write([]byte(hex.EncodeToString(h[name])))
+		tree.Write([]byte{'\n'})
+	}
+	return formatETag(tree.Sum(nil))
+}
@@ -0,0 +1,178 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Upload body to path and return the ETag of the response
+func putETag(t *testing.T, wfs *WritableFileServer, path string, contentType string, body io.ReadCloser) string {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path, body)
+	r.Header.Add("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	return w.Header().Get("ETag")
+}
+
+func TestUploadFileETag(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	content, err := os.ReadFile("tests/assets/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(content)
+
+	first := putETag(t, wfs, "/test.txt", "application/octet-stream", newFile())
+	second := putETag(t, wfs, "/test.txt", "application/octet-stream", newFile())
+
+	assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, first)
+	assert.Equal(t, first, second)
+}
+
+func TestUploadDirectoryETag(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	first := putETag(t, wfs, "/", "application/x-tar", newTar())
+	second := putETag(t, wfs, "/", "application/x-tar+gzip", newTarGz())
+
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, second)
+}
+
+func TestUploadDirectoryETagIgnoresOrder(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	index := tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"}
+	page := tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "pages/about.html", Mode: 0644}, "about"}
+	pages := tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "pages/", Mode: 0755}, ""}
+
+	first := putETag(t, wfs, "/site/", "application/x-tar", newTarWith(pages, page, index))
+	second := putETag(t, wfs, "/site/", "application/x-tar", newTarWith(index, page))
+
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, second)
+}
+
+func TestUploadDirectoryETagChangesWithContent(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	first := putETag(t, wfs, "/site/", "application/x-tar", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"},
+	))
+	second := putETag(t, wfs, "/site/", "application/x-tar", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "changed"},
+	))
+	renamed := putETag(t, wfs, "/site/", "application/x-tar", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "home.html", Mode: 0644}, "index"},
+	))
+
+	assert.NotEqual(t, first, second)
+	assert.NotEqual(t, first, renamed)
+}
+
+func TestUploadDirectoryContentDigest(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	w := httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	etag := w.Header().Get("ETag")
+
+	before, err := os.Stat(wfs.Root + "/site/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+
+	// The same archive is not deployed again
+	for _, digest := range []string{etag, strings.Trim(etag, `"`)} {
+		r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+		r.Header.Add("Content-Type", "application/x-tar")
+		r.Header.Add("X-Content-Digest", digest)
+		w = httptest.NewRecorder()
+		assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+	}
+
+	after, err := os.Stat(wfs.Root + "/site/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(before, after))
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// A write deep in the tree does not change the modification time of the target
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/tested/with-file/deep.txt", strings.NewReader("changed"))
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Content-Digest", etag)
+	w = httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+}
+
+// Deploy the archive of newTar to /site/ with the X-Content-Digest header and return the
+// status of the response
+func putDigest(t *testing.T, wfs *WritableFileServer, digest string, headers map[string]string) int {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Content-Digest", digest)
+	for header, value := range headers {
+		r.Header.Add(header, value)
+	}
+	w := httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	return w.Code
+}
+
+func TestUploadDirectoryContentDigestGeneratedFiles(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PrecompressGzip = true
+	wfs.PrecompressTypes = []string{"text/plain"}
+	wfs.GenerateManifest = true
+	provisionTestWritableFileServer(t, wfs)
+
+	etag := putETag(t, wfs, "/site/", "application/x-tar", newTar())
+	assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt.gz")
+	assertFileExist(t, wfs.Root+"/site/"+MANIFEST_FILE)
+
+	// The files written by the handler are not part of the upload
+	assert.Equal(t, http.StatusNotModified, putDigest(t, wfs, etag, nil))
+}
+
+func TestUploadDirectoryContentDigestChanged(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	etag := putETag(t, wfs, "/site/", "application/x-tar", newTar())
+	assert.Equal(t, http.StatusNotModified, putDigest(t, wfs, etag, nil))
+
+	// A change deep in the tree made outside of the handler is noticed too
+	if err := os.WriteFile(wfs.Root+"/site/tested/with-file/deep.txt", []byte("changed"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNoContent, putDigest(t, wfs, etag, nil))
+
+	// Files kept by merge deploys are not in the upload, the tree is never compared
+	assert.Equal(t, http.StatusNoContent, putDigest(t, wfs, etag, map[string]string{"X-Deploy-Mode": "merge"}))
+}
@@ -0,0 +1,61 @@
+package caddy_writable_file_server
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Names of the events emitted after each deployment
+const (
+	EVENT_DEPLOY_SUCCESS = "deploy.success"
+	EVENT_DEPLOY_FAILED  = "deploy.failed"
+)
+
+// The subset of the Caddy events app used by the handler, stubbed in tests
+type eventEmitter interface {
+	Emit(ctx caddy.Context, eventName string, data map[string]any) caddy.Event
+}
+
+// Count the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Emit `deploy.success` or `deploy.failed` depending on err. Nothing is emitted when
+// the events app is not available.
+func (wfs *WritableFileServer) emitDeployEvent(id string, r *http.Request, bytes int64, start time.Time, status int, err *ErrorDeployement) {
+	if wfs.events == nil {
+		return
+	}
+
+	data := map[string]any{
+		"id":       id,
+		"path":     r.URL.Path,
+		"method":   r.Method,
+		"bytes":    bytes,
+		"duration": time.Since(start).Seconds(),
+	}
+
+	if err != nil {
+		data["status"] = err.StatusCode
+		data["error"] = err.Private.Error()
+		wfs.events.Emit(wfs.ctx, EVENT_DEPLOY_FAILED, data)
+		return
+	}
+
+	if status == 0 {
+		status = http.StatusOK // Nothing written yet
+	}
+	data["status"] = status
+	wfs.events.Emit(wfs.ctx, EVENT_DEPLOY_SUCCESS, data)
+}
@@ -0,0 +1,87 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type emittedEvent struct {
+	name string
+	data map[string]any
+}
+
+// Capture the emitted events instead of dispatching them
+type stubEmitter struct {
+	events []emittedEvent
+}
+
+func (s *stubEmitter) Emit(ctx caddy.Context, eventName string, data map[string]any) caddy.Event {
+	s.events = append(s.events, emittedEvent{eventName, data})
+	return caddy.Event{}
+}
+
+func TestEmitDeploySuccess(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	emitter := &stubEmitter{}
+	wfs.events = emitter
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	assert.Len(t, emitter.events, 1)
+	event := emitter.events[0]
+	assert.Equal(t, EVENT_DEPLOY_SUCCESS, event.name)
+	assert.Equal(t, "/test.txt", event.data["path"])
+	assert.Equal(t, "PUT", event.data["method"])
+	assert.Equal(t, http.StatusCreated, event.data["status"])
+	assert.Greater(t, event.data["bytes"], int64(0))
+	assert.NotEmpty(t, event.data["id"])
+	assert.Contains(t, event.data, "duration")
+}
+
+func TestEmitDeployFailed(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	emitter := &stubEmitter{}
+	wfs.events = emitter
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.Error(t, err)
+
+	assert.Len(t, emitter.events, 1)
+	event := emitter.events[0]
+	assert.Equal(t, EVENT_DEPLOY_FAILED, event.name)
+	assert.Equal(t, "/missing.txt", event.data["path"])
+	assert.Equal(t, http.StatusNotFound, event.data["status"])
+	assert.Equal(t, int64(0), event.data["bytes"])
+	assert.NotEmpty(t, event.data["error"])
+}
+
+func TestNoEventOnOptions(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	emitter := &stubEmitter{}
+	wfs.events = emitter
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "OPTIONS", "/test.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Empty(t, emitter.events)
+}
@@ -2,22 +2,56 @@ package caddy_writable_file_server
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/unicode/norm"
 )
 
-// create target and copy the content of reader into it.
-func extractFile(target string, reader io.Reader) *ErrorDeployement {
+// The number of entries between two progress lines of large extractions
+const PROGRESS_LOG_ENTRIES = 10000
+
+// The subset of *os.File used to write extracted files
+type writableFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// Open a file for extraction. It is a variable so that tests can observe the writes.
+var openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
 
-	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, FILE_PERM)
+// create target and copy the content of reader into it. Return the ETag of the content.
+func (wfs *WritableFileServer) extractFile(target string, reader io.Reader, progress *extractProgress) (string, *ErrorDeployement) {
+
+	file, err := openFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, wfs.filePerm)
 	if err != nil {
-		return &ErrorDeployement{
+		return "", &ErrorDeployement{
 			http.StatusInternalServerError,
 			fmt.Errorf("failed to open target file '%s' for extraction: %w", target, err),
 			"",
@@ -26,118 +60,884 @@ func extractFile(target string, reader io.Reader) *ErrorDeployement {
 	defer file.Close()
 
 	// Stream from reader to file in chunks
-	if _, err := io.Copy(file, reader); err != nil {
-		return &ErrorDeployement{
+	progress.entry()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash, progress), reader); err != nil {
+		return "", &ErrorDeployement{
 			http.StatusInternalServerError,
 			fmt.Errorf("failed to copy data to file '%s' for extraction: %w", target, err),
 			"",
 		}
 	}
+	if wfs.Fsync {
+		if err := file.Sync(); err != nil {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to sync file '%s' after extraction: %w", target, err),
+				"",
+			}
+		}
+	}
 
-	return nil
+	progress.done()
+	return formatETag(hash.Sum(nil)), nil
 }
 
 // TODO: implementation extractDirectory
-func extractDirectory(target string, reader io.Reader, contentType string) *ErrorDeployement {
+func (wfs *WritableFileServer) extractDirectory(target string, reader io.Reader, contentType string, strip int, depth int, progress *extractProgress) (string, *ErrorDeployement) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	// Many clients send tarballs without a meaningful content-type
+	if contentType == "" || contentType == "application/octet-stream" {
+		buffered := bufio.NewReaderSize(reader, tarMagicOffset+len(tarMagic))
+		contentType = sniffArchiveType(buffered)
+		if contentType == "" {
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				errors.New("bad content-type: could not detect the archive format"),
+				"bad content-type: could not detect the archive format, set the Content-Type header",
+			}
+		}
+		reader = buffered
+	}
+
+	// Validating first means a corrupt archive never touches target
+	if wfs.ValidateArchive {
+		validated, errSpool := wfs.validateArchive(target, reader, contentType)
+		if errSpool != nil {
+			return "", errSpool
+		}
+		defer validated.Close()
+		reader = validated
+	}
+
+	tarReader, release, errDecompress := wfs.decompressArchive(reader, contentType)
+	if errDecompress != nil {
+		return "", errDecompress
+	}
+	defer release()
+
+	etag, errExtract := wfs.extractTar(target, tarReader, strip, depth, progress)
+	wfs.convertZstdError(errExtract)
+	return etag, errExtract
+}
+
+// Return the tar stream of an archive of the given content-type, capped by the
+// uncompressed size limit. The returned function releases the decompressor.
+func (wfs *WritableFileServer) decompressArchive(reader io.Reader, contentType string) (io.Reader, func(), *ErrorDeployement) {
 	switch contentType {
-	case "application/x-tar":
-		return extractTar(target, reader)
-	case "application/tar":
-		return extractTar(target, reader)
-	case "application/x-tar+gzip":
-		return extractTarGz(target, reader)
-	case "application/tar+gzip":
-		return extractTarGz(target, reader)
-	case "application/x-gzip":
-		return extractTarGz(target, reader)
-	case "application/gzip":
-		return extractTarGz(target, reader)
+	case "application/x-tar", "application/tar":
+		return reader, func() {}, nil
+	case "application/x-tar+gzip", "application/tar+gzip", "application/x-gzip", "application/gzip":
+		gzr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, nil, errInvalidArchive("failed to wrap body in gzip reader", err)
+		}
+		return wfs.limitUncompressed(gzr), func() { gzr.Close() }, nil
+	case "application/x-tar+xz", "application/tar+xz", "application/x-xz", "application/xz":
+		xzr, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, nil, errInvalidArchive("failed to wrap body in xz reader", err)
+		}
+		return wfs.limitUncompressed(xzr), func() {}, nil
+	case "application/x-tar+bzip2", "application/x-bzip2":
+		// Nothing to release, the bzip2 reader has no Close
+		return wfs.limitUncompressed(bzip2.NewReader(reader)), func() {}, nil
+	case "application/x-tar+zst", "application/x-tar+zstd", "application/tar+zstd", "application/zstd":
+		zr, err := wfs.newZstdReader(reader)
+		if err != nil {
+			return nil, nil, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to wrap body in zstd reader: %w", err),
+				"",
+			}
+		}
+		return wfs.limitUncompressed(zr), zr.Close, nil
 	default:
-		return &ErrorDeployement{
+		return nil, nil, &ErrorDeployement{
 			http.StatusBadRequest,
-			errors.New("bad content-type: only 'application/x-tar' and 'application/x-tar+gzip' are allowed for directories"),
-			"bad content-type: only 'application/x-tar' and 'application/x-tar+gzip' are allowed",
+			errors.New("bad content-type: only 'application/x-tar', 'application/x-tar+gzip', 'application/x-tar+xz', 'application/x-tar+bzip2' and 'application/x-tar+zst' are allowed for directories"),
+			"bad content-type: only 'application/x-tar', 'application/x-tar+gzip', 'application/x-tar+xz', 'application/x-tar+bzip2' and 'application/x-tar+zst' are allowed",
 		}
 	}
 }
 
-func extractTarGz(target string, reader io.Reader) *ErrorDeployement {
-	gzr, err := gzip.NewReader(reader)
-	if err != nil {
-		return &ErrorDeployement{
+// Copy the archive while checking that it decompresses and that every header and entry
+// of its tar stream is complete. Archives up to MemoryBufferMB are copied in memory,
+// larger ones to a spool file next to target. Return the copy, rewound, for the
+// extraction. Closing it removes the spool file.
+func (wfs *WritableFileServer) validateArchive(target string, reader io.Reader, contentType string) (*spoolBuffer, *ErrorDeployement) {
+	spoolPath := strings.TrimSuffix(target, "/") + SPOOL_SUFFIX
+	spool := &spoolBuffer{path: spoolPath, perm: wfs.filePerm, limit: int64(wfs.MemoryBufferMB) << 20}
+
+	tarReader, release, errDecompress := wfs.decompressArchive(io.TeeReader(reader, spool), contentType)
+	if errDecompress != nil {
+		spool.Close()
+		return nil, errDecompress
+	}
+	errValidate := wfs.validateTar(tarReader)
+	release()
+	wfs.convertZstdError(errValidate)
+	if errValidate != nil {
+		spool.Close()
+		return nil, errValidate
+	}
+
+	// The decompressor may stop before the end of the body, like the padding of tar
+	if _, err := io.Copy(spool, reader); err != nil {
+		spool.Close()
+		return nil, &ErrorDeployement{
 			http.StatusInternalServerError,
-			fmt.Errorf("failed to wrap body in gzip reader: %w", err),
+			fmt.Errorf("failed to read the end of the body: %w", err),
 			"",
 		}
 	}
-	defer gzr.Close()
+	if err := spool.rewind(); err != nil {
+		spool.Close()
+		return nil, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to rewind spool file '%s': %w", spoolPath, err),
+			"",
+		}
+	}
+	return spool, nil
+}
+
+// Read a whole tar stream without extracting it
+func (wfs *WritableFileServer) validateTar(reader io.Reader) *ErrorDeployement {
+	tr := tar.NewReader(reader)
+	for entries := 1; ; entries++ {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			_, err = io.Copy(io.Discard, tr)
+		}
+		if err != nil {
+			return errInvalidArchive("failed to validate tar", err)
+		}
+		if entries > wfs.MaxEntries {
+			return &ErrorDeployement{
+				http.StatusRequestEntityTooLarge,
+				fmt.Errorf("archive has more than %d entries", wfs.MaxEntries),
+				fmt.Sprintf("archive exceeds the maximum of %d entries", wfs.MaxEntries),
+			}
+		}
+	}
+}
 
-	return extractTar(target, gzr)
+// Return the error of a failed read of an archive. Failures of the file system are
+// errors of the server, anything else comes from a malformed body. The size limits,
+// timeouts and full disks are reported by handleError.
+func errInvalidArchive(msg string, err error) *ErrorDeployement {
+	var errPath *fs.PathError
+	if errors.As(err, &errPath) {
+		return &ErrorDeployement{http.StatusInternalServerError, fmt.Errorf("%s: %w", msg, err), ""}
+	}
+	return &ErrorDeployement{
+		http.StatusBadRequest,
+		fmt.Errorf("%s: %w", msg, err),
+		"invalid archive: the archive is truncated or corrupt",
+	}
+}
+
+// Return a zstd decoder bounded by the uncompressed size limit
+func (wfs *WritableFileServer) newZstdReader(reader io.Reader) (*zstd.Decoder, error) {
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	// A window larger than the whole uncompressed archive can only be malicious
+	limit := uint64(wfs.MaxUncompressedMB) << 20
+	if limit > 0 {
+		options = append(options, zstd.WithDecoderMaxMemory(limit))
+		options = append(options, zstd.WithDecoderMaxWindow(min(max(limit, zstd.MinWindowSize), zstd.MaxWindowSize)))
+	}
+	return zstd.NewReader(reader, options...)
 }
 
-func extractTar(target string, reader io.Reader) *ErrorDeployement {
+// Report the limits of the zstd decoder like the other uncompressed size errors
+func (wfs *WritableFileServer) convertZstdError(err *ErrorDeployement) {
+	if err != nil && (errors.Is(err.Private, zstd.ErrWindowSizeExceeded) || errors.Is(err.Private, zstd.ErrDecoderSizeExceeded)) {
+		err.Private = fmt.Errorf("%w: %w", &UncompressedSizeError{int64(wfs.MaxUncompressedMB) << 20}, err.Private)
+	}
+}
+
+// Suffix of the copy of archives validated before their extraction
+const SPOOL_SUFFIX = ".spool"
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+	tarMagic   = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// Return the content-type of the archive starting reader based on its magic bytes, or
+// an empty string if it is not recognized. An empty body is a valid empty tar.
+func sniffArchiveType(reader *bufio.Reader) string {
+	// Peek returns what is available when the body is shorter than requested
+	magic, _ := reader.Peek(tarMagicOffset + len(tarMagic))
+	switch {
+	case len(magic) == 0:
+		return "application/x-tar"
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "application/x-tar+gzip"
+	case bytes.HasPrefix(magic, xzMagic):
+		return "application/x-tar+xz"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "application/x-tar+zst"
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return "application/x-tar+bzip2"
+	case len(magic) > tarMagicOffset && bytes.HasPrefix(magic[tarMagicOffset:], tarMagic):
+		return "application/x-tar"
+	default:
+		return ""
+	}
+}
+
+// Returned when a decompressed archive is larger than MaxUncompressedMB
+type UncompressedSizeError struct {
+	Limit int64
+}
+
+func (e *UncompressedSizeError) Error() string {
+	return fmt.Sprintf("uncompressed archive is larger than %d bytes", e.Limit)
+}
+
+// Wrap a decompressed stream so that reading past MaxUncompressedMB fails. This
+// protects the disk against archives with an absurd compression ratio.
+func (wfs *WritableFileServer) limitUncompressed(reader io.Reader) io.Reader {
+	if wfs.MaxUncompressedMB <= 0 {
+		return reader
+	}
+	limit := int64(wfs.MaxUncompressedMB) << 20
+	return &uncompressedReader{reader, limit, limit}
+}
+
+type uncompressedReader struct {
+	reader    io.Reader
+	limit     int64
+	remaining int64
+}
+
+func (r *uncompressedReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, &UncompressedSizeError{r.limit}
+	}
+
+	// We read one byte more than allowed to detect streams that exceed the limit
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = -1
+		return n, &UncompressedSizeError{r.limit}
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// Extract a tar archive into target, removing the strip leading components of the entry
+// names. depth is the number of components of target below the root, counted towards
+// MaxPathDepth. Archives inside the archive are written as is, never extracted. Return
+// an ETag derived from the extracted entries.
+func (wfs *WritableFileServer) extractTar(target string, reader io.Reader, strip int, depth int, progress *extractProgress) (string, *ErrorDeployement) {
+	// Preserved directory modes are applied once extraction is done in case they are
+	// not writable
+	dirModes := map[string]os.FileMode{}
+	// Directory times are applied last since creating their entries updates them
+	dirTimes := map[string]*tar.Header{}
+	hashes := entryHashes{}
+	// The content hashes of the regular files, for the checksum manifest
+	sums := map[string][]byte{}
+	// Symlinks are checked once every entry they may go through is extracted
+	symlinks := []string{}
+	// The entry names of the files written by Flatten, by their base name
+	flattened := map[string]string{}
+
+	fileLimit := int64(wfs.MaxFileSizeMB) << 20
+
 	tr := tar.NewReader(reader)
-	for {
+	for entries := 1; ; entries++ {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return &ErrorDeployement{
-				http.StatusInternalServerError,
-				fmt.Errorf("failed to extract tar: %w", err),
-				"",
+			return "", errInvalidArchive("failed to extract tar", err)
+		}
+		progress.entry()
+
+		// Tiny entries can exhaust inodes well before the size limits
+		if entries > wfs.MaxEntries {
+			return "", &ErrorDeployement{
+				http.StatusRequestEntityTooLarge,
+				fmt.Errorf("archive has more than %d entries", wfs.MaxEntries),
+				fmt.Sprintf("archive exceeds the maximum of %d entries", wfs.MaxEntries),
+			}
+		}
+
+		if errName := wfs.checkEntryName(hdr); errName != nil {
+			return "", errName
+		}
+
+		// Before the path checks so that they apply to the name that is written
+		if wfs.NormalizeUnicode {
+			hdr.Name = norm.NFC.String(hdr.Name)
+			hdr.Linkname = norm.NFC.String(hdr.Linkname)
+		}
+
+		// Entries named after a device would be written to the device
+		if runtime.GOOS == "windows" && (hasWindowsReservedName(hdr.Name) || hasWindowsReservedName(hdr.Linkname)) {
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("security error: windows device name: %s", hdr.Name),
+				"invalid archive: an entry name is a reserved device name",
+			}
+		}
+
+		// Like GNU tar without -P we never write outside of target, but an absolute
+		// name is a sure sign of a hostile or broken archive
+		if path.IsAbs(hdr.Name) || filepath.IsAbs(hdr.Name) {
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("security error: absolute path: %s", hdr.Name),
+				"invalid archive: entries must have relative paths",
+			}
+		}
+
+		// Like tar --strip-components, hardlinks refer to stripped names too
+		if strip > 0 {
+			name, ok := stripComponents(hdr.Name, strip)
+			if !ok {
+				continue
+			}
+			hdr.Name = name
+			if hdr.Typeflag == tar.TypeLink {
+				if hdr.Linkname, ok = stripComponents(hdr.Linkname, strip); !ok {
+					return "", errLinkOutside(hdr.Name, hdr.Linkname)
+				}
+			}
+		}
+
+		if !wfs.selectEntry(hdr.Name) {
+			continue
+		}
+
+		if wfs.Flatten {
+			keep, errFlatten := wfs.flattenEntry(hdr, flattened)
+			if errFlatten != nil {
+				return "", errFlatten
+			}
+			if !keep {
+				continue
 			}
 		}
 
 		targetPath := filepath.Join(target, hdr.Name)
 
+		// The `./` entry of archives created from inside a directory is target itself
+		if targetPath == filepath.Clean(target) && hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
 		// Prevent path traversal attacks
 		if !strings.HasPrefix(targetPath, filepath.Clean(target)+string(os.PathSeparator)) {
-			return &ErrorDeployement{
-				http.StatusInternalServerError,
-				fmt.Errorf("security error: path traversal:  %s", hdr.Name),
-				"",
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("security error: path traversal: %s", hdr.Name),
+				"invalid archive: an entry escapes the target directory",
+			}
+		}
+
+		name := filepath.ToSlash(strings.TrimPrefix(targetPath, filepath.Clean(target)+string(os.PathSeparator)))
+		mode := wfs.entryMode(hdr)
+
+		if wfs.MaxPathDepth > 0 && depth+strings.Count(name, "/")+1 > wfs.MaxPathDepth {
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("entry %s is deeper than %d components", hdr.Name, wfs.MaxPathDepth),
+				fmt.Sprintf("invalid archive: an entry exceeds the maximum path depth of %d", wfs.MaxPathDepth),
+			}
+		}
+
+		// Inner archives are always written as opaque files, never extracted
+		if wfs.RejectNestedArchives && hdr.Typeflag != tar.TypeDir && isArchiveName(name) {
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("nested archive: %s", hdr.Name),
+				"invalid archive: nested archives are not allowed",
+			}
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			if errExtension := wfs.checkExtension(name); errExtension != nil {
+				return "", errExtension
+			}
+		}
+
+		// Without symlinks in the archive there is nothing to write through
+		if wfs.AllowSymlinks {
+			if errLink := checkNoSymlinkParent(target, targetPath); errLink != nil {
+				return "", errLink
 			}
 		}
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(targetPath, os.FileMode(hdr.Mode)); err != nil {
-				return &ErrorDeployement{
+			if wfs.PreserveArchiveModes {
+				dirModes[targetPath] = mode
+				mode |= 0700
+			}
+			if err := os.MkdirAll(targetPath, mode); err != nil {
+				return "", &ErrorDeployement{
 					http.StatusInternalServerError,
 					fmt.Errorf("failed to extract tar: %w", err),
 					"",
 				}
 			}
+			hashes.addDir(name)
+			if wfs.PreserveMTimes {
+				dirTimes[targetPath] = hdr
+			}
 		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return &ErrorDeployement{
+			if fileLimit > 0 && hdr.Size > fileLimit {
+				return "", wfs.errFileTooLarge(hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(targetPath), wfs.dirPerm); err != nil {
+				return "", &ErrorDeployement{
 					http.StatusInternalServerError,
 					fmt.Errorf("failed to extract tar: %w", err),
 					"",
 				}
 			}
-			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			outFile, err := openFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 			if err != nil {
-				return &ErrorDeployement{
+				return "", &ErrorDeployement{
 					http.StatusInternalServerError,
 					fmt.Errorf("failed to extract tar: %w", err),
 					"",
 				}
 			}
-			if _, err := io.Copy(outFile, tr); err != nil {
+			// The size of sparse and PAX entries is not always the one of the header
+			var reader io.Reader = tr
+			if fileLimit > 0 {
+				reader = io.LimitReader(tr, fileLimit+1)
+			}
+			hash := sha256.New()
+			written, err := io.Copy(io.MultiWriter(outFile, hash, progress), reader)
+			if err != nil {
+				outFile.Close()
+				return "", errInvalidArchive("failed to extract tar", err)
+			}
+			if fileLimit > 0 && written > fileLimit {
 				outFile.Close()
-				return &ErrorDeployement{
+				return "", wfs.errFileTooLarge(hdr.Name)
+			}
+			if wfs.Fsync {
+				if err := outFile.Sync(); err != nil {
+					outFile.Close()
+					return "", &ErrorDeployement{
+						http.StatusInternalServerError,
+						fmt.Errorf("failed to extract tar: %w", err),
+						"",
+					}
+				}
+			}
+			outFile.Close()
+			hashes.addFile(name, hash.Sum(nil))
+			sums[name] = hash.Sum(nil)
+			if wfs.PreserveMTimes {
+				if err := setEntryTimes(targetPath, hdr); err != nil {
+					return "", &ErrorDeployement{
+						http.StatusInternalServerError,
+						fmt.Errorf("failed to extract tar: %w", err),
+						"",
+					}
+				}
+			}
+			if wfs.PreserveArchiveModes {
+				if err := os.Chmod(targetPath, mode); err != nil {
+					return "", &ErrorDeployement{
+						http.StatusInternalServerError,
+						fmt.Errorf("failed to extract tar: %w", err),
+						"",
+					}
+				}
+			}
+		case tar.TypeSymlink:
+			if !wfs.AllowSymlinks {
+				continue
+			}
+			if filepath.IsAbs(hdr.Linkname) || !isWithin(filepath.Clean(target), filepath.Join(filepath.Dir(targetPath), hdr.Linkname)) {
+				return "", errLinkOutside(hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(targetPath), wfs.dirPerm); err != nil {
+				return "", &ErrorDeployement{
 					http.StatusInternalServerError,
 					fmt.Errorf("failed to extract tar: %w", err),
 					"",
 				}
 			}
-			outFile.Close()
+			if err := os.Symlink(hdr.Linkname, targetPath); err != nil {
+				return "", &ErrorDeployement{
+					http.StatusInternalServerError,
+					fmt.Errorf("failed to extract tar: %w", err),
+					"",
+				}
+			}
+			symlinks = append(symlinks, targetPath)
+			sum := sha256.Sum256([]byte(hdr.Linkname))
+			hashes.addFile(name, sum[:])
+		case tar.TypeLink:
+			if !wfs.AllowSymlinks {
+				continue
+			}
+			linkTarget := filepath.Join(target, hdr.Linkname)
+			if !isWithin(filepath.Clean(target), linkTarget) || linkTarget == filepath.Clean(target) {
+				return "", errLinkOutside(hdr.Name, hdr.Linkname)
+			}
+			if errLink := checkNoSymlinkParent(target, linkTarget); errLink != nil {
+				return "", errLink
+			}
+			if err := os.MkdirAll(filepath.Dir(targetPath), wfs.dirPerm); err != nil {
+				return "", &ErrorDeployement{
+					http.StatusInternalServerError,
+					fmt.Errorf("failed to extract tar: %w", err),
+					"",
+				}
+			}
+			if err := os.Link(linkTarget, targetPath); err != nil {
+				status, public := http.StatusInternalServerError, ""
+				if errors.Is(err, os.ErrNotExist) {
+					status, public = http.StatusBadRequest, "invalid archive: a hardlink points to a missing entry"
+				}
+				return "", &ErrorDeployement{status, fmt.Errorf("failed to extract tar: %w", err), public}
+			}
+			linkName := filepath.ToSlash(strings.TrimPrefix(linkTarget, filepath.Clean(target)+string(os.PathSeparator)))
+			hashes.addFile(name, hashes[linkName])
+			if sum, ok := sums[linkName]; ok {
+				sums[name] = sum
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return "", &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("security error: special file: %s", hdr.Name),
+				"invalid archive: device and fifo entries are not supported",
+			}
 		default:
-			// We ignore other types
+			// We ignore other types, like the global headers of some archivers
+			wfs.logger.Log(zapcore.DebugLevel, "ignoring tar entry", zap.String("name", hdr.Name), zap.String("type", string(hdr.Typeflag)))
+		}
+	}
+
+	for _, link := range symlinks {
+		if !symlinkStaysWithin(target, link) {
+			linkname, _ := os.Readlink(link)
+			return "", errLinkOutside(link, linkname)
+		}
+	}
+
+	// Children come first, a parent could lose the search permission they are reached
+	// through
+	dirs := make([]string, 0, len(dirModes))
+	for dir := range dirModes {
+		dirs = append(dirs, dir)
+	}
+	slices.SortFunc(dirs, func(a string, b string) int { return len(b) - len(a) })
+	for _, dir := range dirs {
+		if err := os.Chmod(dir, dirModes[dir]); err != nil {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to extract tar: %w", err),
+				"",
+			}
+		}
+	}
+
+	for dir, hdr := range dirTimes {
+		if err := setEntryTimes(dir, hdr); err != nil {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to extract tar: %w", err),
+				"",
+			}
+		}
+	}
+
+	// The hashes of the extraction spare reading the files again
+	if wfs.GenerateManifest {
+		if errManifest := wfs.writeChecksumManifest(target, sums); errManifest != nil {
+			return "", errManifest
 		}
 	}
+
+	// The entries of the directories must be durable too, not only their content
+	if wfs.Fsync {
+		if err := syncDirectories(target); err != nil {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to extract tar: %w", err),
+				"",
+			}
+		}
+	}
+
+	progress.done()
+	return hashes.etag(), nil
+}
+
+// Count the entries and bytes of an extraction, and log its progress at debug level so
+// that operators can tell a stuck deploy from a slow one. Nothing is logged until
+// ProgressLogMB megabytes are written, then a line is logged every ProgressLogMB
+// megabytes or PROGRESS_LOG_ENTRIES entries.
+type extractProgress struct {
+	ctx      context.Context
+	logger   *zap.Logger
+	target   string
+	interval int64
+	start    time.Time
+
+	entries int
+	bytes   int64
+	// Counters at which the next line is logged
+	nextBytes   int64
+	nextEntries int
+}
+
+// Return the progress of an extraction into target. It only counts when ProgressLogMB
+// is 0. Its writes fail once ctx is done, which aborts the copies of the extraction.
+func (wfs *WritableFileServer) newExtractProgress(ctx context.Context, target string) *extractProgress {
+	interval := int64(wfs.ProgressLogMB) * 1024 * 1024
+	nextBytes := interval
+	if interval == 0 {
+		nextBytes = math.MaxInt64
+	}
+	return &extractProgress{
+		ctx:         ctx,
+		logger:      wfs.logger,
+		target:      target,
+		interval:    interval,
+		start:       time.Now(),
+		nextBytes:   nextBytes,
+		nextEntries: math.MaxInt,
+	}
+}
+
+// Count an entry of the archive
+func (p *extractProgress) entry() {
+	p.entries++
+	if p.entries >= p.nextEntries {
+		p.log("extraction progress")
+	}
+}
+
+// Count the bytes of the extracted files. It only adds and compares counters so that
+// it can sit in the copy of every file.
+func (p *extractProgress) Write(b []byte) (int, error) {
+	if err := context.Cause(p.ctx); err != nil {
+		return 0, err
+	}
+	p.bytes += int64(len(b))
+	if p.bytes >= p.nextBytes {
+		p.log("extraction progress")
+	}
+	return len(b), nil
+}
+
+// Log the end of an extraction that logged its progress
+func (p *extractProgress) done() {
+	if p.interval == 0 || p.bytes < p.interval {
+		return
+	}
+	p.log("extraction done")
+}
+
+func (p *extractProgress) log(msg string) {
+	p.logger.Log(
+		zapcore.DebugLevel, msg,
+		zap.String("target", p.target),
+		zap.Int("entries", p.entries),
+		zap.Int64("bytes", p.bytes),
+		zap.Duration("elapsed", time.Since(p.start)),
+	)
+	p.nextBytes = p.bytes + p.interval
+	p.nextEntries = p.entries + PROGRESS_LOG_ENTRIES
+}
+
+// Reject the entries whose name or link name contains NUL or control characters, which
+// can forge log lines or confuse the tools reading the site. With SanitizeEntryNames
+// they are replaced with `_` instead.
+func (wfs *WritableFileServer) checkEntryName(hdr *tar.Header) *ErrorDeployement {
+	if !hasControl(hdr.Name) && !hasControl(hdr.Linkname) {
+		return nil
+	}
+	if !wfs.SanitizeEntryNames {
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("security error: control character in entry name: %q", hdr.Name),
+			"invalid archive: an entry name contains control characters",
+		}
+	}
+
+	sanitize := func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}
+	name := strings.Map(sanitize, hdr.Name)
+	wfs.logger.Log(zapcore.DebugLevel, "sanitized tar entry name", zap.String("name", name))
+	hdr.Name = name
+	hdr.Linkname = strings.Map(sanitize, hdr.Linkname)
 	return nil
 }
+
+// Return true if s contains NUL or another control character
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// Returned for the files of archives larger than MaxFileSizeMB
+func (wfs *WritableFileServer) errFileTooLarge(name string) *ErrorDeployement {
+	return &ErrorDeployement{
+		http.StatusRequestEntityTooLarge,
+		fmt.Errorf("entry %s is larger than %d MB", name, wfs.MaxFileSizeMB),
+		fmt.Sprintf("archive contains a file exceeding the maximum size of %d MB", wfs.MaxFileSizeMB),
+	}
+}
+
+// Extensions of the archives rejected inside archives by RejectNestedArchives
+var archiveExtensions = []string{
+	".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.bz2", ".tbz2", ".tar.zst", ".tzst",
+	".zip", ".7z", ".rar",
+}
+
+// Return true if name looks like an archive. Plain `.gz` files are not archives, they
+// are often precompressed assets.
+func isArchiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the archive entry name should be extracted according to the Include and
+// Exclude options. Excludes take precedence.
+func (wfs *WritableFileServer) selectEntry(name string) bool {
+	name = strings.Trim(path.Clean(name), "/")
+	if matchEntry(wfs.Exclude, name) {
+		return false
+	}
+	return len(wfs.Include) == 0 || matchEntry(wfs.Include, name)
+}
+
+// Return true if one of the glob patterns matches name or one of its parents. Patterns
+// without a slash are matched against each component of name instead.
+func matchEntry(patterns []string, name string) bool {
+	components := strings.Split(name, "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		for i := range components {
+			candidate := strings.Join(components[:i+1], "/")
+			if !strings.Contains(pattern, "/") {
+				candidate = components[i]
+			}
+			// Patterns are checked by Validate
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove the n leading components of the archive path name. The boolean is false if
+// nothing remains.
+func stripComponents(name string, n int) (string, bool) {
+	components := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+	if len(components) <= n {
+		return "", false
+	}
+	return strings.Join(components[n:], "/"), true
+}
+
+// Rename the entry hdr to its base name for Flatten. flattened maps the base names
+// already written to the entry names they come from. Return false for the entries that
+// are not written: directories, and links when they are not allowed.
+func (wfs *WritableFileServer) flattenEntry(hdr *tar.Header, flattened map[string]string) (bool, *ErrorDeployement) {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return false, nil
+	case tar.TypeSymlink:
+		if !wfs.AllowSymlinks {
+			return false, nil
+		}
+		return false, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("cannot flatten the symlink %s", hdr.Name),
+			"invalid archive: symlinks cannot be flattened",
+		}
+	case tar.TypeLink:
+		if !wfs.AllowSymlinks {
+			return false, nil
+		}
+		linkname := path.Clean(hdr.Linkname)
+		if flattened[path.Base(linkname)] != linkname {
+			return false, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("hardlink %s to the missing file %s", hdr.Name, hdr.Linkname),
+				"invalid archive: a hardlink points to a missing entry",
+			}
+		}
+		hdr.Linkname = path.Base(linkname)
+	case tar.TypeReg:
+	default:
+		// Rejected or ignored by the extraction
+		return true, nil
+	}
+
+	name := path.Clean(hdr.Name)
+	base := path.Base(name)
+	if previous, ok := flattened[base]; ok {
+		return false, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("cannot flatten %s and %s: same base name", previous, name),
+			fmt.Sprintf("archive has several files named %s: they cannot be flattened", base),
+		}
+	}
+	flattened[base] = name
+	hdr.Name = base
+	return true, nil
+}
+
+// Apply the modification time of an entry to path. The access time is the one of the
+// entry when the archive has it, its modification time otherwise.
+func setEntryTimes(path string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(path, atime, hdr.ModTime)
+}
+
+// Return the permissions of an extracted entry. Setuid and setgid bits are always
+// stripped, the sticky bit is only kept when preserving the archive modes.
+func (wfs *WritableFileServer) entryMode(hdr *tar.Header) os.FileMode {
+	if wfs.PreserveArchiveModes {
+		return hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSticky) &^ wfs.umask
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return wfs.dirPerm
+	}
+	return wfs.filePerm
+}
@@ -0,0 +1,65 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Name of the file created and removed in the root by health checks. Its temporary
+// name is removed with the stale artifacts if the server dies in the middle of one.
+const HEALTH_FILE = ".health"
+
+// Body of the responses of HealthPath
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Answer the health checks of orchestrators on HealthPath: 200 if a file can be created
+// and removed in root, 503 otherwise, like when its volume was remounted read-only. The
+// path is reserved, other methods than GET and HEAD are refused.
+func (wfs *WritableFileServer) HandleHealth(id string, root string, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return wfs.handleError(id, w, r, &ErrorDeployement{
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s on the health path", r.Method),
+			"the health path only answers GET and HEAD",
+		})
+	}
+
+	// Probes must never get a cached answer
+	w.Header().Set("Cache-Control", "no-store")
+	if err := wfs.checkWritable(id, root); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "health check failed", zap.String("id", id), zap.String("root", root), zap.Error(err))
+		return writeJSON(w, http.StatusServiceUnavailable, healthResponse{"unhealthy", "the root is not writable"})
+	}
+	return writeJSON(w, http.StatusOK, healthResponse{"healthy", ""})
+}
+
+// Create a file in root and remove it
+func (wfs *WritableFileServer) checkWritable(id string, root string) error {
+	if root == "" {
+		return errors.New("root resolved empty")
+	}
+	if errBase := wfs.checkBaseRoot(root); errBase != nil {
+		return errBase
+	}
+
+	probe := getTempPath(id, filepath.Join(strings.TrimSuffix(root, "/"), HEALTH_FILE))
+	file, err := openFile(probe, os.O_CREATE|os.O_EXCL|os.O_WRONLY, wfs.filePerm)
+	if err != nil {
+		return err
+	}
+	_, errWrite := file.Write([]byte("ok"))
+	errClose := file.Close()
+	errRemove := os.Remove(probe)
+	return errors.Join(errWrite, errClose, errRemove)
+}
@@ -0,0 +1,80 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return the status and body of a GET on the health path
+func getHealth(t *testing.T, wfs *WritableFileServer) (int, healthResponse) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/.health", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+
+	var body healthResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	return w.Code, body
+}
+
+func TestHealth(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.HealthPath = "/.health"
+
+	status, body := getHealth(t, wfs)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "healthy", body.Status)
+
+	// The volume of the root is remounted read-only
+	original := openFile
+	t.Cleanup(func() { openFile = original })
+	openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+	status, body = getHealth(t, wfs)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "unhealthy", body.Status)
+
+	openFile = original
+	status, _ = getHealth(t, wfs)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The probe leaves nothing behind
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestHealthMissingRoot(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.HealthPath = "/.health"
+	os.RemoveAll(wfs.Root)
+
+	status, body := getHealth(t, wfs)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "unhealthy", body.Status)
+}
+
+func TestHealthReservedPath(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.HealthPath = "/.health"
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/.health", newFile())
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusMethodNotAllowed, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+	assert.NoFileExists(t, wfs.Root+"/.health")
+}
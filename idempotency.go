@@ -0,0 +1,97 @@
+package caddy_writable_file_server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default duration for which the result of a deploy is kept for its Idempotency-Key
+const IDEMPOTENCY_TTL = 24 * time.Hour
+
+// Results of completed deploys, shared by every instance of the handler like the locks
+var idempotencyKeys = newIdempotencyCache()
+
+// The result of a completed deploy, returned again to the retries of its request
+type idempotentResult struct {
+	method string
+	path   string
+	status int
+	etag   string
+	// The body written by the handler, like the results of a 207 Multi-Status
+	body        []byte
+	contentType string
+	expires     time.Time
+}
+
+// Cache the results of completed deploys by the Idempotency-Key of their request so
+// that a retried deploy is not applied twice.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	results map[string]idempotentResult
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{results: map[string]idempotentResult{}}
+}
+
+// Return the result stored for key, if it has not expired
+func (c *idempotencyCache) get(key string) (idempotentResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.results[key]
+	if ok && time.Now().After(result.expires) {
+		delete(c.results, key)
+		return idempotentResult{}, false
+	}
+	return result, ok
+}
+
+// Store the result of a completed deploy for key and evict the expired ones
+func (c *idempotencyCache) put(key string, result idempotentResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, r := range c.results {
+		if now.After(r.expires) {
+			delete(c.results, k)
+		}
+	}
+	c.results[key] = result
+}
+
+// Return the cache key of the Idempotency-Key of r, or an empty string if it has none.
+// Keys are scoped by root so that two sites cannot replay the deploys of each other.
+func idempotencyKey(root string, r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return ""
+	}
+	return root + "\x00" + key
+}
+
+// Write the stored result of a retried deploy. A key reused for another request is
+// rejected with 422 Unprocessable Entity.
+func (wfs *WritableFileServer) replayResult(w http.ResponseWriter, r *http.Request, result idempotentResult) (int, *ErrorDeployement) {
+	if result.method != r.Method || result.path != r.URL.Path {
+		return 0, &ErrorDeployement{
+			http.StatusUnprocessableEntity,
+			fmt.Errorf("idempotency key reused for %s %s, first used for %s %s", r.Method, r.URL.Path, result.method, result.path),
+			"Idempotency-Key was already used for another request",
+		}
+	}
+
+	if result.etag != "" {
+		w.Header().Set("ETag", result.etag)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	if result.body != nil {
+		w.Header().Set("Content-Type", result.contentType)
+		w.WriteHeader(result.status)
+		w.Write(result.body)
+	}
+	return result.status, nil
+}
@@ -0,0 +1,115 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a PUT of content to path with the given Idempotency-Key
+func putIdempotent(wfs *WritableFileServer, path string, key string, content string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path, bytes.NewBufferString(content))
+	r.Header.Set("Idempotency-Key", key)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	first, err := putIdempotent(wfs, "/test.txt", "deploy-1", "first")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// The retry is not deployed, even with another body
+	second, err := putIdempotent(wfs, "/test.txt", "deploy-1", "second")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	content, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(content))
+
+	// Another key deploys again
+	third, err := putIdempotent(wfs, "/test.txt", "deploy-2", "third")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, third.Code)
+
+	content, err = os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "third", string(content))
+}
+
+func TestIdempotencyKeyReusedForAnotherPath(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	_, err := putIdempotent(wfs, "/test.txt", "deploy-1", "first")
+	assert.NoError(t, err)
+
+	w, err := putIdempotent(wfs, "/other.txt", "deploy-1", "first")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnprocessableEntity, errHandler.StatusCode)
+	assert.Equal(t, "Idempotency-Key was already used for another request\n", w.Body.String())
+	assert.NoFileExists(t, wfs.Root+"/other.txt")
+}
+
+func TestIdempotencyKeyFailureNotCached(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	_, err := putIdempotent(wfs, "/test.txt", "deploy-1", string(make([]byte, 2<<20)))
+	assert.Error(t, err)
+
+	// The retry of a failed deploy is deployed
+	w, err := putIdempotent(wfs, "/test.txt", "deploy-1", "retried")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
+
+func TestIdempotencyKeyExpired(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.IdempotencyTTL = caddy.Duration(time.Millisecond)
+
+	_, err := putIdempotent(wfs, "/test.txt", "deploy-1", "first")
+	assert.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	w, err := putIdempotent(wfs, "/test.txt", "deploy-1", "second")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	content, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+}
+
+func TestIdempotencyCacheEviction(t *testing.T) {
+	cache := newIdempotencyCache()
+	cache.put("expired", idempotentResult{expires: time.Now().Add(-time.Second)})
+	cache.put("valid", idempotentResult{expires: time.Now().Add(time.Hour)})
+
+	assert.Len(t, cache.results, 1)
+	_, ok := cache.get("valid")
+	assert.True(t, ok)
+	_, ok = cache.get("expired")
+	assert.False(t, ok)
+}
@@ -0,0 +1,84 @@
+package caddy_writable_file_server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Deploys in progress, shared by every instance of the handler like the locks
+var inflight singleflight.Group
+
+// Headers changing the outcome of a PUT. Two requests are only identical if they
+// agree on all of them.
+var inflightHeaders = []string{
+	"Digest",
+	"Content-Type",
+	"Content-Encoding",
+	"X-Deploy-Mode",
+	"X-Deploy-Strategy",
+	"X-Strip-Components",
+	"X-Deploy-Timeout",
+	"If-Match",
+	"If-None-Match",
+	"Idempotency-Key",
+}
+
+// Headers of the response of a deploy returned to the identical requests
+var inflightResponseHeaders = []string{"ETag", "Last-Modified", "Location", "Retry-After"}
+
+// The result of a deploy shared with the identical requests received while it ran
+type inflightResult struct {
+	status int
+	header http.Header
+	err    *ErrorDeployement
+}
+
+// Return the key identifying the identical deploys of r, or an empty string if r cannot
+// be shared. Only PUT requests whose body is identified by a `Digest` header qualify.
+func inflightKey(root string, target string, r *http.Request) string {
+	if r.Method != http.MethodPut || r.Header.Get("Digest") == "" || r.Header.Get("Content-Range") != "" || r.URL.RawQuery != "" {
+		return ""
+	}
+
+	key := []string{root, target}
+	for _, header := range inflightHeaders {
+		key = append(key, strings.Join(r.Header.Values(header), ","))
+	}
+	return strings.Join(key, "\x00")
+}
+
+// Deploy r like deploy, unless an identical deploy is already in progress, in which
+// case its result is returned once it is done instead of extracting the body again.
+func (wfs *WritableFileServer) deployOnce(id string, root string, target string, destination string, lockTargets []string, start time.Time, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	key := inflightKey(root, target, r)
+	if key == "" {
+		return wfs.deploy(id, root, target, destination, lockTargets, start, w, r)
+	}
+
+	// The function only runs for the first request, the others wait for its result
+	leader := false
+	value, _, _ := inflight.Do(key, func() (any, error) {
+		leader = true
+		status, err := wfs.deploy(id, root, target, destination, lockTargets, start, w, r)
+		return inflightResult{status, w.Header().Clone(), err}, nil
+	})
+	result := value.(inflightResult)
+	if leader {
+		return result.status, result.err
+	}
+
+	if result.err != nil {
+		// handleError updates the error of each request
+		err := *result.err
+		return 0, &err
+	}
+	for _, header := range inflightResponseHeaders {
+		if value := result.header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	return result.status, nil
+}
@@ -0,0 +1,91 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Count the files opened for extraction
+func countExtractions(t *testing.T) *atomic.Int32 {
+	counter := &atomic.Int32{}
+	original := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+		counter.Add(1)
+		return original(name, flag, perm)
+	}
+	t.Cleanup(func() { openFile = original })
+	return counter
+}
+
+func TestIdenticalConcurrentDeploys(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	extractions := countExtractions(t)
+
+	content := "shared content"
+	sum := sha256.Sum256([]byte(content))
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	// The body of the first request is held until the second one is waiting for it
+	reader, writer := io.Pipe()
+	bodies := []io.Reader{reader, &trackingReader{reader: strings.NewReader(content)}}
+
+	recorders := make([]*httptest.ResponseRecorder, len(bodies))
+	wg := sync.WaitGroup{}
+	for i, body := range bodies {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", body)
+		r.Header.Set("Digest", digest)
+		recorders[i] = httptest.NewRecorder()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, wfs.ServeHTTP(recorders[i], r, &MockHandler{}))
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	writer.Write([]byte(content))
+	writer.Close()
+	wg.Wait()
+
+	assert.Equal(t, int32(1), extractions.Load())
+	assert.Equal(t, int64(0), bodies[1].(*trackingReader).n.Load())
+	for _, w := range recorders {
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, recorders[0].Header().Get("ETag"), w.Header().Get("ETag"))
+	}
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestInflightKey(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/test.txt", nil)
+	assert.Empty(t, inflightKey("/srv", "/srv/test.txt", r))
+
+	r.Header.Set("Digest", "sha-256=abc")
+	key := inflightKey("/srv", "/srv/test.txt", r)
+	assert.NotEmpty(t, key)
+
+	// Requests that would deploy differently are not identical
+	r.Header.Set("X-Deploy-Mode", "merge")
+	assert.NotEqual(t, key, inflightKey("/srv", "/srv/test.txt", r))
+
+	r.Header.Set("Content-Range", "bytes 0-1/2")
+	assert.Empty(t, inflightKey("/srv", "/srv/test.txt", r))
+}
@@ -0,0 +1,196 @@
+package caddy_writable_file_server
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum number of symlinks followed while resolving a symlink
+const MAX_SYMLINK_HOPS = 255
+
+// Return true if path is root or inside of it. Both paths must be cleaned.
+func isWithin(root string, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(os.PathSeparator))
+}
+
+// Reject path if one of its parents below root is a symlink, so that extraction never
+// writes through a symlink of the archive. Remove path itself if it is a symlink since
+// the new entry replaces it.
+func checkNoSymlinkParent(root string, path string) *ErrorDeployement {
+	parent, err := symlinkParent(root, path)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to check parents of %s: %w", path, err),
+			"",
+		}
+	}
+	if parent != "" {
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("security error: entry %s is inside the symlink %s", path, parent),
+			"invalid archive: an entry is inside a symlink",
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to replace symlink %s: %w", path, err),
+				"",
+			}
+		}
+	}
+	return nil
+}
+
+// Return the first parent of path below root that is a symlink, or an empty string if
+// there is none
+func symlinkParent(root string, path string) (string, error) {
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	current := root
+	for _, component := range strings.Split(rel, string(os.PathSeparator)) {
+		if component == "." {
+			continue
+		}
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if err != nil {
+			break // The rest of the path does not exist yet
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return current, nil
+		}
+	}
+	return "", nil
+}
+
+// Return true if resolving the symlink at link never leaves root, including through the
+// other symlinks it goes through. The missing parts of dangling links are resolved
+// lexically.
+func symlinkStaysWithin(root string, link string) bool {
+	return resolvesWithin(filepath.Clean(root), link, filepath.Dir(link), func(path string) string { return path })
+}
+
+// Return true if the symlink at link, inside the tree source, still resolves within
+// root once source is relocated to dest by a MOVE or a COPY. The parts of the resolution
+// inside dest are looked up in source and, when moved, the ones left in source are gone.
+func relocatedSymlinkStaysWithin(root string, link string, source string, dest string, moved bool) bool {
+	rel, err := filepath.Rel(source, filepath.Dir(link))
+	if err != nil {
+		return false
+	}
+	return resolvesWithin(filepath.Clean(root), link, filepath.Join(dest, rel), func(path string) string {
+		if isWithin(dest, path) {
+			rel, _ := filepath.Rel(dest, path)
+			return filepath.Join(source, rel)
+		}
+		if moved && isWithin(source, path) {
+			return ""
+		}
+		return path
+	})
+}
+
+// Resolve the symlink at link from the directory dir, looking up each path at the path
+// returned by lookup, or nowhere if it is empty. Return true if it never leaves root.
+func resolvesWithin(root string, link string, dir string, lookup func(path string) string) bool {
+	dest, err := os.Readlink(link)
+	if err != nil || filepath.IsAbs(dest) {
+		return false
+	}
+
+	current := dir
+	remaining := strings.Split(filepath.ToSlash(dest), "/")
+	hops := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			if !isWithin(root, current) {
+				return false
+			}
+			continue
+		}
+
+		next := filepath.Join(current, component)
+		found := lookup(next)
+		if found == "" {
+			current = next
+			continue
+		}
+		info, err := os.Lstat(found)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		hops++
+		if hops > MAX_SYMLINK_HOPS {
+			return false
+		}
+		dest, err := os.Readlink(found)
+		if err != nil || filepath.IsAbs(dest) {
+			return false
+		}
+		remaining = append(strings.Split(filepath.ToSlash(dest), "/"), remaining...)
+	}
+	return true
+}
+
+// Refuse to relocate the tree source to dest, see relocatedSymlinkStaysWithin, if one
+// of its symlinks would point outside of root from there. A link that is fine deep in a
+// tree can climb out of the root once the tree is moved up.
+func checkRelocatedSymlinks(root string, source string, dest string, moved bool) *ErrorDeployement {
+	var escaping string
+	err := filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type()&os.ModeSymlink != 0 && !relocatedSymlinkStaysWithin(root, path, source, dest, moved) {
+			escaping = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to check the symlinks of %s: %w", source, err),
+			"",
+		}
+	}
+	if escaping != "" {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("security error: symlink %s would point outside of the root at %s", escaping, dest),
+			"a symlink would point outside of the root at the destination",
+		}
+	}
+	return nil
+}
+
+// Error returned for links pointing outside of the extracted directory
+func errLinkOutside(name string, linkname string) *ErrorDeployement {
+	return &ErrorDeployement{
+		http.StatusBadRequest,
+		fmt.Errorf("security error: link %s points outside of the target: %s", name, linkname),
+		"invalid archive: a link points outside of the target",
+	}
+}
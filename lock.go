@@ -0,0 +1,178 @@
+package caddy_writable_file_server
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often LockTimeout checks whether a held lock was released
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// Serialize requests that touch the same top-level entry of a root while letting
+// requests on unrelated entries run concurrently.
+//
+// Requests on the root itself conflict with every other request of that root so they
+// take its global lock exclusively, everything else takes it shared. The global lock
+// of a root lives in the same map as the entry locks, keyed by the cleaned root, so
+// that deploys to different roots never wait on each other.
+type pathLocker struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newPathLocker() *pathLocker {
+	return &pathLocker{locks: map[string]*pathLock{}}
+}
+
+// Lock every entry of root touched by targets and return the function releasing them.
+func (pl *pathLocker) Lock(root string, targets ...string) func() {
+	global := filepath.Clean(root)
+	keys, ok := lockKeys(root, targets)
+	if !ok {
+		pl.acquire(global).Lock()
+		return func() { pl.release(global) }
+	}
+
+	pl.acquire(global).RLock()
+	for _, key := range keys {
+		pl.acquire(key).Lock()
+	}
+	return pl.unlocker(global, keys)
+}
+
+// Like Lock but give up once timeout has elapsed, in which case nothing is held and
+// the boolean is false. A timeout of 0 waits forever.
+func (pl *pathLocker) LockTimeout(root string, timeout time.Duration, targets ...string) (func(), bool) {
+	if timeout == 0 {
+		return pl.Lock(root, targets...), true
+	}
+	deadline := time.Now().Add(timeout)
+
+	global := filepath.Clean(root)
+	keys, ok := lockKeys(root, targets)
+	if !ok {
+		if !retryUntil(deadline, pl.acquire(global).TryLock) {
+			pl.abandon(global)
+			return nil, false
+		}
+		return func() { pl.release(global) }, true
+	}
+
+	if !retryUntil(deadline, pl.acquire(global).TryRLock) {
+		pl.abandon(global)
+		return nil, false
+	}
+	for i, key := range keys {
+		if !retryUntil(deadline, pl.acquire(key).TryLock) {
+			pl.abandon(key)
+			pl.unlocker(global, keys[:i])()
+			return nil, false
+		}
+	}
+	return pl.unlocker(global, keys), true
+}
+
+// Return the function releasing keys and the shared global lock of their root
+func (pl *pathLocker) unlocker(global string, keys []string) func() {
+	return func() {
+		for _, key := range keys {
+			pl.release(key)
+		}
+		pl.releaseShared(global)
+	}
+}
+
+func (pl *pathLocker) acquire(key string) *pathLock {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	l, ok := pl.locks[key]
+	if !ok {
+		l = &pathLock{}
+		pl.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// Unlock key and forget about it once nobody is waiting on it.
+func (pl *pathLocker) release(key string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.locks[key].Unlock()
+	pl.unref(key)
+}
+
+// Release the shared hold on the global lock key.
+func (pl *pathLocker) releaseShared(key string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.locks[key].RUnlock()
+	pl.unref(key)
+}
+
+// Stop waiting on key without having locked it.
+func (pl *pathLocker) abandon(key string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.unref(key)
+}
+
+// Must be called with pl.mu held
+func (pl *pathLocker) unref(key string) {
+	l := pl.locks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(pl.locks, key)
+	}
+}
+
+// Return the sorted top-level entries of root touched by targets. The boolean is false
+// if one of them is the root itself, which requires the global lock of root.
+func lockKeys(root string, targets []string) ([]string, bool) {
+	keys := make([]string, 0, len(targets))
+	for _, target := range targets {
+		key, ok := lockKey(root, target)
+		if !ok {
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+
+	// Always acquire in the same order to avoid deadlocks between multi-target requests
+	slices.Sort(keys)
+	return slices.Compact(keys), true
+}
+
+// Call try until it succeeds or deadline is passed
+func retryUntil(deadline time.Time, try func() bool) bool {
+	for !try() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+	return true
+}
+
+// Return the top-level entry of root containing target. The boolean is false if
+// target is the root itself (or outside of it).
+func lockKey(root string, target string) (string, bool) {
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	segment, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return filepath.Join(root, segment), true
+}
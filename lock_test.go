@@ -0,0 +1,127 @@
+package caddy_writable_file_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockKey(t *testing.T) {
+	var tests = []struct {
+		target string
+		key    string
+		ok     bool
+	}{
+		{"/srv/www/", "", false},
+		{"/srv/www", "", false},
+		{"/srv/other/file", "", false},
+		{"/srv/www/file", "/srv/www/file", true},
+		{"/srv/www/dir/", "/srv/www/dir", true},
+		{"/srv/www/dir/sub/file", "/srv/www/dir", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			key, ok := lockKey("/srv/www", test.target)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.key, key)
+		})
+	}
+}
+
+func TestLockUnrelatedPathsConcurrently(t *testing.T) {
+	pl := newPathLocker()
+
+	unlock := pl.Lock("/srv/www", "/srv/www/a/file")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pl.Lock("/srv/www", "/srv/www/b/")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("lock on an unrelated path should not block")
+	}
+}
+
+func TestLockRootsIndependently(t *testing.T) {
+	pl := newPathLocker()
+
+	// Even a deploy of a whole root leaves the other roots alone
+	unlock := pl.Lock("/srv/www", "/srv/www/")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pl.Lock("/srv/other/", "/srv/other/")()
+		pl.Lock("/srv/other", "/srv/other/a/file")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("lock on another root should not block")
+	}
+}
+
+func TestLockConflictingPaths(t *testing.T) {
+	var tests = map[string]string{
+		"same entry": "/srv/www/a/other",
+		"root":       "/srv/www/",
+	}
+
+	for name, target := range tests {
+		t.Run(name, func(t *testing.T) {
+			pl := newPathLocker()
+			unlock := pl.Lock("/srv/www", "/srv/www/a/file")
+
+			done := make(chan struct{})
+			go func() {
+				pl.Lock("/srv/www", target)()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				t.Error("lock on a conflicting path should block")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			unlock()
+			<-done
+			assert.Empty(t, pl.locks, "locks should be pruned once released")
+		})
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	var tests = map[string]string{
+		"same entry": "/srv/www/a/other",
+		"root":       "/srv/www/",
+	}
+
+	for name, target := range tests {
+		t.Run(name, func(t *testing.T) {
+			pl := newPathLocker()
+			unlock := pl.Lock("/srv/www", "/srv/www/a/file")
+
+			start := time.Now()
+			_, ok := pl.LockTimeout("/srv/www", 50*time.Millisecond, "/srv/www/b/file", target)
+			assert.False(t, ok)
+			assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+			// Nothing is held after giving up
+			unlock()
+			unlock, ok = pl.LockTimeout("/srv/www", 50*time.Millisecond, "/srv/www/b/file", target)
+			assert.True(t, ok)
+			unlock()
+			assert.Empty(t, pl.locks, "locks should be pruned once released")
+		})
+	}
+}
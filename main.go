@@ -1,41 +1,310 @@
 package caddy_writable_file_server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/unicode/norm"
 )
 
 const DIR_PERM = 0740
 const FILE_PERM = 0640
+const MAX_ENTRIES = 100000
 
-var lock sync.Mutex = sync.Mutex{}
+const (
+	DEPLOY_MODE_REPLACE = "replace"
+	DEPLOY_MODE_MERGE   = "merge"
+)
+
+// Shared by every instance so that a config reload does not allow conflicting deploys
+var locks = newPathLocker()
 
 func init() {
 	caddy.RegisterModule(WritableFileServer{})
+	httpcaddyfile.RegisterHandlerDirective("writable_file_server", parseCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("writable_file_server", httpcaddyfile.Before, "file_server")
 	// TODO: unit tests
 	// TODO: integration tests (add file, add tar, add tar.gz, delete file, delete directory)
-	// TODO: only use ErrorDeployement on not 500 errors
-	// TODO: add end of line on error message
 }
 
 type WritableFileServer struct {
 	// The path to the root of the site. Default is `{http.vars.root}`
 	Root string `json:"root,omitempty"`
 
+	// The directory the resolved Root must be strictly inside, for roots built from the
+	// request like `/srv/sites/{http.auth.user.id}`. Default is none
+	BaseRoot string `json:"base_root,omitempty"`
+
+	// The maximum size of a request body in megabytes. Default is 0 (unlimited)
+	MaxSizeMB int `json:"max_size_mb,omitempty"`
+
+	// Accept file uploads with an empty body, which create an empty file. When false
+	// they are rejected as a client mistake. Default is true
+	AllowEmptyUpload *bool `json:"allow_empty_upload,omitempty"`
+
+	// The maximum size of a compressed archive once decompressed, in megabytes. Default
+	// is 0 (unlimited)
+	MaxUncompressedMB int `json:"max_uncompressed_mb,omitempty"`
+
+	// The maximum number of entries in an archive. Default is 100000
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// The maximum size of each file of an archive, in megabytes. Default is 0 (unlimited)
+	MaxFileSizeMB int `json:"max_file_size_mb,omitempty"`
+
+	// The number of leading components removed from the entry names of archives, like
+	// `tar --strip-components`. Can be overridden per request with the
+	// `X-Strip-Components` header. Default is 0
+	StripComponents int `json:"strip_components,omitempty"`
+
+	// Write the files of archives directly into the target by their base name, without
+	// the directories of the archive. Files with the same base name are rejected with
+	// 409. Default is false
+	Flatten bool `json:"flatten,omitempty"`
+
+	// Only extract the entries of archives matching one of these glob patterns. Patterns
+	// without a slash match any component of the entry names, others match the entry
+	// names or their parents. Default is to extract everything
+	Include []string `json:"include,omitempty"`
+
+	// Skip the entries of archives matching one of these glob patterns, even if they
+	// are included. They are matched like Include
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Files, relative to the uploaded directory, that must exist once a directory upload
+	// is extracted for it to go live. Default is none
+	RequireFiles []string `json:"require_files,omitempty"`
+
+	// The maximum number of components of the paths written below the root, both for
+	// request paths and the entries of archives. Default is 0 (unlimited)
+	MaxPathDepth int `json:"max_path_depth,omitempty"`
+
+	// Log the progress of uploads at debug level every this many megabytes written, and
+	// every 10000 entries once past it. Default is 0 (disabled)
+	ProgressLogMB int `json:"progress_log_mb,omitempty"`
+
+	// Refuse the archives containing entries named like archives (`.tar.gz`, `.zip`...),
+	// for sites that must be a flat tree. Inner archives are never extracted either
+	// way. Default is false
+	RejectNestedArchives bool `json:"reject_nested_archives,omitempty"`
+
+	// Replace the NUL and control characters of the entry names of archives with `_`
+	// instead of rejecting the upload. Default is false
+	SanitizeEntryNames bool `json:"sanitize_entry_names,omitempty"`
+
+	// Convert the request paths and the entry names of archives to the composed Unicode
+	// form (NFC), so that the names of archives created on macOS (NFD) are served like
+	// the ones typed elsewhere. Default is false
+	NormalizeUnicode bool `json:"normalize_unicode,omitempty"`
+
+	// Refuse the writes and deletes of the paths, relative to the root, matching one of
+	// these glob patterns, and of their content. They are matched like Include.
+	// Default is none
+	ProtectedPaths []string `json:"protected_paths,omitempty"`
+
+	// Refuse the files whose name ends with one of these extensions, like `.php` or
+	// `.cgi`, whether they are uploaded alone or inside an archive. Matching is case
+	// insensitive. Default is none
+	DeniedExtensions []string `json:"denied_extensions,omitempty"`
+
+	// The permissions of created directories, as an octal string. Default is `0740`
+	DirPerm string `json:"dir_perm,omitempty"`
+
+	// The permissions of created files, as an octal string. Default is `0640`
+	FilePerm string `json:"file_perm,omitempty"`
+
+	// Bits removed from the permissions of every created file and directory, as an
+	// octal string. It applies on top of DirPerm, FilePerm and the modes preserved from
+	// archives, and the umask of the process still applies at creation. Default is
+	// `0000` (none)
+	Umask string `json:"umask,omitempty"`
+
+	// The user given the files and directories extracted by uploads, as a name or a
+	// number. Changing it needs privileges, like running as root. Default is the user
+	// of the process
+	FileOwner string `json:"file_owner,omitempty"`
+
+	// The group given the files and directories extracted by uploads, as a name or a
+	// number. Default is the group of the process
+	FileGroup string `json:"file_group,omitempty"`
+
+	// Apply the permissions stored in archives instead of `dir_perm` and `file_perm`.
+	// Setuid and setgid bits are always stripped. Default is false
+	PreserveArchiveModes bool `json:"preserve_archive_modes,omitempty"`
+
+	// Apply the modification times stored in archives to the extracted files and
+	// directories instead of the time of the upload. Default is false
+	PreserveMTimes bool `json:"preserve_mtimes,omitempty"`
+
+	// Extract the symlinks and hardlinks of archives instead of ignoring them. Links
+	// pointing outside of the uploaded directory are rejected. Default is false
+	AllowSymlinks bool `json:"allow_symlinks,omitempty"`
+
+	// How directory uploads are applied to an existing target: `replace` swaps the
+	// whole directory while `merge` only creates or overwrites the entries present in
+	// the archive. Can be overridden per request with the `X-Deploy-Mode` header.
+	// Default is `replace`
+	DeployMode string `json:"deploy_mode,omitempty"`
+
+	// The number of previous versions kept next to a target after a successful PUT,
+	// for manual restore. Default is 0 (none)
+	KeepBackups int `json:"keep_backups,omitempty"`
+
+	// The methods accepted by the handler, among GET, HEAD, PROPFIND (with enable_read),
+	// PUT, PATCH, DELETE, MOVE and COPY. OPTIONS is always accepted. Default is all of them
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// The origins allowed to send cross-origin requests from a browser, or `*` for any
+	// origin. Default is none
+	AllowOrigins []string `json:"allow_origins,omitempty"`
+
+	// Answer GET and HEAD requests with the content of files and a JSON listing of
+	// directories, and PROPFIND requests with their WebDAV properties. Default is false
+	EnableRead bool `json:"enable_read,omitempty"`
+
+	// A path, like `/.health`, reserved for health checks: GET and HEAD requests get 200
+	// when a file can be created in the root and 503 otherwise. Default is none
+	HealthPath string `json:"health_path,omitempty"`
+
+	// The maximum size of the files under the root in megabytes. Uploads that would
+	// cross it are rejected. Default is 0 (unlimited)
+	QuotaMB int `json:"quota_mb,omitempty"`
+
+	// A directory, relative to the root, where the temporary and backup paths of deploys
+	// are placed instead of next to their target. It must be on the same file system as
+	// the root. Default is none
+	StagingDir string `json:"staging_dir,omitempty"`
+
+	// A directory, relative to the root, where deleted paths are moved instead of being
+	// removed, so that they can be restored with a PUT with the `restore=trash` query.
+	// Default is none, only the deletions with the `soft=1` query are kept, in `.trash`
+	TrashDir string `json:"trash_dir,omitempty"`
+
+	// The number of deleted versions of a path kept in the trash. Default is 0
+	// (unlimited)
+	TrashKeep int `json:"trash_keep,omitempty"`
+
+	// The duration after which deleted paths are removed from the trash. Default is 0
+	// (forever)
+	TrashMaxAge caddy.Duration `json:"trash_max_age,omitempty"`
+
+	// The maximum duration of the read of a request body, once the locks of its
+	// targets are held. Slower uploads are aborted with 408. Default is 0 (unlimited)
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+
+	// The maximum duration clients can give to the extraction of their upload with the
+	// `X-Deploy-Timeout` header, longer ones are capped to it. Default is 0 (unlimited)
+	MaxDeployTimeout caddy.Duration `json:"max_deploy_timeout,omitempty"`
+
+	// The maximum duration a request waits for a deploy of the same paths to finish.
+	// Requests waiting longer are answered with 503 and a `Retry-After` header.
+	// Default is 0 (unlimited)
+	MaxLockWait caddy.Duration `json:"max_lock_wait,omitempty"`
+
+	// The duration for which the result of a deploy sent with an `Idempotency-Key`
+	// header is returned to the retries of the request instead of deploying again.
+	// Default is 24h
+	IdempotencyTTL caddy.Duration `json:"idempotency_ttl,omitempty"`
+
+	// The duration after its last chunk for which an incomplete resumable upload is
+	// kept. Abandoned ones are removed when the handler starts and when another upload
+	// starts in the same directory. Default is 24h
+	PartialTTL caddy.Duration `json:"partial_ttl,omitempty"`
+
+	// URL called with a POST after each successful deploy. Failures are logged but do
+	// not fail the deploy. Default is none
+	Webhook string `json:"webhook,omitempty"`
+
+	// A file where a JSON line is appended for each write request: its client, path,
+	// method, status and byte count. It can be rotated by moving it away. Default is
+	// none
+	AuditLog string `json:"audit_log,omitempty"`
+
+	// The placeholder of the authenticated user, set by an `authentication` handler
+	// running before this one. It is recorded in the logs and in the audit log. Default
+	// is `{http.auth.user.id}`
+	UserPlaceholder string `json:"user_placeholder,omitempty"`
+
+	// The body of the responses of successful requests, with the placeholders of the
+	// request and `{deploy.id}`, `{deploy.path}` and `{deploy.bytes}`, and literal
+	// braces escaped as `\{` and `\}`. It is sent as JSON when it is valid JSON.
+	// Default is none: the status alone, or a JSON body for uploads accepting it
+	SuccessTemplate string `json:"success_template,omitempty"`
+
+	// Read the whole archive of directory uploads before extracting it, so that a
+	// truncated or corrupt archive is rejected without touching any file. The archive
+	// is spooled next to the target. Default is false
+	ValidateArchive bool `json:"validate_archive,omitempty"`
+
+	// The size in MB under which the archives of ValidateArchive are copied in memory
+	// instead of a spool file. Default is 0: they are always spooled to disk
+	MemoryBufferMB int `json:"memory_buffer_mb,omitempty"`
+
+	// Flush extracted files and directories to disk before and after the swap so that
+	// a crash cannot leave a truncated deploy. It slows uploads down. Default is false
+	Fsync bool `json:"fsync,omitempty"`
+
+	// Also write a gzip compressed copy of the uploaded files with one of
+	// PrecompressTypes, like `index.html.gz`, for a `file_server` with `precompressed
+	// gzip`. Default is false
+	PrecompressGzip bool `json:"precompress_gzip,omitempty"`
+
+	// Also write a brotli compressed copy of the uploaded files with one of
+	// PrecompressTypes, like `index.html.br`, for a `file_server` with `precompressed
+	// br`. It is much slower than gzip. Default is false
+	PrecompressBrotli bool `json:"precompress_brotli,omitempty"`
+
+	// The quality of the brotli compression of PrecompressBrotli, from 1 (fastest) to
+	// 11 (smallest). Default is 11
+	BrotliQuality int `json:"brotli_quality,omitempty"`
+
+	// The media types of the files precompressed, guessed from their extension.
+	// Default is `text/html`, `text/css`, `text/javascript` and `application/json`
+	PrecompressTypes []string `json:"precompress_types,omitempty"`
+
+	// Write a checksum manifest listing the SHA-256 of every file of a directory upload
+	// in the format of `sha256sum`. Default is false
+	GenerateManifest bool `json:"generate_manifest,omitempty"`
+
+	// The path of the checksum manifest of GenerateManifest, relative to the uploaded
+	// directory. Default is `SHA256SUMS`
+	ManifestFile string `json:"manifest_file,omitempty"`
+
+	dirPerm  os.FileMode
+	filePerm os.FileMode
+	umask    os.FileMode
+	// Resolved FileOwner and FileGroup, -1 when unset
+	uid int
+	gid int
+
 	// Caddy structured logger
 	logger *zap.Logger
+
+	// Caddy events app, nil when it is not available
+	events eventEmitter
+	ctx    caddy.Context
 }
 
 // CaddyModule returns the Caddy module information.
@@ -49,20 +318,238 @@ func (WritableFileServer) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the Static Site wfs.
 func (wfs *WritableFileServer) Provision(ctx caddy.Context) error {
 	wfs.logger = ctx.Logger()
+	wfs.ctx = ctx
+
+	// The events app is always loaded by the http app
+	eventsApp, err := ctx.AppIfConfigured("events")
+	if err != nil && !errors.Is(err, caddy.ErrNotConfigured) {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	if err == nil {
+		wfs.events = eventsApp.(*caddyevents.App)
+	}
 
 	if wfs.Root == "" {
 		wfs.Root = "{http.vars.root}"
 	}
 
+	if wfs.MaxEntries == 0 {
+		wfs.MaxEntries = MAX_ENTRIES
+	}
+	if wfs.ManifestFile == "" {
+		wfs.ManifestFile = MANIFEST_FILE
+	}
+	if wfs.BrotliQuality == 0 {
+		wfs.BrotliQuality = brotli.BestCompression
+	}
+	if wfs.AllowEmptyUpload == nil {
+		allow := true
+		wfs.AllowEmptyUpload = &allow
+	}
+	if wfs.DeployMode == "" {
+		wfs.DeployMode = DEPLOY_MODE_REPLACE
+	}
+	if wfs.IdempotencyTTL == 0 {
+		wfs.IdempotencyTTL = caddy.Duration(IDEMPOTENCY_TTL)
+	}
+	if wfs.PartialTTL == 0 {
+		wfs.PartialTTL = caddy.Duration(PARTIAL_TTL)
+	}
+	if wfs.UserPlaceholder == "" {
+		wfs.UserPlaceholder = "{http.auth.user.id}"
+	}
+	for i, method := range wfs.AllowedMethods {
+		wfs.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	for i, ext := range wfs.DeniedExtensions {
+		wfs.DeniedExtensions[i] = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	}
+	if wfs.DirPerm == "" {
+		wfs.DirPerm = fmt.Sprintf("%#o", DIR_PERM)
+	}
+	if wfs.FilePerm == "" {
+		wfs.FilePerm = fmt.Sprintf("%#o", FILE_PERM)
+	}
+	if wfs.Umask == "" {
+		wfs.Umask = "0000"
+	}
+	// Invalid values are reported by Validate
+	wfs.umask, _ = parsePerm(wfs.Umask)
+	wfs.dirPerm, _ = parsePerm(wfs.DirPerm)
+	wfs.dirPerm &^= wfs.umask
+	wfs.filePerm, _ = parsePerm(wfs.FilePerm)
+	wfs.filePerm &^= wfs.umask
+	wfs.uid, _ = lookupUid(wfs.FileOwner)
+	wfs.gid, _ = lookupGid(wfs.FileGroup)
+	if !canChown(wfs.uid, wfs.gid) {
+		wfs.logger.Log(zapcore.WarnLevel, "file_owner and file_group need privileges, uploads will fail", zap.Int("uid", wfs.uid), zap.Int("gid", wfs.gid), zap.Int("euid", os.Geteuid()))
+	}
+
+	// A templated root is only known at request time
+	if !strings.Contains(wfs.Root, "{") {
+		// Holding the root lock ensures no deploy from a previous config is running
+		unlock := locks.Lock(wfs.Root, wfs.Root)
+		removed, err := cleanStaleArtifacts(wfs.Root)
+		wfs.removeExpiredPartials(wfs.partialsPath(wfs.Root))
+		unlock()
+
+		for _, path := range removed {
+			wfs.logger.Log(zapcore.InfoLevel, "removed stale deploy artifact", zap.String("path", path))
+		}
+		// Invalid roots are reported by Validate
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to remove stale deploy artifacts", zap.String("root", wfs.Root), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// Validate rejects configurations that would only fail at request time.
+func (wfs *WritableFileServer) Validate() error {
+	if wfs.MaxSizeMB < 0 {
+		return fmt.Errorf("max_size_mb must be positive, got %d", wfs.MaxSizeMB)
+	}
+	if wfs.MaxUncompressedMB < 0 {
+		return fmt.Errorf("max_uncompressed_mb must be positive, got %d", wfs.MaxUncompressedMB)
+	}
+	if wfs.MaxEntries < 0 {
+		return fmt.Errorf("max_entries must be positive, got %d", wfs.MaxEntries)
+	}
+	if wfs.MaxFileSizeMB < 0 {
+		return fmt.Errorf("max_file_size_mb must be positive, got %d", wfs.MaxFileSizeMB)
+	}
+	if wfs.MemoryBufferMB < 0 {
+		return fmt.Errorf("memory_buffer_mb must be positive, got %d", wfs.MemoryBufferMB)
+	}
+	if wfs.BrotliQuality < 1 || wfs.BrotliQuality > brotli.BestCompression {
+		return fmt.Errorf("brotli_quality must be between 1 and %d, got %d", brotli.BestCompression, wfs.BrotliQuality)
+	}
+	if wfs.MaxPathDepth < 0 {
+		return fmt.Errorf("max_path_depth must be positive, got %d", wfs.MaxPathDepth)
+	}
+	if wfs.ProgressLogMB < 0 {
+		return fmt.Errorf("progress_log_mb must be positive, got %d", wfs.ProgressLogMB)
+	}
+	if wfs.StripComponents < 0 {
+		return fmt.Errorf("strip_components must be positive, got %d", wfs.StripComponents)
+	}
+	for _, pattern := range slices.Concat(wfs.Include, wfs.Exclude, wfs.ProtectedPaths) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern '%s': %w", pattern, err)
+		}
+	}
+	for _, file := range wfs.RequireFiles {
+		if !filepath.IsLocal(file) {
+			return fmt.Errorf("invalid require_files '%s': must be a relative path inside the uploaded directory", file)
+		}
+	}
+	known := append([]string{http.MethodOptions, http.MethodGet, http.MethodHead, METHOD_PROPFIND}, wfs.supportedMethods()...)
+	for _, method := range wfs.AllowedMethods {
+		if !slices.Contains(known, method) {
+			return fmt.Errorf("invalid allowed_methods: unsupported method '%s'", method)
+		}
+	}
+	if wfs.StagingDir != "" && !filepath.IsLocal(wfs.StagingDir) {
+		return fmt.Errorf("invalid staging_dir '%s': must be a relative path inside the root", wfs.StagingDir)
+	}
+	if !filepath.IsLocal(wfs.ManifestFile) {
+		return fmt.Errorf("invalid manifest_file '%s': must be a relative path inside the uploaded directory", wfs.ManifestFile)
+	}
+	if wfs.TrashDir != "" && !filepath.IsLocal(wfs.TrashDir) {
+		return fmt.Errorf("invalid trash_dir '%s': must be a relative path inside the root", wfs.TrashDir)
+	}
+	if wfs.TrashKeep < 0 {
+		return fmt.Errorf("trash_keep must be positive, got %d", wfs.TrashKeep)
+	}
+	if wfs.TrashMaxAge < 0 {
+		return fmt.Errorf("trash_max_age must be positive, got %s", time.Duration(wfs.TrashMaxAge))
+	}
+	if wfs.ReadTimeout < 0 {
+		return fmt.Errorf("read_timeout must be positive, got %s", time.Duration(wfs.ReadTimeout))
+	}
+	if wfs.HealthPath != "" && !strings.HasPrefix(wfs.HealthPath, "/") {
+		return fmt.Errorf("invalid health_path '%s': must start with /", wfs.HealthPath)
+	}
+	if wfs.MaxDeployTimeout < 0 {
+		return fmt.Errorf("max_deploy_timeout must be positive, got %s", time.Duration(wfs.MaxDeployTimeout))
+	}
+	if wfs.MaxLockWait < 0 {
+		return fmt.Errorf("max_lock_wait must be positive, got %s", time.Duration(wfs.MaxLockWait))
+	}
+	if wfs.IdempotencyTTL < 0 {
+		return fmt.Errorf("idempotency_ttl must be positive, got %s", time.Duration(wfs.IdempotencyTTL))
+	}
+	if wfs.PartialTTL < 0 {
+		return fmt.Errorf("partial_ttl must be positive, got %s", time.Duration(wfs.PartialTTL))
+	}
+	if wfs.QuotaMB < 0 {
+		return fmt.Errorf("quota_mb must be positive, got %d", wfs.QuotaMB)
+	}
+	if wfs.KeepBackups < 0 {
+		return fmt.Errorf("keep_backups must be positive, got %d", wfs.KeepBackups)
+	}
+	if wfs.Webhook != "" {
+		webhook, err := url.Parse(wfs.Webhook)
+		if err != nil {
+			return fmt.Errorf("invalid webhook: %w", err)
+		}
+		if (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			return fmt.Errorf("invalid webhook '%s': must be an http or https URL", wfs.Webhook)
+		}
+	}
+	if wfs.DeployMode != DEPLOY_MODE_REPLACE && wfs.DeployMode != DEPLOY_MODE_MERGE {
+		return fmt.Errorf("invalid deploy_mode '%s': must be '%s' or '%s'", wfs.DeployMode, DEPLOY_MODE_REPLACE, DEPLOY_MODE_MERGE)
+	}
+	if _, err := parsePerm(wfs.DirPerm); err != nil {
+		return fmt.Errorf("invalid dir_perm: %w", err)
+	}
+	if _, err := parsePerm(wfs.FilePerm); err != nil {
+		return fmt.Errorf("invalid file_perm: %w", err)
+	}
+	if _, err := parsePerm(wfs.Umask); err != nil {
+		return fmt.Errorf("invalid umask: %w", err)
+	}
+	if (wfs.FileOwner != "" || wfs.FileGroup != "") && runtime.GOOS == "windows" {
+		return errors.New("file_owner and file_group are not supported on windows")
+	}
+	if _, err := lookupUid(wfs.FileOwner); err != nil {
+		return fmt.Errorf("invalid file_owner '%s': %w", wfs.FileOwner, err)
+	}
+	if _, err := lookupGid(wfs.FileGroup); err != nil {
+		return fmt.Errorf("invalid file_group '%s': %w", wfs.FileGroup, err)
+	}
+
+	// A templated root is only known at request time
+	if !strings.Contains(wfs.Root, "{") {
+		if err := checkWritableDirectory(wfs.Root); err != nil {
+			return fmt.Errorf("invalid root: %w", err)
+		}
+		if staging := wfs.stagingPath(wfs.Root); staging != "" {
+			if err := os.MkdirAll(staging, wfs.dirPerm); err != nil {
+				return fmt.Errorf("invalid staging_dir: %w", err)
+			}
+			if err := checkSameFilesystem(wfs.Root, staging); err != nil {
+				return fmt.Errorf("invalid staging_dir: %w", err)
+			}
+		}
+	}
+
 	return nil
 }
 
 func (wfs *WritableFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Request are processed sequencially to avoid conflict
-	lock.Lock()
-	defer lock.Unlock()
+	id := newId()
+	start := time.Now()
+	// Lets clients correlate any response with the logs of the server
+	w.Header().Set("X-Deploy-Id", id)
 
-	id := GetId()
+	// Paths typed on macOS are decomposed (NFD), they must name the same files as the
+	// composed (NFC) ones sent by other systems
+	if wfs.NormalizeUnicode {
+		r.URL.Path = norm.NFC.String(r.URL.Path)
+		r.URL.RawPath = ""
+	}
 
 	// The following checks are taken directly from the static file module and kept to
 	// ensure we don't miss a dangerous edge-case:
@@ -77,55 +564,458 @@ func (wfs *WritableFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request,
 		if len(path.Base(trimmedPath)) <= 12 && strings.Contains(trimmedPath, "~") {
 			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("illegal short name"))
 		}
+		// reject paths with device names, writing to them can hang or misbehave
+		if hasWindowsReservedName(r.URL.Path) {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("illegal device name"))
+		}
 		// both of those could bypass file hiding or possibly leak information even if the file is not hidden
 	}
 
+	// Browsers need the CORS headers on errors too to let scripts read them
+	wfs.setCORSHeaders(w, r)
+
+	if wfs.HealthPath != "" && r.URL.Path == wfs.HealthPath {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		return wfs.HandleHealth(id, repl.ReplaceAll(wfs.Root, ""), w, r)
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", strings.Join(wfs.allowedMethods(), ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if !slices.Contains(wfs.allowedMethods(), r.Method) {
+		return wfs.handleError(id, w, r, wfs.methodNotAllowed(w, r))
+	}
+
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	root := repl.ReplaceAll(wfs.Root, ".")
+	root := repl.ReplaceAll(wfs.Root, "")
 	// End of copied code
 
-	target := caddyhttp.SanitizedPathJoin(root, r.URL.Path)
-	if target == root {
-		target += "/" // Side effect of SanitizedPathJoin
+	// Paths joined to an empty root are relative to the working directory of Caddy
+	if root == "" {
+		return wfs.handleError(id, w, r, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("root resolved empty; is file_server root configured? root: %s", wfs.Root),
+			"",
+		})
 	}
+	if errBase := wfs.checkBaseRoot(root); errBase != nil {
+		return wfs.handleError(id, w, r, errBase)
+	}
+
+	target, isDir := resolveTarget(root, r.URL.Path)
 
-	if c := wfs.logger.Check(zapcore.DebugLevel, "sanitized path join"); c != nil {
+	if c := wfs.logger.Check(zapcore.DebugLevel, "resolved target"); c != nil {
 		c.Write(
+			zap.String("id", id),
+			zap.String("user", wfs.authUser(r)),
 			zap.String("site_root", root),
 			zap.String("request_path", r.URL.Path),
 			zap.String("result", target),
+			zap.Bool("is_dir", isDir),
 		)
 	}
 
-	// Root request to handler
-	var err *ErrorDeployement
+	if errStaging := wfs.checkNotReserved(root, target); errStaging != nil {
+		return wfs.handleError(id, w, r, errStaging)
+	}
+
+	// Reads are not locked since targets are always swapped atomically
+	if wfs.EnableRead && (r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == METHOD_PROPFIND) {
+		handle := wfs.HandleGet
+		switch {
+		case r.Method == METHOD_PROPFIND:
+			handle = wfs.HandlePropfind
+		case r.URL.Query().Has("deployment"):
+			handle = wfs.HandleDeployment
+		}
+		if err := handle(target, w, r); err != nil {
+			return wfs.handleError(id, w, r, err)
+		}
+		return nil
+	}
+
+	if errDepth := wfs.checkPathDepth(root, target); errDepth != nil {
+		return wfs.handleError(id, w, r, errDepth)
+	}
+
+	// COPY only reads its source
+	if r.Method != METHOD_COPY {
+		if errProtected := wfs.checkNotProtected(root, target); errProtected != nil {
+			return wfs.handleError(id, w, r, errProtected)
+		}
+	}
+	if !isDir && (r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		if errExtension := wfs.checkExtension(target); errExtension != nil {
+			return wfs.handleError(id, w, r, errExtension)
+		}
+	}
+
+	// MOVE and COPY also write to their destination
+	lockTargets := []string{target}
+	var destination string
+	if r.Method == METHOD_MOVE || r.Method == METHOD_COPY {
+		var errDestination *ErrorDeployement
+		destination, errDestination = wfs.resolveDestination(root, r)
+		if errDestination != nil {
+			return wfs.handleError(id, w, r, errDestination)
+		}
+		if errStaging := wfs.checkNotReserved(root, destination); errStaging != nil {
+			return wfs.handleError(id, w, r, errStaging)
+		}
+		if errProtected := wfs.checkNotProtected(root, destination); errProtected != nil {
+			return wfs.handleError(id, w, r, errProtected)
+		}
+		if errExtension := wfs.checkExtension(destination); errExtension != nil {
+			return wfs.handleError(id, w, r, errExtension)
+		}
+		if errDepth := wfs.checkPathDepth(root, destination); errDepth != nil {
+			return wfs.handleError(id, w, r, errDepth)
+		}
+		lockTargets = append(lockTargets, destination)
+	}
+
+	// Clients sending `Expect: 100-continue` only stream the body once it is first read,
+	// so what is known from the headers is checked before waiting for the locks
+	if errLength := wfs.checkContentLength(r); errLength != nil {
+		return wfs.handleError(id, w, r, errLength)
+	}
+
+	// The id is final before anything is written under it
+	fresh, errId := wfs.freshId(id, root, lockTargets...)
+	if errId != nil {
+		return wfs.handleError(id, w, r, errId)
+	}
+	if fresh != id {
+		id = fresh
+		w.Header().Set("X-Deploy-Id", id)
+	}
+
+	if wfs.SuccessTemplate != "" {
+		repl.Set("deploy.id", id)
+		repl.Set("deploy.path", r.URL.Path)
+	}
+
+	status, err := wfs.deployOnce(id, root, target, destination, lockTargets, start, w, r)
+	if err != nil {
+		return wfs.handleError(id, w, r, err)
+	}
+	if wfs.SuccessTemplate != "" {
+		return wfs.writeSuccessTemplate(w, r, status)
+	}
+	return writeSuccess(w, r, status)
+}
+
+// Apply a write request once the locks of lockTargets are held, and report it through
+// the events, the webhook and the idempotency cache. The response is left to the caller.
+func (wfs *WritableFileServer) deploy(id string, root string, target string, destination string, lockTargets []string, start time.Time, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	// Request on the same top-level entries are processed sequencially to avoid conflict
+	unlock, ok := locks.LockTimeout(root, time.Duration(wfs.MaxLockWait), lockTargets...)
+	if !ok {
+		// The running deploy is likely to last at least as long as we waited for it
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Duration(wfs.MaxLockWait).Seconds()))))
+		return 0, &ErrorDeployement{
+			http.StatusServiceUnavailable,
+			fmt.Errorf("locks of %v not acquired within %s", lockTargets, time.Duration(wfs.MaxLockWait)),
+			"another deploy of this path is in progress, retry later",
+		}
+	}
+	defer unlock()
+
+	if errStaging := wfs.createStaging(root); errStaging != nil {
+		return 0, errStaging
+	}
+
+	// The retry of a completed deploy gets its result back without deploying again
+	key := idempotencyKey(filepath.Clean(root), r)
+	if result, ok := idempotencyKeys.get(key); key != "" && ok {
+		return wfs.replayResult(w, r, result)
+	}
+
+	if wfs.MaxSizeMB > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(wfs.MaxSizeMB)<<20)
+	}
+	// The timeout starts once the locks are held since waiting for them is not reading
+	release := wfs.limitReadTime(w, r)
+	defer release()
+	body := &countingReader{ReadCloser: http.NoBody}
+	if r.Body != nil {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+
+	recorder := &bodyRecorder{ResponseWriter: w}
+	status, err := wfs.dispatch(id, root, target, destination, recorder, r)
+
+	// Every request reaching this point may have changed the disk usage of root
+	usages.settle(filepath.Clean(root), id)
+	treeETags.invalidate(filepath.Clean(root))
+
+	if err != nil {
+		// The event carries the status of the response
+		wfs.classifyError(err)
+		wfs.emitDeployEvent(id, r, body.n, start, 0, err)
+		wfs.writeAudit(id, r, destination, body.n, 0, err)
+		return 0, err
+	}
+	// The intermediate chunks of a resumable upload are not deploys of their own: only
+	// the one completing it is reported
+	if status == STATUS_RESUME_INCOMPLETE {
+		return status, nil
+	}
+	wfs.logger.Log(zapcore.InfoLevel, "deploy succeeded",
+		zap.String("id", id),
+		zap.String("method", r.Method),
+		zap.String("target", target),
+		zap.Int("status", status),
+		zap.Int64("bytes", body.n),
+		zap.Duration("duration", time.Since(start)),
+	)
+	wfs.emitDeployEvent(id, r, body.n, start, status, nil)
+	wfs.writeAudit(id, r, destination, body.n, status, nil)
+	if wfs.SuccessTemplate != "" {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("deploy.bytes", body.n)
+	}
+
+	// A skipped deploy changed nothing
+	if status != http.StatusNotModified {
+		wfs.callWebhook(id, r, body.n)
+	}
+
+	// The deploys of the paths removed or replaced are forgotten, the matches of a glob
+	// are forgotten one by one by HandleDeleteGlob
+	switch {
+	case r.Method == http.MethodPut && r.URL.Query().Has("restore"):
+		deployments.forget(target)
+	case r.Method == http.MethodPut:
+		if status != http.StatusNotModified {
+			if wfs.deployMode(r) != DEPLOY_MODE_MERGE {
+				deployments.forget(target)
+			}
+			deployments.record(target, deploymentInfo{id, r.Method, body.n, time.Now().UTC()})
+		}
+	case r.Method == http.MethodDelete && !r.URL.Query().Has("glob"):
+		deployments.forget(target)
+	case r.Method == METHOD_MOVE:
+		deployments.forget(target)
+		deployments.forget(destination)
+	case r.Method == METHOD_COPY:
+		deployments.forget(destination)
+	}
+
+	if key != "" {
+		expires := time.Now().Add(time.Duration(wfs.IdempotencyTTL))
+		result := idempotentResult{method: r.Method, path: r.URL.Path, status: status, etag: w.Header().Get("ETag"), expires: expires}
+		if status == http.StatusMultiStatus {
+			result.body = recorder.body.Bytes()
+			result.contentType = w.Header().Get("Content-Type")
+		}
+		idempotencyKeys.put(key, result)
+	}
+
+	return status, nil
+}
+
+// Create the staging directory of root, if any. The one of a templated root is only
+// known once a deploy to it starts.
+func (wfs *WritableFileServer) createStaging(root string) *ErrorDeployement {
+	staging := wfs.stagingPath(root)
+	if staging == "" {
+		return nil
+	}
+	if err := os.MkdirAll(staging, wfs.dirPerm); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create staging directory %s: %w", staging, err),
+			"",
+		}
+	}
+	return nil
+}
+
+// Route the request to its handler. A panic of the handler is recovered, see
+// recoverHandler.
+func (wfs *WritableFileServer) dispatch(id string, root string, target string, destination string, w http.ResponseWriter, r *http.Request) (status int, err *ErrorDeployement) {
+	defer wfs.recoverHandler(id, root, target, &err)
+
 	switch r.Method {
 	case http.MethodPut:
-		err = wfs.HandlePut(id, target, r)
+		if r.URL.Query().Has("restore") {
+			status, err = wfs.HandleRestore(id, root, target, r)
+		} else if isManifest(r) {
+			status, err = wfs.HandleManifest(id, root, target, w, r)
+		} else {
+			status, err = wfs.HandlePut(id, root, target, w, r)
+		}
+	case http.MethodPatch:
+		status, err = wfs.HandlePatch(id, root, target, w, r)
 	case http.MethodDelete:
-		err = wfs.HandleDelete(id, target, r)
+		if r.URL.Query().Has("glob") {
+			status, err = wfs.HandleDeleteGlob(id, root, target, w, r)
+		} else if r.URL.Query().Has("contents_only") {
+			status, err = wfs.HandleDeleteContents(id, root, target, r)
+		} else {
+			status, err = wfs.HandleDelete(id, root, target, r)
+		}
+	case METHOD_MOVE:
+		status, err = wfs.HandleMove(id, root, target, destination, w, r)
+	case METHOD_COPY:
+		status, err = wfs.HandleCopy(id, root, target, destination, w, r)
 	default:
-		w.Write([]byte(fmt.Sprintf("Unauthorized method: %s\n", r.Method)))
-		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("unauthorized method"))
+		err = wfs.methodNotAllowed(w, r)
 	}
+	return status, err
+}
 
-	if err != nil {
-		wfs.logger.Log(zapcore.DebugLevel, err.Error())
-		level := zapcore.WarnLevel
-		if err.StatusCode >= 500 {
-			level = zapcore.ErrorLevel
-			err.Public = ""
-		}
-		wfs.logger.Log(level, err.Private.Error(), zap.Int("statusCode", err.StatusCode))
-		w.Write([]byte(err.Error()))
-		return caddyhttp.Error(err.StatusCode, err.Private)
+// Turn a panic of a handler into a 500 instead of crashing the server. The target is put
+// back as it was before the request: its temporary path is removed and its backup, if
+// the panic came before the swap, is restored.
+func (wfs *WritableFileServer) recoverHandler(id string, root string, target string, err **ErrorDeployement) {
+	recovered := recover()
+	if recovered == nil {
+		return
 	}
-	wfs.logger.Log(zapcore.DebugLevel, "err is fucking null")
+	wfs.logger.Log(zapcore.ErrorLevel, "handler panicked", zap.String("id", id), zap.Any("panic", recovered), zap.Stack("stack"))
 
+	private := fmt.Errorf("handler panicked: %v", recovered)
+	if errTemp := os.RemoveAll(wfs.tempPath(id, root, target)); errTemp != nil {
+		private = fmt.Errorf("%w AND failed to remove temporary path: %w", private, errTemp)
+	}
+	if errRollback := rollback(wfs.backupPath(id, root, target), target); errRollback != nil {
+		private = fmt.Errorf("%w AND failed to rollback: %w", private, errRollback)
+	}
+	*err = &ErrorDeployement{http.StatusInternalServerError, private, ""}
+}
+
+// Reject a request whose announced body is larger than MaxSizeMB before reading it.
+// Bodies without a Content-Length are capped while they are read.
+func (wfs *WritableFileServer) checkContentLength(r *http.Request) *ErrorDeployement {
+	// The size of chunked bodies is unknown (-1) until they are read
+	if r.ContentLength < 0 {
+		return nil
+	}
+	limit := int64(wfs.MaxSizeMB) << 20
+	if wfs.MaxSizeMB > 0 && r.ContentLength > limit {
+		return &ErrorDeployement{
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("content-length %d is too large: %w", r.ContentLength, &http.MaxBytesError{Limit: limit}),
+			"", // Set by handleError
+		}
+	}
 	return nil
 }
 
-func (wfs *WritableFileServer) HandlePut(id string, target string, r *http.Request) *ErrorDeployement {
+// Adjust the status and public message of the errors that can come from any request:
+// size limits, timeouts and full disks
+func (wfs *WritableFileServer) classifyError(err *ErrorDeployement) {
+	var errMaxBytes *http.MaxBytesError
+	if errors.As(err.Private, &errMaxBytes) {
+		err.StatusCode = http.StatusRequestEntityTooLarge
+		err.Public = fmt.Sprintf("request body exceeds the maximum size of %d MB", wfs.MaxSizeMB)
+	}
+	if isReadTimeout(err.Private) {
+		err.StatusCode = http.StatusRequestTimeout
+		err.Public = fmt.Sprintf("request body was not received within %s", time.Duration(wfs.ReadTimeout))
+	}
+	var errUncompressed *UncompressedSizeError
+	if errors.As(err.Private, &errUncompressed) {
+		err.StatusCode = http.StatusRequestEntityTooLarge
+		err.Public = fmt.Sprintf("uncompressed archive exceeds the maximum size of %d MB", wfs.MaxUncompressedMB)
+	}
+
+	if errors.Is(err.Private, syscall.ENOSPC) {
+		err.StatusCode = http.StatusInsufficientStorage
+		err.Public = "not enough space left on the server"
+	}
+}
+
+// Log err, write its public message in the response and convert it for Caddy. The
+// message is written in JSON if the client accepts it.
+func (wfs *WritableFileServer) handleError(id string, w http.ResponseWriter, r *http.Request, err *ErrorDeployement) error {
+	wfs.classifyError(err)
+
+	user := wfs.authUser(r)
+	wfs.logger.Log(zapcore.DebugLevel, err.Error(), zap.String("id", id), zap.String("user", user))
+	level := zapcore.WarnLevel
+	// A full disk, quota, busy path or deploy timeout is expected to happen, it is not a
+	// bug of the server
+	expected := []int{http.StatusInsufficientStorage, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	if err.StatusCode >= 500 && !slices.Contains(expected, err.StatusCode) {
+		level = zapcore.ErrorLevel
+		err.Public = ""
+	}
+	wfs.logger.Log(level, err.Private.Error(), zap.String("id", id), zap.String("user", user), zap.Int("statusCode", err.StatusCode))
+
+	// The private error may contain paths of the server, it only goes to the logs
+	public := err.Public
+	if public == "" {
+		public = http.StatusText(err.StatusCode)
+	}
+	public = strings.TrimRight(public, "\n")
+	if acceptsJSON(r) {
+		writeJSON(w, err.StatusCode, errorResponse{public, err.StatusCode})
+	} else {
+		w.WriteHeader(err.StatusCode)
+		w.Write([]byte(public + "\n"))
+	}
+	return caddyhttp.Error(err.StatusCode, err.Private)
+}
+
+// Return the methods supported by the handler, restricted to AllowedMethods when it
+// is set. OPTIONS is always allowed.
+func (wfs *WritableFileServer) allowedMethods() []string {
+	methods := []string{http.MethodOptions}
+	for _, method := range wfs.supportedMethods() {
+		if len(wfs.AllowedMethods) == 0 || slices.Contains(wfs.AllowedMethods, method) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// Return the methods the handler knows how to serve with the current configuration
+func (wfs *WritableFileServer) supportedMethods() []string {
+	methods := []string{}
+	if wfs.EnableRead {
+		methods = append(methods, http.MethodGet, http.MethodHead, METHOD_PROPFIND)
+	}
+	return append(methods, http.MethodPut, http.MethodPatch, http.MethodDelete, METHOD_MOVE, METHOD_COPY)
+}
+
+// Return the error of requests with a method that is not allowed, and announce the
+// allowed ones in the `Allow` header
+func (wfs *WritableFileServer) methodNotAllowed(w http.ResponseWriter, r *http.Request) *ErrorDeployement {
+	w.Header().Set("Allow", strings.Join(wfs.allowedMethods(), ", "))
+	return &ErrorDeployement{
+		http.StatusMethodNotAllowed,
+		fmt.Errorf("unauthorized method: %s", r.Method),
+		fmt.Sprintf("Unauthorized method: %s", r.Method),
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*WritableFileServer)(nil)
+	_ caddy.Validator             = (*WritableFileServer)(nil)
+	_ caddyhttp.MiddlewareHandler = (*WritableFileServer)(nil)
+	_ caddyfile.Unmarshaler       = (*WritableFileServer)(nil)
+)
+
+// Return the deploy mode of r, DeployMode unless overridden by the `X-Deploy-Mode`
+// header
+func (wfs *WritableFileServer) deployMode(r *http.Request) string {
+	if header := r.Header.Get("X-Deploy-Mode"); header != "" {
+		return header
+	}
+	return wfs.DeployMode
+}
+
+// Deploy the request body to target. On success it returns 201 Created if the
+// target did not exist before and 204 No Content if it was replaced.
+func (wfs *WritableFileServer) HandlePut(id string, root string, target string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
 	// We make sure tu close the body if it is not empty
 	if r.Body != nil {
 		defer r.Body.Close()
@@ -133,18 +1023,253 @@ func (wfs *WritableFileServer) HandlePut(id string, target string, r *http.Reque
 
 	isDirectory := strings.HasSuffix(target, "/")
 
+	mode := wfs.deployMode(r)
+	if mode != DEPLOY_MODE_REPLACE && mode != DEPLOY_MODE_MERGE {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid deploy mode: %s", mode),
+			"invalid X-Deploy-Mode header: must be 'replace' or 'merge'",
+		}
+	}
+
+	strategy, errStrategy := deployStrategy(r)
+	if errStrategy != nil {
+		return 0, errStrategy
+	}
+	if strategy == DEPLOY_STRATEGY_SYMLINK && (!isDirectory || mode == DEPLOY_MODE_MERGE) {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("symlink strategy for %s in mode %s", target, mode),
+			"the symlink strategy only deploys directories, in replace mode",
+		}
+	}
+
+	info, errStat := statTarget(root, target)
+	if errStat != nil {
+		return 0, errStat
+	}
+	exists := info != nil
+
+	if errPrecondition := checkPreconditions(r, exists); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+	if errPrecondition := checkUnmodifiedSince(r, info); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+	// Like WebDAV clients, `Overwrite: F` only creates
+	if errOverwrite := checkOverwrite(r, exists); errOverwrite != nil {
+		if exists {
+			errOverwrite.Public = "target already exists"
+		}
+		return 0, errOverwrite
+	}
+
+	// The body is not even read when the target already is what it would deploy
+	if exists && isDirectory {
+		etag, errDeployed := wfs.deployedETag(r, root, target, mode)
+		if errDeployed != nil {
+			return 0, errDeployed
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			setLastModified(w, filepath.Clean(target))
+			return http.StatusNotModified, nil
+		}
+	}
+
+	if r.Header.Get("Content-Range") != "" {
+		return wfs.HandleRangePut(id, root, target, exists, w, r)
+	}
+
+	// If the client announced a digest we compute it while the body is extracted
+	digests, errDigest := parseDigestHeader(r.Header.Get("Digest"))
+	if errDigest != nil {
+		return 0, errDigest
+	}
+	var body io.Reader = http.NoBody
+	if r.Body != nil {
+		body = r.Body
+	}
+	if digests != nil {
+		body = io.TeeReader(body, digestWriter(digests))
+	}
+	raw := body
+
+	strip := wfs.StripComponents
+	if header := r.Header.Get("X-Strip-Components"); header != "" {
+		var errStrip error
+		strip, errStrip = strconv.Atoi(header)
+		if errStrip != nil || strip < 0 {
+			return 0, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("invalid strip components: %s", header),
+				"invalid X-Strip-Components header: must be a positive integer",
+			}
+		}
+	}
+
+	timeout, errTimeout := wfs.deployTimeout(r)
+	if errTimeout != nil {
+		return 0, errTimeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errDeployTimeout)
+		defer cancel()
+	}
+
+	// Archives are decoded by their extractor
+	if !isDirectory {
+		decoded, release, errDecode := wfs.decodeContent(body, strings.Join(r.Header.Values("Content-Encoding"), ","))
+		if errDecode != nil {
+			return 0, errDecode
+		}
+		defer release()
+		body = decoded
+	}
+
+	options := putOptions{
+		ctx:         ctx,
+		contentType: r.Header.Get("content-type"),
+		mode:        mode,
+		strategy:    strategy,
+		strip:       strip,
+	}
+	// The digest covers the whole body, including what the extractor did not consume
+	if digests != nil {
+		options.verify = func() *ErrorDeployement {
+			if _, err := io.Copy(io.Discard, raw); err != nil {
+				return &ErrorDeployement{
+					http.StatusInternalServerError,
+					fmt.Errorf("failed to read the end of the body: %w", err),
+					"",
+				}
+			}
+			return verifyDigests(digests)
+		}
+	}
+
+	result, errPut := wfs.putTarget(id, root, target, info, body, options)
+	if errPut != nil {
+		if errors.Is(errPut.Private, errDeployTimeout) {
+			errPut.StatusCode = http.StatusGatewayTimeout
+			errPut.Public = fmt.Sprintf("deploy did not complete within %s", timeout)
+		}
+		return 0, errPut
+	}
+
+	w.Header().Set("ETag", result.etag)
+	if wfs.successHasBody(r, result.status) {
+		setSummaryTrailers(w, result.progress)
+	}
+	if strategy == DEPLOY_STRATEGY_SYMLINK {
+		setLastModified(w, filepath.Join(target, CURRENT_LINK))
+		return result.status, nil
+	}
+	setLastModified(w, filepath.Clean(target))
+	if !exists {
+		w.Header().Set("Location", r.URL.Path)
+	}
+	return result.status, nil
+}
+
+// How putTarget writes its body, set by the headers of PUT requests
+type putOptions struct {
+	// Aborts the deploy until target is swapped
+	ctx         context.Context
+	contentType string
+	mode        string
+	strategy    string
+	strip       int
+	// Called once the body is extracted, before anything is swapped
+	verify func() *ErrorDeployement
+}
+
+// The outcome of a successful putTarget
+type putResult struct {
+	status   int
+	etag     string
+	progress *extractProgress
+}
+
+// Return the info of target, or nil if it does not exist yet. A target that the upload
+// cannot replace, a file with a directory or the opposite, is a conflict.
+func statTarget(root string, target string) (os.FileInfo, *ErrorDeployement) {
+	isDirectory := strings.HasSuffix(target, "/")
+	info, err := os.Stat(filepath.Clean(target))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if errors.Is(err, syscall.ENOTDIR) {
+		return nil, errFileParent(root, target, err)
+	}
+	if err != nil {
+		return nil, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+
+	if isDirectory && !info.IsDir() {
+		return nil, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to upload a directory over the file %s", target),
+			"target is a file: cannot replace it with a directory",
+		}
+	}
+	if !isDirectory && info.IsDir() {
+		return nil, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to upload a file over the directory %s", target),
+			"target is a directory: cannot replace it with a file",
+		}
+	}
+	return info, nil
+}
+
+// Extract body next to target and atomically swap it with target, described by info as
+// returned by statTarget. Directories are extracted from the archive body and files are
+// written as is. On success the status is 201 Created if the target did not exist
+// before and 204 No Content if it was replaced.
+func (wfs *WritableFileServer) putTarget(id string, root string, target string, info os.FileInfo, body io.Reader, options putOptions) (putResult, *ErrorDeployement) {
+	isDirectory := strings.HasSuffix(target, "/")
+	exists := info != nil
+
 	// We prepare all the data in a temporary location
 	// If the target directory does not exist, we create it
-	targetTemp := getTempPath(id, target)
+	targetTemp := wfs.tempPath(id, root, target)
+
+	// A temporary path of this id is a partial upload, it is not ours to remove or reuse
+	if _, err := os.Lstat(strings.TrimSuffix(targetTemp, "/")); err == nil {
+		return putResult{}, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("temporary path %s already exists", targetTemp),
+			"",
+		}
+	}
+	// Whatever fails from now on, including the copy of the body, the temporary path is
+	// removed. Once swapped it is the target.
+	swapped := false
+	defer func() {
+		if !swapped {
+			os.RemoveAll(targetTemp)
+		}
+	}()
+
 	var targetTempDir string
 	if isDirectory {
 		targetTempDir = targetTemp
 	} else {
 		targetTempDir = filepath.Dir(target)
 	}
-	if err := os.MkdirAll(targetTempDir, DIR_PERM); err != nil {
-		// TODO: return 400 on directory = existing file
-		return &ErrorDeployement{
+	if err := os.MkdirAll(targetTempDir, wfs.dirPerm); err != nil {
+		// A parent may have been replaced by a file since the stat
+		if errors.Is(err, syscall.ENOTDIR) {
+			return putResult{}, errFileParent(root, target, err)
+		}
+		return putResult{}, &ErrorDeployement{
 			http.StatusInternalServerError,
 			fmt.Errorf("failed to create target directory %s: %w", target, err),
 			"",
@@ -152,36 +1277,113 @@ func (wfs *WritableFileServer) HandlePut(id string, target string, r *http.Reque
 	}
 
 	// We extract the body to a temporary location
+	var etag string
 	var errExtract *ErrorDeployement
+	body = &timeoutReader{io.NopCloser(body), options.ctx}
+	progress := wfs.newExtractProgress(options.ctx, targetTemp)
 	if isDirectory {
-		errExtract = extractDirectory(targetTemp, r.Body, r.Header.Get("content-type"))
+		etag, errExtract = wfs.extractDirectory(targetTemp, body, options.contentType, options.strip, pathDepth(root, target), progress)
 	} else {
-		errExtract = extractFile(targetTemp, r.Body)
+		etag, errExtract = wfs.extractFile(targetTemp, body, progress)
+		wfs.convertZstdError(errExtract)
+		// Chunked bodies are only known to be empty once read
+		if errExtract == nil && progress.bytes == 0 && !*wfs.AllowEmptyUpload {
+			errExtract = &ErrorDeployement{
+				http.StatusBadRequest,
+				errors.New("empty file upload"),
+				"the body is empty: empty uploads are not allowed",
+			}
+		}
 	}
 
 	if errExtract != nil {
-		wfs.logger.Log(zapcore.DebugLevel, errExtract.Error())
-		return errExtract
+		wfs.logger.Log(zapcore.DebugLevel, "extraction failed", zap.String("id", id), zap.String("temp", targetTemp), zap.Error(errExtract))
+		return putResult{}, errExtract
 	}
 
-	wfs.logger.Log(zapcore.DebugLevel, " errExtract is nil")
+	if options.verify != nil {
+		if errVerify := options.verify(); errVerify != nil {
+			return putResult{}, errVerify
+		}
+	}
 
-	// Check the state of the target
-	_, err := os.Stat(target)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return &ErrorDeployement{
+	wfs.logger.Log(zapcore.DebugLevel, "extracted upload",
+		zap.String("id", id),
+		zap.String("temp", targetTemp),
+		zap.Int("entries", progress.entries),
+		zap.Int64("bytes", progress.bytes),
+	)
+
+	// The compressed siblings are part of the swapped tree, so they are never stale
+	if isDirectory {
+		if err := wfs.precompressTree(targetTemp); err != nil {
+			return putResult{}, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to precompress files of %s: %w", targetTemp, err),
+				"",
+			}
+		}
+	}
+
+	// In merge mode the entries of the target missing from the upload are brought into
+	// the temporary location so that the swap stays atomic
+	if exists && isDirectory && options.mode == DEPLOY_MODE_MERGE && options.strategy == DEPLOY_STRATEGY_SWAP {
+		if err := copyTree(target, targetTemp, wfs.reservedPaths(root)...); err != nil {
+			return putResult{}, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to merge target %s into %s: %w", target, targetTemp, err),
+				"",
+			}
+		}
+	}
+
+	if err := wfs.chownTree(targetTemp); err != nil {
+		return putResult{}, &ErrorDeployement{
 			http.StatusInternalServerError,
-			fmt.Errorf("could not stat target: %w", err),
+			fmt.Errorf("failed to change the owner of %s: %w", targetTemp, err),
 			"",
 		}
 	}
 
+	if isDirectory {
+		if errRequired := wfs.checkRequiredFiles(targetTemp); errRequired != nil {
+			return putResult{}, errRequired
+		}
+	}
+
+	// Retained backups are not counted, releases are
+	replaced := ""
+	if exists && options.strategy == DEPLOY_STRATEGY_SWAP {
+		replaced = target
+	}
+	if errQuota := wfs.checkQuota(id, root, replaced, targetTemp); errQuota != nil {
+		return putResult{}, errQuota
+	}
+
+	if err := context.Cause(options.ctx); err != nil {
+		return putResult{}, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("deploy of %s aborted before the swap: %w", target, err),
+			"",
+		}
+	}
+
+	// Releases are published next to the previous ones instead of replacing target
+	if options.strategy == DEPLOY_STRATEGY_SYMLINK {
+		status, errRelease := wfs.publishRelease(id, target, targetTemp)
+		if errRelease != nil {
+			return putResult{}, errRelease
+		}
+		return putResult{status, etag, progress}, nil
+	}
+
 	// We backup target if it already exist
-	if err == nil {
-		targetBackup := getBackupPath(id, target)
-		err = os.Rename(target, targetBackup)
+	targetBackup := wfs.backupPath(id, root, target)
+	keepBackup := false
+	if exists {
+		err := rename(target, targetBackup)
 		if err != nil {
-			return &ErrorDeployement{
+			return putResult{}, &ErrorDeployement{
 				http.StatusInternalServerError,
 				fmt.Errorf("failed to backup target directory %s: %w", target, err),
 				"",
@@ -189,36 +1391,202 @@ func (wfs *WritableFileServer) HandlePut(id string, target string, r *http.Reque
 		}
 		defer func() {
 			// We only clear the backup if everything happened without issues
-			// (rollback takes care of cleaning up the backup if successfull)
-			if err == nil {
-
-				err := os.RemoveAll(targetBackup)
-				wfs.logger.Log(zapcore.DebugLevel, "removing", zap.String("targetBackup", targetBackup))
-				wfs.logger.Log(zapcore.DebugLevel, "line 198", zap.Error(err))
+			// (rollback takes care of cleaning up the backup if successfull). A panic
+			// also runs this function, before the swap the backup is all that is left.
+			if swapped {
+				if keepBackup {
+					wfs.logger.Log(zapcore.WarnLevel, "backup kept after deploy", zap.String("id", id), zap.String("backup", targetBackup))
+					return
+				}
+				if wfs.KeepBackups > 0 {
+					if err := wfs.retainBackup(root, targetBackup, target); err != nil {
+						wfs.logger.Log(zapcore.WarnLevel, "failed to retain backup", zap.String("id", id), zap.String("backup", targetBackup), zap.Error(err))
+					}
+					return
+				}
 
+				if err := os.RemoveAll(targetBackup); err != nil {
+					wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after deploy", zap.String("id", id), zap.String("backup", targetBackup), zap.Error(err))
+					return
+				}
+				wfs.logger.Log(zapcore.DebugLevel, "backup removed", zap.String("id", id), zap.String("backup", targetBackup))
 			}
 		}()
 	}
 
 	// Swap target directory with artifact using atomic `Rename`
-	err = os.Rename(targetTemp, target)
-	if err != nil {
+	if err := rename(targetTemp, target); err != nil {
 		err := fmt.Errorf("failed to swap temporary directoy (%s) with target (%s): %w", targetTemp, target, err)
-		errRollback := rollback(id, target)
+		errRollback := rollback(targetBackup, target)
 		if errRollback != nil {
-			err = fmt.Errorf("failed to swap temporary directoy (%s) with target (%s): %w AND failed to rollback: %w", targetTemp, target, err, err)
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return putResult{}, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+	swapped = true
+
+	// The directories of the handler live in the root, they outlast its versions. If
+	// they cannot be moved the backup still holds them.
+	if exists && filepath.Clean(target) == filepath.Clean(root) {
+		if err := wfs.carryOverReserved(root, targetBackup); err != nil {
+			wfs.logger.Log(zapcore.ErrorLevel, "failed to carry over the directories of the handler", zap.String("id", id), zap.String("backup", targetBackup), zap.Error(err))
+			keepBackup = true
+		}
+	}
+
+	// The rename itself is only durable once the parent directory is synced
+	if wfs.Fsync {
+		if err := syncDirectory(filepath.Dir(filepath.Clean(target))); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to sync parent directory after deploy", zap.String("target", target), zap.Error(err))
+		}
+	}
+
+	if !isDirectory {
+		if err := wfs.precompressSiblings(id, root, target); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to precompress file after deploy", zap.String("target", target), zap.Error(err))
+		}
+	}
+
+	if !exists {
+		return putResult{http.StatusCreated, etag, progress}, nil
+	}
+	return putResult{http.StatusNoContent, etag, progress}, nil
+}
+
+// Deploy the content of r to target without going through HTTP, for the modules
+// embedding this one. target is relative to the root, like the path of a request. With
+// isDir, r is an archive of contentType extracted in the directory target, otherwise it
+// is the content of the file target. The checks, the options and the atomic swap are
+// the ones of a PUT request without any header.
+//
+// The root can only use global placeholders, like {env.*}, since there is no request.
+// id names the temporary and backup paths so, like the ids of requests, it must be
+// unique: see GetId. Events, audit lines and webhooks describe requests and are not
+// emitted.
+func (wfs *WritableFileServer) Deploy(id string, target string, r io.Reader, contentType string, isDir bool) *ErrorDeployement {
+	start := time.Now()
+	root := caddy.NewReplacer().ReplaceAll(wfs.Root, "")
+	if root == "" {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("root resolved empty; is file_server root configured? root: %s", wfs.Root),
+			"",
 		}
-		return &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+	if errBase := wfs.checkBaseRoot(root); errBase != nil {
+		return errBase
 	}
 
+	urlPath := path.Join("/", filepath.ToSlash(target))
+	if isDir {
+		urlPath = strings.TrimSuffix(urlPath, "/") + "/"
+	}
+	target, targetIsDir := resolveTarget(root, urlPath)
+	if targetIsDir != isDir {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to deploy a file to the root %s", root),
+			"target is the root: only directories can be deployed to it",
+		}
+	}
+
+	if errStaging := wfs.checkNotReserved(root, target); errStaging != nil {
+		return errStaging
+	}
+	if errDepth := wfs.checkPathDepth(root, target); errDepth != nil {
+		return errDepth
+	}
+	if errProtected := wfs.checkNotProtected(root, target); errProtected != nil {
+		return errProtected
+	}
+	if !isDir {
+		if errExtension := wfs.checkExtension(target); errExtension != nil {
+			return errExtension
+		}
+	}
+
+	unlock, ok := locks.LockTimeout(root, time.Duration(wfs.MaxLockWait), target)
+	if !ok {
+		return &ErrorDeployement{
+			http.StatusServiceUnavailable,
+			fmt.Errorf("lock of %s not acquired within %s", target, time.Duration(wfs.MaxLockWait)),
+			"another deploy of this path is in progress, retry later",
+		}
+	}
+	defer unlock()
+
+	if errStaging := wfs.createStaging(root); errStaging != nil {
+		return errStaging
+	}
+
+	// Read like a request body so that the same limits apply
+	body := &countingReader{ReadCloser: io.NopCloser(r)}
+	var reader io.Reader = body
+	if wfs.MaxSizeMB > 0 {
+		reader = http.MaxBytesReader(nil, body, int64(wfs.MaxSizeMB)<<20)
+	}
+
+	status, err := wfs.deployReader(id, root, target, reader, contentType)
+
+	usages.settle(filepath.Clean(root), id)
+	treeETags.invalidate(filepath.Clean(root))
+
+	if err != nil {
+		wfs.classifyError(err)
+		return err
+	}
+	wfs.logger.Log(zapcore.InfoLevel, "deploy succeeded",
+		zap.String("id", id),
+		zap.String("target", target),
+		zap.Int("status", status),
+		zap.Int64("bytes", body.n),
+		zap.Duration("duration", time.Since(start)),
+	)
+	if wfs.DeployMode != DEPLOY_MODE_MERGE {
+		deployments.forget(target)
+	}
+	deployments.record(target, deploymentInfo{id, http.MethodPut, body.n, time.Now().UTC()})
 	return nil
 }
 
-func (wfs *WritableFileServer) HandleDelete(id string, target string, r *http.Request) *ErrorDeployement {
+// Write body to target for Deploy. A panic is recovered like the one of a request
+// handler, see recoverHandler.
+func (wfs *WritableFileServer) deployReader(id string, root string, target string, body io.Reader, contentType string) (status int, err *ErrorDeployement) {
+	defer wfs.recoverHandler(id, root, target, &err)
+
+	info, errStat := statTarget(root, target)
+	if errStat != nil {
+		return 0, errStat
+	}
+	result, errPut := wfs.putTarget(id, root, target, info, body, putOptions{
+		ctx:         context.Background(),
+		contentType: contentType,
+		mode:        wfs.DeployMode,
+		strategy:    DEPLOY_STRATEGY_SWAP,
+		strip:       wfs.StripComponents,
+	})
+	if errPut != nil {
+		return 0, errPut
+	}
+	return result.status, nil
+}
+
+// Delete target, or move it to the trash when TrashDir is set or with the `soft=1`
+// query. On success it returns 204 No Content.
+func (wfs *WritableFileServer) HandleDelete(id string, root string, target string, r *http.Request) (int, *ErrorDeployement) {
+	recursive, errDepth := isRecursiveDelete(r)
+	if errDepth != nil {
+		return 0, errDepth
+	}
+	soft, errSoft := isSoftDelete(r)
+	if errSoft != nil {
+		return 0, errSoft
+	}
+
 	// Check the state of the target
-	_, err := os.Stat(target)
+	info, err := os.Stat(target)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return &ErrorDeployement{
+		return 0, &ErrorDeployement{
 			http.StatusInternalServerError,
 			fmt.Errorf("could not stat target: %w", err),
 			"",
@@ -227,25 +1595,72 @@ func (wfs *WritableFileServer) HandleDelete(id string, target string, r *http.Re
 
 	// If it does not exists return 404
 	if errors.Is(err, os.ErrNotExist) {
-		return &ErrorDeployement{
+		return 0, &ErrorDeployement{
 			http.StatusNotFound,
 			fmt.Errorf("trying to delete a target that does not exist: %w", err),
 			"Not Found.",
 		}
 	}
 
-	// Otherwise we just delete the target
-	err = os.RemoveAll(target)
-	wfs.logger.Log(zapcore.DebugLevel, "removing", zap.String("target", target))
+	if errPrecondition := checkUnmodifiedSince(r, info); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+
+	// Wiping a whole tree must be explicit
+	if info.IsDir() && !recursive {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("could not read target directory: %w", err),
+				"",
+			}
+		}
+		if len(entries) > 0 {
+			return 0, &ErrorDeployement{
+				http.StatusConflict,
+				fmt.Errorf("trying to delete the non-empty directory %s without recursion", target),
+				"directory is not empty: set 'X-Recursive: true' or 'Depth: infinity' to delete it",
+			}
+		}
+	}
 
-	wfs.logger.Log(zapcore.DebugLevel, "line 238", zap.Error(err))
+	if soft || wfs.TrashDir != "" {
+		if errTrash := wfs.moveToTrash(root, target); errTrash != nil {
+			return 0, errTrash
+		}
+		return http.StatusNoContent, nil
+	}
 
-	if err != nil {
-		return &ErrorDeployement{
+	// Otherwise we just delete the target
+	if err := os.RemoveAll(target); err != nil {
+		return 0, &ErrorDeployement{
 			http.StatusInternalServerError,
 			fmt.Errorf("failed to delete target: %w", err),
 			"",
 		}
 	}
-	return nil
+	wfs.logger.Log(zapcore.DebugLevel, "target deleted", zap.String("id", id), zap.String("target", target))
+	return http.StatusNoContent, nil
+}
+
+// Return true if the client asked to delete directories with their content, with the
+// `X-Recursive: true` or the WebDAV `Depth: infinity` header. `Depth: 0` only deletes
+// empty directories, even with `X-Recursive`, and other depths are rejected.
+func isRecursiveDelete(r *http.Request) (bool, *ErrorDeployement) {
+	depth := r.Header.Get("Depth")
+	switch {
+	case depth == "":
+		return strings.EqualFold(r.Header.Get("X-Recursive"), "true"), nil
+	case strings.EqualFold(depth, "infinity"):
+		return true, nil
+	case depth == "0":
+		return false, nil
+	default:
+		return false, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid depth header: %s", depth),
+			"invalid Depth header: must be '0' or 'infinity'",
+		}
+	}
 }
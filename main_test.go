@@ -1,21 +1,36 @@
 package caddy_writable_file_server
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"pgregory.net/rapid"
 )
 
@@ -40,10 +55,22 @@ func newTestWritableFileServer(t T) *WritableFileServer {
 		os.RemoveAll(tmp)
 	})
 
-	return &WritableFileServer{
-		Root:   tmp,
-		logger: zap.NewNop(),
+	wfs := &WritableFileServer{Root: tmp}
+	provisionTestWritableFileServer(t, wfs)
+	return wfs
+}
+
+// Provision wfs again, needed after changing options derived during provisioning
+func provisionTestWritableFileServer(t T, wfs *WritableFileServer) {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := wfs.Provision(ctx); err != nil {
+		t.Errorf("failed to provision: %v", err)
 	}
+	wfs.logger = zap.NewNop()
 }
 
 func newFile() io.ReadCloser {
@@ -70,6 +97,56 @@ func newTarGz() io.ReadCloser {
 	return file
 }
 
+func newTarXz() io.ReadCloser {
+	file, err := os.Open("tests/assets/test.tar.xz")
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+func newTarZst() io.ReadCloser {
+	file, err := os.Open("tests/assets/test.tar.zst")
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+func newTarBz2() io.ReadCloser {
+	file, err := os.Open("tests/assets/test.tar.bz2")
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+type tarEntry struct {
+	Header *tar.Header
+	Body   string
+}
+
+// Build an in-memory tar, the size of regular files is derived from their body
+func newTarWith(entries ...tarEntry) io.ReadCloser {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		if entry.Header.Typeflag == tar.TypeReg {
+			entry.Header.Size = int64(len(entry.Body))
+		}
+		if err := tw.WriteHeader(entry.Header); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(entry.Body)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	return io.NopCloser(buf)
+}
+
 type MockHandler struct {
 }
 
@@ -114,6 +191,267 @@ func GenetatorUrlPath() *rapid.Generator[string] {
 	})
 }
 
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                                Configuration                                 ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestValidate(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	assert.NoError(t, wfs.Validate())
+
+	wfs.Root = "{http.vars.root}"
+	assert.NoError(t, wfs.Validate())
+}
+
+func TestValidateNegativeMaxSize(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_size_mb")
+}
+
+func TestValidateNegativeMaxUncompressedSize(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxUncompressedMB = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_uncompressed_mb")
+}
+
+func TestProvisionRemovesStaleArtifacts(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	id := GetId()
+	stale := []string{
+		getTempPath(id, wfs.Root+"/site/"),
+		getBackupPath(id, wfs.Root+"/site/"),
+		getTempPath(id, wfs.Root+"/site/index.html"),
+		getTempPath(id, wfs.Root+"/docs") + SPOOL_SUFFIX,
+		getBackupPath(id, wfs.Root+"/docs/page.html"),
+		getTempPath(id, wfs.Root+"/"),
+	}
+	kept := []string{
+		wfs.Root + "/site/",
+		wfs.Root + "/docs/",
+		wfs.Root + "/docs/build-tmp",
+		wfs.Root + "/docs/page.old-backup",
+		wfs.Root + "/docs/page-0123456789-tmp",
+	}
+	t.Cleanup(func() { os.RemoveAll(getTempPath(id, wfs.Root+"/")) })
+
+	for _, path := range append(kept, stale...) {
+		if strings.HasSuffix(path, "/") {
+			if err := os.MkdirAll(path+"nested", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(path, []byte("content"), FILE_PERM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	provisionTestWritableFileServer(t, wfs)
+
+	for _, path := range stale {
+		_, err := os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist, path)
+	}
+	for _, path := range kept {
+		_, err := os.Stat(path)
+		assert.NoError(t, err, path)
+	}
+}
+
+func TestValidateNegativeMaxEntries(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxEntries = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_entries")
+}
+
+func TestValidateNegativeMaxFileSize(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxFileSizeMB = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_file_size_mb")
+}
+
+func TestValidateInvalidBrotliQuality(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.BrotliQuality = 12
+	assert.ErrorContains(t, wfs.Validate(), "brotli_quality")
+}
+
+func TestValidateNegativeMaxLockWait(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxLockWait = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_lock_wait")
+}
+
+func TestValidateRequireFilesOutside(t *testing.T) {
+	for _, file := range []string{"../index.html", "/index.html", ""} {
+		wfs := newTestWritableFileServer(t)
+		wfs.RequireFiles = []string{file}
+		assert.ErrorContains(t, wfs.Validate(), "require_files", file)
+	}
+}
+
+func TestValidateInvalidManifestFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ManifestFile = "/SHA256SUMS"
+	assert.ErrorContains(t, wfs.Validate(), "manifest_file")
+
+	wfs.ManifestFile = "../SHA256SUMS"
+	assert.ErrorContains(t, wfs.Validate(), "manifest_file")
+}
+
+func TestValidateInvalidTrash(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.TrashDir = "../trash"
+	assert.ErrorContains(t, wfs.Validate(), "trash_dir")
+
+	wfs = newTestWritableFileServer(t)
+	wfs.TrashKeep = -1
+	assert.ErrorContains(t, wfs.Validate(), "trash_keep")
+
+	wfs = newTestWritableFileServer(t)
+	wfs.TrashMaxAge = -1
+	assert.ErrorContains(t, wfs.Validate(), "trash_max_age")
+}
+
+func TestValidateNegativeMaxPathDepth(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxPathDepth = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_path_depth")
+}
+
+func TestValidateNegativeKeepBackups(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = -1
+	assert.ErrorContains(t, wfs.Validate(), "keep_backups")
+}
+
+func TestValidateNegativeStripComponents(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StripComponents = -1
+	assert.ErrorContains(t, wfs.Validate(), "strip_components")
+}
+
+func TestValidateInvalidGlob(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Exclude = []string{"[.git"}
+	assert.ErrorContains(t, wfs.Validate(), "glob")
+
+	wfs.Exclude = nil
+	wfs.ProtectedPaths = []string{"[robots.txt"}
+	assert.ErrorContains(t, wfs.Validate(), "glob")
+}
+
+func TestValidateNegativeQuota(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.QuotaMB = -1
+	assert.ErrorContains(t, wfs.Validate(), "quota_mb")
+}
+
+func TestValidateInvalidAllowedMethods(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowedMethods = []string{"PUT", "POST"}
+	assert.ErrorContains(t, wfs.Validate(), "allowed_methods")
+}
+
+func TestValidateInvalidStagingDir(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StagingDir = "../staging"
+	assert.ErrorContains(t, wfs.Validate(), "staging_dir")
+
+	wfs.StagingDir = "/tmp/staging"
+	assert.ErrorContains(t, wfs.Validate(), "staging_dir")
+}
+
+func TestValidateCreatesStagingDir(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StagingDir = ".deploy-staging"
+	assert.NoError(t, wfs.Validate())
+	assertDirectoryEmpty(t, wfs.Root+"/.deploy-staging")
+}
+
+func TestValidateNegativeReadTimeout(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ReadTimeout = -1
+	assert.ErrorContains(t, wfs.Validate(), "read_timeout")
+}
+
+func TestValidateInvalidHealthPath(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.HealthPath = ".health"
+	assert.ErrorContains(t, wfs.Validate(), "health_path")
+}
+
+func TestValidateNegativeMaxDeployTimeout(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxDeployTimeout = -1
+	assert.ErrorContains(t, wfs.Validate(), "max_deploy_timeout")
+}
+
+func TestValidateInvalidWebhook(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Webhook = "example.com/hook"
+	assert.ErrorContains(t, wfs.Validate(), "webhook")
+}
+
+func TestValidateRootIsFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Root += "/file"
+	if err := os.WriteFile(wfs.Root, []byte{}, FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, wfs.Validate(), "not a directory")
+}
+
+func TestValidateRootDoesNotExist(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Root += "/missing"
+	assert.ErrorIs(t, wfs.Validate(), os.ErrNotExist)
+}
+
+func TestValidateRootNotWritable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("Skipping permission test: not enforced for this user")
+	}
+
+	wfs := newTestWritableFileServer(t)
+	if err := os.Chmod(wfs.Root, 0500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(wfs.Root, DIR_PERM) })
+
+	assert.ErrorContains(t, wfs.Validate(), "not writable")
+}
+
+func TestValidateInvalidDeployMode(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.DeployMode = "overlay"
+	assert.ErrorContains(t, wfs.Validate(), "deploy_mode")
+}
+
+func TestValidateInvalidPerm(t *testing.T) {
+	var tests = map[string]string{
+		"not octal":    "0789",
+		"not a number": "rwx",
+		"out of range": "01777",
+	}
+
+	for name, perm := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.DirPerm = perm
+			assert.ErrorContains(t, wfs.Validate(), "dir_perm")
+
+			wfs = newTestWritableFileServer(t)
+			wfs.FilePerm = perm
+			assert.ErrorContains(t, wfs.Validate(), "file_perm")
+
+			wfs = newTestWritableFileServer(t)
+			wfs.Umask = perm
+			assert.ErrorContains(t, wfs.Validate(), "umask")
+		})
+	}
+}
+
 // ╔══════════════════════════════════════════════════════════════════════════════╗
 // ║                               Invalid Requests                               ║
 // ╚══════════════════════════════════════════════════════════════════════════════╝
@@ -122,7 +460,6 @@ func TestOnlyPUTAndDeleteAllowed(t *testing.T) {
 	var tests = []string{
 		http.MethodGet,
 		http.MethodHead,
-		http.MethodPatch,
 		http.MethodPost,
 	}
 	wfs := newTestWritableFileServer(t)
@@ -141,160 +478,2442 @@ func TestOnlyPUTAndDeleteAllowed(t *testing.T) {
 			assert.True(t, ok)
 			assert.Equal(t, http.StatusMethodNotAllowed, errHandler.StatusCode)
 			assert.Equal(t, fmt.Sprintf("Unauthorized method: %s\n", method), w.Body.String())
+			assert.Equal(t, "OPTIONS, PUT, PATCH, DELETE, MOVE, COPY", w.Header().Get("Allow"))
 		})
 	}
 }
 
-func TestRejectWindowADSPath(t *testing.T) {
-	if runtime.GOOS != "windows" {
-		t.Skip("Skipping windows specific tests")
+func TestAllowedMethods(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowedMethods = []string{"PUT"}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// DELETE is supported but not allowed
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/test.txt", nil)
+
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusMethodNotAllowed, errHandler.StatusCode)
+	assert.Equal(t, "OPTIONS, PUT", w.Header().Get("Allow"))
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
+
+func TestOptions(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "OPTIONS", "/test.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "OPTIONS, PUT, PATCH, DELETE, MOVE, COPY", w.Header().Get("Allow"))
+	assert.Empty(t, w.Body.String())
+}
+
+func TestErrorBodyHidesRoot(t *testing.T) {
+	var tests = map[string]struct {
+		method string
+		path   string
+		status int
+	}{
+		"delete missing target": {"DELETE", "/missing.txt", http.StatusNotFound},
+		"move missing target":   {"MOVE", "/missing.txt", http.StatusNotFound},
+		"upload under a file":   {"PUT", "/file.txt/test.txt", http.StatusConflict},
+		"upload over a file":    {"PUT", "/file.txt/", http.StatusConflict},
 	}
 
-	pathWithADS := `\Path\To\Your\File.txt:hiddenstream.txt`
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			if err := os.WriteFile(wfs.Root+"/file.txt", []byte("original"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, test.method, test.path, newFile())
+			r.Header.Add("Content-Type", "application/x-tar")
+			r.Header.Add("Destination", "/moved.txt")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assert.Equal(t, test.status, w.Code)
+			assert.NotEmpty(t, w.Body.String())
+			assert.NotContains(t, w.Body.String(), wfs.Root)
+			assert.True(t, strings.HasSuffix(w.Body.String(), "\n"))
+			assert.False(t, strings.HasSuffix(w.Body.String(), "\n\n"))
+		})
+	}
+}
+
+func TestErrorBodyEndsWithNewline(t *testing.T) {
+	var tests = map[string]string{
+		"without newline": "invalid request",
+		"with newline":    "invalid request\n",
+		"with newlines":   "invalid request\n\n",
+	}
+
+	for name, public := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("PUT", "/", nil)
+			wfs.handleError("", w, r, &ErrorDeployement{http.StatusBadRequest, errors.New("invalid"), public})
+
+			assert.Equal(t, "invalid request\n", w.Body.String())
+		})
+	}
+}
+
+func TestErrorBodyDefaultsToStatusText(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/", nil)
+	err := wfs.handleError("", w, r, &ErrorDeployement{
+		http.StatusInternalServerError,
+		fmt.Errorf("failed to write %s", wfs.Root),
+		"",
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError)+"\n", w.Body.String())
+}
 
+func TestDeployIdHeader(t *testing.T) {
 	wfs := newTestWritableFileServer(t)
+	core, logs := observer.New(zapcore.DebugLevel)
+	wfs.logger = zap.New(core)
+
 	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", pathWithADS, bytes.NewBuffer([]byte{}))
-	r.Header.Add("Content-Type", "application/octet-stream")
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	w := httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	success := w.Header().Get("X-Deploy-Id")
+	assert.NotEmpty(t, success)
+
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+	w = httptest.NewRecorder()
+	assert.Error(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	failure := w.Header().Get("X-Deploy-Id")
+	assert.NotEmpty(t, failure)
+	assert.NotEqual(t, success, failure)
+
+	// The id of the failed request is in the fields of its error log
+	warnings := logs.FilterLevelExact(zapcore.WarnLevel).All()
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, failure, warnings[0].ContextMap()["id"])
+	}
+}
+
+func TestRootResolvedEmpty(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Root = "{http.vars.root}"
+
+	// Anything written by mistake would land in the working directory
+	cwd := t.TempDir()
+	t.Chdir(cwd)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", strings.NewReader("test"))
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInternalServerError, errHandler.StatusCode)
+	assert.ErrorContains(t, errHandler.Err, "root resolved empty")
+	assertDirectoryEmpty(t, cwd)
+}
+
+func TestBaseRoot(t *testing.T) {
+	base := t.TempDir()
+	wfs := newTestWritableFileServer(t)
+	wfs.Root = base + "/sites/{http.auth.user.id}"
+	wfs.BaseRoot = base + "/sites"
+
+	var tests = map[string]int{
+		"alice":          http.StatusCreated,
+		"team/bob":       http.StatusCreated,
+		"../escaped":     http.StatusForbidden,
+		"alice/../..":    http.StatusForbidden,
+		"../sites-other": http.StatusForbidden,
+		"":               http.StatusForbidden,
+		".":              http.StatusForbidden,
+	}
+
+	for user, status := range tests {
+		t.Run(user, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			repl.Set("http.auth.user.id", user)
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+			w := httptest.NewRecorder()
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			if status == http.StatusCreated {
+				assert.NoError(t, err)
+				assert.Equal(t, status, w.Code)
+				assertFileExist(t, base+"/sites/"+user+"/test.txt")
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, status, err.(caddyhttp.HandlerError).StatusCode)
+			}
+		})
+	}
+
+	assert.NoFileExists(t, base+"/escaped/test.txt")
+	assert.NoFileExists(t, base+"/test.txt")
+	assert.NoFileExists(t, base+"/sites/test.txt")
+	assert.NoFileExists(t, base+"/sites-other/test.txt")
+}
+
+func TestRejectStagingPath(t *testing.T) {
+	var tests = map[string]func(r *http.Request){
+		"target": func(r *http.Request) {},
+		"destination": func(r *http.Request) {
+			r.Method = "COPY"
+			r.URL.Path = "/test.txt"
+			r.Header.Add("Destination", "/.deploy-staging/test.txt")
+		},
+	}
+
+	for name, prepare := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.StagingDir = ".deploy-staging"
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/.deploy-staging/test.txt", newFile())
+			prepare(r)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusForbidden, errHandler.StatusCode)
+		})
+	}
+}
+
+// Return a server protecting robots.txt and .well-known/, with an existing robots.txt
+func newProtectedWritableFileServer(t *testing.T) *WritableFileServer {
+	wfs := newTestWritableFileServer(t)
+	wfs.ProtectedPaths = []string{"/robots.txt", ".well-known/"}
+
+	if err := os.WriteFile(wfs.Root+"/robots.txt", []byte("protected"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	return wfs
+}
+
+func TestRejectProtectedPath(t *testing.T) {
+	var tests = map[string]func(r *http.Request){
+		"PUT":        func(r *http.Request) {},
+		"PUT inside": func(r *http.Request) { r.URL.Path = "/.well-known/security.txt" },
+		"PATCH":      func(r *http.Request) { r.Method = "PATCH" },
+		"DELETE":     func(r *http.Request) { r.Method = "DELETE" },
+		"MOVE":       func(r *http.Request) { r.Method = "MOVE"; r.Header.Add("Destination", "/other.txt") },
+		"MOVE over": func(r *http.Request) {
+			r.Method = "MOVE"
+			r.URL.Path = "/test.txt"
+			r.Header.Add("Destination", "/robots.txt")
+		},
+		"COPY over": func(r *http.Request) {
+			r.Method = "COPY"
+			r.URL.Path = "/test.txt"
+			r.Header.Add("Destination", "/robots.txt")
+		},
+		"PUT restore":  func(r *http.Request) { r.URL.RawQuery = "restore=1" },
+		"PUT sanitize": func(r *http.Request) { r.URL.Path = "/site/../robots.txt" },
+	}
+
+	for name, prepare := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newProtectedWritableFileServer(t)
+			if err := os.WriteFile(wfs.Root+"/test.txt", []byte("test"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/robots.txt", newFile())
+			prepare(r)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusForbidden, errHandler.StatusCode)
+			assert.Equal(t, "the target is protected\n", w.Body.String())
+
+			content, err := os.ReadFile(wfs.Root + "/robots.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "protected", string(content))
+			assertFileExist(t, wfs.Root+"/test.txt")
+			assert.NoDirExists(t, wfs.Root+"/.well-known")
+		})
+	}
+}
+
+func TestDeniedExtensions(t *testing.T) {
+	var tests = map[string]func(r *http.Request){
+		"PUT":       func(r *http.Request) {},
+		"uppercase": func(r *http.Request) { r.URL.Path = "/INDEX.PHP" },
+		"MOVE": func(r *http.Request) {
+			r.Method = "MOVE"
+			r.URL.Path = "/test.txt"
+			r.Header.Add("Destination", "/test.cgi")
+		},
+		"archive": func(r *http.Request) {
+			r.URL.Path = "/site/"
+			r.Body = newTarWith(
+				tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "index"},
+				tarEntry{&tar.Header{Name: "admin/shell.Php", Typeflag: tar.TypeReg, Mode: 0644}, "<?php"},
+			)
+			r.Header.Set("Content-Type", "application/x-tar")
+		},
+	}
+
+	for name, prepare := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.DeniedExtensions = []string{"php", ".CGI"}
+			provisionTestWritableFileServer(t, wfs)
+			if err := os.WriteFile(wfs.Root+"/test.txt", []byte("test"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/index.php", newFile())
+			prepare(r)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusForbidden, errHandler.StatusCode)
+			assert.Contains(t, w.Body.String(), "are not allowed")
+			assert.NoFileExists(t, wfs.Root+"/index.php")
+			assert.NoFileExists(t, wfs.Root+"/test.cgi")
+			assert.NoDirExists(t, wfs.Root+"/site")
+			assertFileExist(t, wfs.Root+"/test.txt")
+		})
+	}
+}
+
+func TestProtectedPathAdjacentAllowed(t *testing.T) {
+	wfs := newProtectedWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/robots.txt.bak", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/robots.txt.bak")
+
+	// Copying a protected path only reads it
+	r, _ = http.NewRequestWithContext(ctx, "COPY", "/robots.txt", nil)
+	r.Header.Add("Destination", "/robots-copy.txt")
+
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/robots-copy.txt")
+	assertFileExist(t, wfs.Root+"/robots.txt")
+}
+
+func TestRejectWindowADSPath(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Skipping windows specific tests")
+	}
+
+	pathWithADS := `\Path\To\Your\File.txt:hiddenstream.txt`
+
+	wfs := newTestWritableFileServer(t)
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", pathWithADS, bytes.NewBuffer([]byte{}))
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+}
+
+func TestRejectWindowsDeviceName(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Skipping windows specific tests")
+	}
+
+	wfs := newTestWritableFileServer(t)
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/CON.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+}
+
+func TestUploadDirectoryWindowsDeviceName(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Skipping windows specific tests")
+	}
+
+	wfs := newTestWritableFileServer(t)
+	archive := newTarWith(tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "aux", Mode: 0644}, "aux"})
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", archive)
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assert.Contains(t, w.Body.String(), "reserved device name")
+	assert.NoDirExists(t, wfs.Root+"/site")
+}
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                                 Upload File                                  ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestUploadFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi. What are you doing here?\n", string(data))
+}
+
+func TestUploadFileStatusCode(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/test.txt", w.Header().Get("Location"))
+
+	// Overwrite
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestUploadFilePerm(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.DirPerm = "0750"
+	wfs.FilePerm = "0600"
+	provisionTestWritableFileServer(t, wfs)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/dir/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/dir/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	info, err = os.Stat(wfs.Root + "/dir")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestUploadFileUmask(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.DirPerm = "0770"
+	wfs.FilePerm = "0660"
+	wfs.Umask = "0027"
+	provisionTestWritableFileServer(t, wfs)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/dir/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/dir/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	info, err = os.Stat(wfs.Root + "/dir")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestUploadFileWithEmptyBody(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", bytes.NewBuffer([]byte{}))
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), 0)
+}
+
+func TestUploadFileWithEmptyBodyRejected(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	allow := false
+	wfs.AllowEmptyUpload = &allow
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", bytes.NewBuffer([]byte{}))
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+
+	// Only files are refused, an empty directory is a valid deploy
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", bytes.NewBuffer([]byte{}))
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	assertDirectoryExist(t, wfs.Root+"/site")
+}
+
+// Count the calls to Sync on the files opened for extraction
+type syncCounter struct {
+	sync.Mutex
+	count int
+}
+
+type countedFile struct {
+	writableFile
+	counter *syncCounter
+}
+
+func (f countedFile) Sync() error {
+	f.counter.Lock()
+	f.counter.count++
+	f.counter.Unlock()
+	return f.writableFile.Sync()
+}
+
+func countSyncs(t *testing.T) *syncCounter {
+	counter := &syncCounter{}
+	original := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+		file, err := original(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return countedFile{file, counter}, nil
+	}
+	t.Cleanup(func() { openFile = original })
+	return counter
+}
+
+func TestUploadFileFsync(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		t.Run(fmt.Sprint(fsync), func(t *testing.T) {
+			counter := countSyncs(t)
+			wfs := newTestWritableFileServer(t)
+			wfs.Fsync = fsync
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+			r.Header.Add("Content-Type", "application/octet-stream")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+			assertFileExist(t, wfs.Root+"/test.txt")
+
+			if fsync {
+				assert.Equal(t, 1, counter.count)
+			} else {
+				assert.Equal(t, 0, counter.count)
+			}
+		})
+	}
+}
+
+func TestUploadFileStaging(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StagingDir = ".deploy-staging"
+
+	// Record the swaps to check they come from the staging directory
+	renamed := []string{}
+	original := rename
+	rename = func(oldpath string, newpath string) error {
+		renamed = append(renamed, oldpath)
+		return original(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = original })
+
+	for _, expected := range []int{http.StatusCreated, http.StatusNoContent} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, w.Code)
+	}
+
+	assertFileExist(t, wfs.Root+"/test.txt")
+	assertDirectoryEmpty(t, wfs.Root+"/.deploy-staging")
+	for _, path := range renamed {
+		assert.True(t, isWithin(wfs.Root+"/.deploy-staging", path) || path == wfs.Root+"/test.txt", path)
+	}
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestUploadFileRollbackFailure(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the backup of the target succeeds, the swap and the restore both fail
+	original := rename
+	rename = func(oldpath string, newpath string) error {
+		if strings.HasSuffix(oldpath, "-tmp") {
+			return errors.New("injected swap failure")
+		}
+		if strings.HasSuffix(oldpath, "-backup") {
+			return errors.New("injected restore failure")
+		}
+		return original(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = original })
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInternalServerError, errHandler.StatusCode)
+	assert.ErrorContains(t, errHandler.Err, "failed to swap")
+	assert.ErrorContains(t, errHandler.Err, "injected swap failure")
+	assert.ErrorContains(t, errHandler.Err, "failed to rollback")
+	assert.ErrorContains(t, errHandler.Err, "injected restore failure")
+}
+
+func TestUploadFileSwapFailureCleansUp(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	original := rename
+	rename = func(oldpath string, newpath string) error {
+		if strings.HasSuffix(oldpath, "-tmp") {
+			return errors.New("injected swap failure")
+		}
+		return original(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = original })
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.Error(t, err)
+
+	// The original is restored and neither the temporary file nor the backup remain
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadFileOverDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.Mkdir(wfs.Root+"/test.txt", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	assertDirectoryExist(t, wfs.Root+"/test.txt")
+}
+
+func TestUploadFileUnderFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/parent", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/parent/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	assertFileExist(t, wfs.Root+"/parent")
+}
+
+func TestUploadFileUnderNestedFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.MkdirAll(wfs.Root+"/a", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/a/b", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a/b/c.txt", "/a/b/c/d.txt", "/a/b/c/"} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", path, newFile())
+		r.Header.Add("Content-Type", "application/x-tar")
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		errHandler, ok := err.(caddyhttp.HandlerError)
+
+		assert.True(t, ok, path)
+		assert.Equal(t, http.StatusConflict, errHandler.StatusCode, path)
+		assert.Equal(t, "a parent of the target is a file: /a/b\n", w.Body.String(), path)
+		assert.NotContains(t, w.Body.String(), wfs.Root, path)
+	}
+	assertFileExist(t, wfs.Root+"/a/b")
+}
+
+func TestUploadFileTooLarge(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", bytes.NewBuffer(make([]byte, 2<<20)))
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, errHandler.StatusCode)
+}
+
+// A body counting the bytes read from it by the client
+type trackingReader struct {
+	reader io.Reader
+	n      atomic.Int64
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Send a PUT of body to a real server with an `Expect: 100-continue` header
+func putExpectContinue(t *testing.T, wfs *WritableFileServer, path string, contentType string, body *trackingReader, size int64) *http.Response {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		wfs.ServeHTTP(w, r.WithContext(ctx), &MockHandler{})
+	}))
+	t.Cleanup(server.Close)
+
+	r, _ := http.NewRequest("PUT", server.URL+path, body)
+	r.ContentLength = size
+	r.Header.Set("Expect", "100-continue")
+	r.Header.Set("Content-Type", contentType)
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestUploadFileExpectContinue(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	body := &trackingReader{reader: bytes.NewReader(make([]byte, 1024))}
+	resp := putExpectContinue(t, wfs, "/test.txt", "application/octet-stream", body, 1024)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, int64(1024), body.n.Load())
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
+
+func TestUploadFileTooLargeExpectContinue(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	// The body is rejected from its Content-Length, before the client sends it
+	body := &trackingReader{reader: bytes.NewReader(make([]byte, 2<<20))}
+	resp := putExpectContinue(t, wfs, "/test.txt", "application/octet-stream", body, 2<<20)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, int64(0), body.n.Load())
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryBadContentTypeExpectContinue(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	body := &trackingReader{reader: bytes.NewReader(make([]byte, 1024))}
+	resp := putExpectContinue(t, wfs, "/site/", "text/plain", body, 1024)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, int64(0), body.n.Load())
+}
+
+// Send a PUT of body to a real server with `Transfer-Encoding: chunked` and no
+// Content-Length. Return the response and the transfer encoding seen by the server.
+func putChunked(t *testing.T, wfs *WritableFileServer, path string, contentType string, body io.Reader) (*http.Response, []string) {
+	var encoding []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.TransferEncoding
+		ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		wfs.ServeHTTP(w, r.WithContext(ctx), &MockHandler{})
+	}))
+	t.Cleanup(server.Close)
+
+	// A reader of unknown size is streamed in chunks
+	r, _ := http.NewRequest("PUT", server.URL+path, io.MultiReader(body))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp, encoding
+}
+
+func TestUploadFileChunked(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	resp, encoding := putChunked(t, wfs, "/test.txt", "application/octet-stream", bytes.NewReader(make([]byte, 512<<10)))
+
+	assert.Equal(t, []string{"chunked"}, encoding)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	info, err := os.Stat(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512<<10), info.Size())
+}
+
+func TestUploadFileTooLargeChunked(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	// Without a Content-Length the limit is only hit while reading
+	resp, encoding := putChunked(t, wfs, "/test.txt", "application/octet-stream", bytes.NewReader(make([]byte, 2<<20)))
+
+	assert.Equal(t, []string{"chunked"}, encoding)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryTooLargeChunked(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+
+	content := strings.Repeat("a", 2<<20)
+	archive := newTarWith(tarEntry{&tar.Header{Name: "large.txt", Typeflag: tar.TypeReg, Mode: 0644}, content})
+	resp, _ := putChunked(t, wfs, "/site/", "application/x-tar", archive)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+
+	archive = newTarWith(tarEntry{&tar.Header{Name: "small.txt", Typeflag: tar.TypeReg, Mode: 0644}, "small"})
+	resp, _ = putChunked(t, wfs, "/site/", "application/x-tar", archive)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assertFileExist(t, wfs.Root+"/site/small.txt")
+}
+
+func TestUploadFilePBT(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		var (
+			path = GenetatorUrlPath().Draw(t, "path")
+			body = rapid.SliceOf(rapid.Byte()).Draw(t, "body")
+		)
+		wfs := newTestWritableFileServer(t)
+
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/"+path, bytes.NewBuffer(body))
+		r.Header.Add("Content-Type", "application/octet-stream")
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		if err != nil {
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.True(t, errHandler.StatusCode < 500)
+		}
+	})
+}
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                               Upload Directory                               ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestUploadDirectoryTar(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+}
+
+func TestUploadDirectoryTarGz(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarGz())
+	r.Header.Add("Content-Type", "application/x-tar+gzip")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	// Check directory structure
+	assertDirectoryExist(t, wfs.Root+"/tested/with-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/empty-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/no-file/")
+	assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
+	assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+
+	// Check files content
+	data, err := os.ReadFile(wfs.Root + "/tested/empty-file/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), 0)
+
+	data, err = os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "deeeep!\n", string(data))
+
+}
+
+func TestUploadDirectoryTarXz(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarXz())
+	r.Header.Add("Content-Type", "application/x-tar+xz")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	// Check directory structure
+	assertDirectoryExist(t, wfs.Root+"/tested/with-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/empty-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/no-file/")
+	assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
+	assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+
+	// Check files content
+	data, err := os.ReadFile(wfs.Root + "/tested/empty-file/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), 0)
+
+	data, err = os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "deeeep!\n", string(data))
+}
+
+func TestUploadDirectoryTarZst(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarZst())
+	r.Header.Add("Content-Type", "application/x-tar+zst")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	// Check directory structure
+	assertDirectoryExist(t, wfs.Root+"/tested/with-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/empty-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/no-file/")
+	assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
+	assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+
+	// Check files content
+	data, err := os.ReadFile(wfs.Root + "/tested/empty-file/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), 0)
+
+	data, err = os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "deeeep!\n", string(data))
+}
+
+func TestUploadDirectoryTarBz2(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarBz2())
+	r.Header.Add("Content-Type", "application/x-tar+bzip2")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	// Check directory structure
+	assertDirectoryExist(t, wfs.Root+"/tested/with-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/empty-file/")
+	assertDirectoryExist(t, wfs.Root+"/tested/no-file/")
+	assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
+	assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+
+	// Check files content
+	data, err := os.ReadFile(wfs.Root + "/tested/empty-file/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), 0)
+
+	data, err = os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "deeeep!\n", string(data))
+}
+
+func TestUploadDirectoryTarBz2Corrupt(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", bytes.NewBufferString("BZh9 not really bzip2"))
+	r.Header.Add("Content-Type", "application/x-tar+bzip2")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryTooManyEntries(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxEntries = 5
+
+	// The test archive has 7 entries
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryMaxFileSize(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxFileSizeMB = 1
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "index"},
+		tarEntry{&tar.Header{Name: "debug.log", Typeflag: tar.TypeReg, Mode: 0644}, strings.Repeat("a", 1024*1024+1)},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, errHandler.StatusCode)
+	assert.Contains(t, w.Body.String(), "maximum size of 1 MB")
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryMaxPathDepth(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxPathDepth = 3
+
+	// site/a/b.txt fits, site/a/b/c.txt is one component too deep
+	for path, expected := range map[string]int{"a/b.txt": http.StatusCreated, "a/b/c.txt": http.StatusBadRequest} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+			tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "index"},
+			tarEntry{&tar.Header{Name: path, Typeflag: tar.TypeReg, Mode: 0644}, "nested"},
+		))
+		r.Header.Add("Content-Type", "application/x-tar")
+
+		w := httptest.NewRecorder()
+
+		wfs.ServeHTTP(w, r, &MockHandler{})
+		assert.Equal(t, expected, w.Code, path)
+	}
+	assertFileExist(t, wfs.Root+"/site/a/b.txt")
+	_, err := os.Stat(wfs.Root + "/site/a/b")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUploadFileMaxPathDepth(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxPathDepth = 2
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/a/b/c.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assert.Equal(t, "path exceeds the maximum depth of 2\n", w.Body.String())
+	assertDirectoryEmpty(t, wfs.Root)
+
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/a/b.txt", newFile())
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/a/b.txt")
+}
+
+func TestUploadDirectoryProgressLog(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ProgressLogMB = 1
+	core, logs := observer.New(zapcore.DebugLevel)
+	wfs.logger = zap.New(core)
+
+	// Only the archives above 1 MB log their progress
+	small := newTarWith(tarEntry{&tar.Header{Name: "small.txt", Typeflag: tar.TypeReg, Mode: 0644}, "small"})
+	large := newTarWith(
+		tarEntry{&tar.Header{Name: "a.bin", Typeflag: tar.TypeReg, Mode: 0644}, strings.Repeat("a", 1024*1024)},
+		tarEntry{&tar.Header{Name: "b.bin", Typeflag: tar.TypeReg, Mode: 0644}, strings.Repeat("b", 1024*1024)},
+		tarEntry{&tar.Header{Name: "c.txt", Typeflag: tar.TypeReg, Mode: 0644}, "c"},
+	)
+	for path, body := range map[string]io.Reader{"/small/": small, "/large/": large} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", path, body)
+		r.Header.Add("Content-Type", "application/x-tar")
+		assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	}
+
+	progress := logs.FilterMessage("extraction progress").All()
+	if assert.Len(t, progress, 2) {
+		assert.Equal(t, int64(1024*1024), progress[0].ContextMap()["bytes"])
+		assert.Equal(t, int64(1), progress[0].ContextMap()["entries"])
+		assert.Equal(t, int64(2*1024*1024), progress[1].ContextMap()["bytes"])
+		assert.Equal(t, int64(2), progress[1].ContextMap()["entries"])
+		assert.Contains(t, progress[0].ContextMap()["target"], "large")
+	}
+	done := logs.FilterMessage("extraction done").All()
+	if assert.Len(t, done, 1) {
+		assert.Equal(t, int64(3), done[0].ContextMap()["entries"])
+	}
+}
+
+func TestUploadDirectoryDetectArchiveType(t *testing.T) {
+	var tests = map[string]func() io.ReadCloser{
+		"tar":     newTar,
+		"tar.gz":  newTarGz,
+		"tar.xz":  newTarXz,
+		"tar.zst": newTarZst,
+		"tar.bz2": newTarBz2,
+	}
+
+	for name, newArchive := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newArchive())
+			r.Header.Add("Content-Type", "application/octet-stream")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
+			assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
+
+			data, err := os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "deeeep!\n", string(data))
+		})
+	}
+}
+
+func TestUploadDirectoryUnknownArchiveType(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+
+	_, err = os.Stat(wfs.Root + "/site")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUploadDirectoryUncompressedTooLarge(t *testing.T) {
+	// A tar holding 2 MB of zeros compresses to a few kilobytes
+	archive, err := io.ReadAll(newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "zeros", Mode: 0644}, string(make([]byte, 2<<20))},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipped := &bytes.Buffer{}
+	gzw := gzip.NewWriter(gzipped)
+	gzw.Write(archive)
+	gzw.Close()
+
+	xzed := &bytes.Buffer{}
+	xzw, err := xz.NewWriter(xzed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xzw.Write(archive)
+	xzw.Close()
+
+	zstw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zsted := bytes.NewBuffer(zstw.EncodeAll(archive, nil))
+
+	var tests = map[string]*bytes.Buffer{
+		"application/x-tar+gzip": gzipped,
+		"application/x-tar+xz":   xzed,
+		"application/x-tar+zst":  zsted,
+	}
+
+	for contentType, body := range tests {
+		t.Run(contentType, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.MaxUncompressedMB = 1
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", body)
+			r.Header.Add("Content-Type", contentType)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, errHandler.StatusCode)
+
+			_, err = os.Stat(wfs.Root + "/site")
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestUploadDirectoryStatusCode(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/site/", w.Header().Get("Location"))
+
+	// Overwrite
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestUploadDirectoryConcurrently(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("/site-%d/", i), newTar())
+			r.Header.Add("Content-Type", "application/x-tar")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// No temporary or backup directory should be left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 50)
+	for i := range 50 {
+		assertFileExist(t, fmt.Sprintf("%s/site-%d/tested/with-file/deep.txt", wfs.Root, i))
+	}
+	assert.Empty(t, locks.locks)
+}
+
+func newTarWithModes() io.ReadCloser {
+	return newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "shared/", Mode: 01777}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "shared/open.sh", Mode: 0777}, "echo open"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "shared/suid", Mode: 06755}, "echo root"},
+	)
+}
+
+func TestUploadDirectoryIgnoreArchiveModes(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarWithModes())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/shared")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|DIR_PERM, info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/open.sh")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(FILE_PERM), info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/suid")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(FILE_PERM), info.Mode())
+}
+
+func TestUploadDirectoryPreserveArchiveModes(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PreserveArchiveModes = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarWithModes())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/shared")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSticky|0777, info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/open.sh")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0777), info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/suid")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+}
+
+func TestUploadDirectoryPreserveArchiveModesNested(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PreserveArchiveModes = true
+	t.Cleanup(func() { os.Chmod(wfs.Root+"/locked", DIR_PERM) })
+
+	// The parent loses its search permission after its child got its mode
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "locked/", Mode: 0600}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "locked/a/", Mode: 0755}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "locked/a/b/", Mode: 0700}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/locked")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0600, info.Mode())
+
+	os.Chmod(wfs.Root+"/locked", DIR_PERM)
+	info, err = os.Stat(wfs.Root + "/locked/a")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0755, info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/locked/a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0700, info.Mode())
+}
+
+func TestUploadDirectoryPreserveArchiveModesUmask(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PreserveArchiveModes = true
+	wfs.Umask = "0077"
+	provisionTestWritableFileServer(t, wfs)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarWithModes())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	info, err := os.Stat(wfs.Root + "/shared")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSticky|0700, info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/open.sh")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode())
+
+	info, err = os.Stat(wfs.Root + "/shared/suid")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode())
+}
+
+func TestUploadDirectoryMerge(t *testing.T) {
+	var tests = map[string]func(wfs *WritableFileServer, r *http.Request){
+		"header": func(wfs *WritableFileServer, r *http.Request) { r.Header.Add("X-Deploy-Mode", "merge") },
+		"config": func(wfs *WritableFileServer, r *http.Request) { wfs.DeployMode = DEPLOY_MODE_MERGE },
+	}
+
+	for name, setup := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			// Pre-populate the target with a file that is also in the archive and one that is not
+			if err := os.MkdirAll(wfs.Root+"/site/tested/", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(wfs.Root+"/site/tested/tested.txt", []byte("old"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(wfs.Root+"/site/tested/untouched.txt", []byte("untouched"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+			r.Header.Add("Content-Type", "application/x-tar")
+			setup(wfs, r)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusNoContent, w.Code)
+
+			data, err := os.ReadFile(wfs.Root + "/site/tested/untouched.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "untouched", string(data))
+
+			data, err = os.ReadFile(wfs.Root + "/site/tested/tested.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "success\n", string(data))
+
+			assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt")
+
+			// No temporary or backup directory should be left behind
+			entries, err := os.ReadDir(wfs.Root)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestUploadDirectoryFsync(t *testing.T) {
+	counter := countSyncs(t)
+	wfs := newTestWritableFileServer(t)
+	wfs.Fsync = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+
+	// One per regular file of the archive
+	assert.Equal(t, 3, counter.count)
+}
+
+func TestUploadDirectoryIgnoreSymlinks(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeSymlink, Name: "home.html", Linkname: "index.html"}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeLink, Name: "copy.html", Linkname: "index.html"}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(wfs.Root + "/site")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadDirectorySymlinks(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AllowSymlinks = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "pages/index.html", Mode: 0644}, "index"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeSymlink, Name: "home.html", Linkname: "pages/index.html"}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeSymlink, Name: "pages/up", Linkname: ".."}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeLink, Name: "copy.html", Linkname: "pages/index.html"}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	link, err := os.Readlink(wfs.Root + "/site/home.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "pages/index.html", link)
+
+	for _, path := range []string{"/site/home.html", "/site/copy.html", "/site/pages/up/pages/index.html"} {
+		data, err := os.ReadFile(wfs.Root + path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, "index", string(data), path)
+	}
+}
+
+func TestUploadDirectoryRejectSymlinksOutside(t *testing.T) {
+	var tests = map[string][]tarEntry{
+		"relative symlink": {
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "passwd", Linkname: "../../etc/passwd"}, ""},
+		},
+		"absolute symlink": {
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "passwd", Linkname: "/etc/passwd"}, ""},
+		},
+		"symlink through symlink": {
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "here", Linkname: "."}, ""},
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "pages/escape", Linkname: "../here/.."}, ""},
+		},
+		"entry inside symlink": {
+			{&tar.Header{Typeflag: tar.TypeDir, Name: "pages/", Mode: 0755}, ""},
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "alias", Linkname: "pages"}, ""},
+			{&tar.Header{Typeflag: tar.TypeReg, Name: "alias/index.html", Mode: 0644}, "index"},
+		},
+		"hardlink": {
+			{&tar.Header{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "../../etc/passwd"}, ""},
+		},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.AllowSymlinks = true
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(entries...))
+			r.Header.Add("Content-Type", "application/x-tar")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+
+			_, err = os.Stat(wfs.Root + "/site")
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func newTarWithPrefix() io.ReadCloser {
+	return newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "./dist/", Mode: 0755}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "./dist/index.html", Mode: 0644}, "index"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "./dist/pages/", Mode: 0755}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "./dist/pages/about.html", Mode: 0644}, "about"},
+	)
+}
+
+func TestUploadDirectoryStripComponents(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StripComponents = 1
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWithPrefix())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	assertFileExist(t, wfs.Root+"/site/index.html")
+	assertFileExist(t, wfs.Root+"/site/pages/about.html")
+
+	entries, err := os.ReadDir(wfs.Root + "/site")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestUploadDirectoryStripComponentsHeader(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWithPrefix())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Strip-Components", "2")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	// Entries with two components or less are skipped
+	assertFileExist(t, wfs.Root+"/site/about.html")
+
+	entries, err := os.ReadDir(wfs.Root + "/site")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadDirectoryFlatten(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Flatten = true
+	wfs.AllowSymlinks = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/assets/", newTarWith(
+		tarEntry{&tar.Header{Name: "css/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "css/style.css", Typeflag: tar.TypeReg, Mode: 0644}, "body {}"},
+		tarEntry{&tar.Header{Name: "js/vendor/lib.js", Typeflag: tar.TypeReg, Mode: 0644}, "lib()"},
+		tarEntry{&tar.Header{Name: "./logo.png", Typeflag: tar.TypeReg, Mode: 0644}, "png"},
+		tarEntry{&tar.Header{Name: "img/copy.png", Typeflag: tar.TypeLink, Linkname: "./logo.png"}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	for name, content := range map[string]string{"style.css": "body {}", "lib.js": "lib()", "logo.png": "png", "copy.png": "png"} {
+		data, err := os.ReadFile(wfs.Root + "/assets/" + name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, string(data), name)
+	}
+	entries, err := os.ReadDir(wfs.Root + "/assets")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestUploadDirectoryFlattenCollision(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.Flatten = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/assets/", newTarWith(
+		tarEntry{&tar.Header{Name: "en/index.html", Typeflag: tar.TypeReg, Mode: 0644}, "hello"},
+		tarEntry{&tar.Header{Name: "fr/index.html", Typeflag: tar.TypeReg, Mode: 0644}, "bonjour"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.Equal(t, "archive has several files named index.html: they cannot be flattened\n", w.Body.String())
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadDirectoryInvalidStripComponents(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWithPrefix())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Strip-Components", "-1")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func newTarMixed() io.ReadCloser {
+	return newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: ".DS_Store", Mode: 0644}, "junk"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: ".git/", Mode: 0755}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: ".git/config", Mode: 0644}, "secret"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "docs/guide.html", Mode: 0644}, "guide"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "docs/.DS_Store", Mode: 0644}, "junk"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "docs/draft.md", Mode: 0644}, "draft"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "src/main.go", Mode: 0644}, "package main"},
+	)
+}
+
+func TestUploadDirectoryFilterEntries(t *testing.T) {
+	var tests = map[string]struct {
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		"exclude": {
+			nil,
+			[]string{".git", ".DS_Store"},
+			[]string{"index.html", "docs/guide.html", "docs/draft.md", "src/main.go"},
+		},
+		"include": {
+			[]string{"*.html", "src"},
+			nil,
+			[]string{"index.html", "docs/guide.html", "src/main.go"},
+		},
+		"exclude takes precedence": {
+			[]string{"docs/*"},
+			[]string{"*.md", ".DS_Store"},
+			[]string{"docs/guide.html"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.Include = test.include
+			wfs.Exclude = test.exclude
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarMixed())
+			r.Header.Add("Content-Type", "application/x-tar")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			files := []string{}
+			filepath.WalkDir(wfs.Root+"/site", func(path string, entry fs.DirEntry, err error) error {
+				if err == nil && !entry.IsDir() {
+					rel, _ := filepath.Rel(wfs.Root+"/site", path)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			assert.ElementsMatch(t, test.expected, files)
+		})
+	}
+}
+
+func TestUploadDirectoryOverFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/site", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+
+	data, err := os.ReadFile(wfs.Root + "/site")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadDirectoryInvalidDeployMode(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Deploy-Mode", "overlay")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+}
+
+func TestUploadDirectoryWithEmptyBody(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/tested/", bytes.NewBuffer([]byte{}))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	assertDirectoryExist(t, wfs.Root+"/tested/")
+	assertDirectoryEmpty(t, wfs.Root+"/tested/")
+}
+
+func TestUploadDirectoryStaging(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StagingDir = ".deploy-staging"
+
+	for range 2 {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+		r.Header.Add("Content-Type", "application/x-tar")
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		assert.NoError(t, err)
+	}
+
+	assertDirectoryExist(t, wfs.Root+"/site/")
+	assertDirectoryEmpty(t, wfs.Root+"/.deploy-staging")
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestUploadDirectoryPreserveMTimes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprint(preserve), func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.PreserveMTimes = preserve
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+				tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0755, ModTime: mtime}, ""},
+				tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "docs/index.html", Mode: 0644, ModTime: mtime}, "index"},
+			))
+			r.Header.Add("Content-Type", "application/x-tar")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			for _, path := range []string{"/site/docs", "/site/docs/index.html"} {
+				info, err := os.Stat(wfs.Root + path)
+				assert.NoError(t, err)
+				if preserve {
+					assert.True(t, mtime.Equal(info.ModTime()), path)
+				} else {
+					assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute, path)
+				}
+			}
+		})
+	}
+}
+
+// Fail writes like a full disk
+type fullFile struct {
+	writableFile
+}
+
+func (f fullFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+func TestUploadDirectoryNoSpaceLeft(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.MkdirAll(wfs.Root+"/site", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/site/index.html", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	original := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+		file, err := original(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return fullFile{file}, nil
+	}
+	t.Cleanup(func() { openFile = original })
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+	assert.Equal(t, "not enough space left on the server\n", w.Body.String())
+
+	// The original is untouched and the temporary directory is gone
+	data, err := os.ReadFile(wfs.Root + "/site/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// Return test.tar cut in the middle of the content of its second regular file
+func newTruncatedTar() io.ReadCloser {
+	data, err := os.ReadFile("tests/assets/test.tar")
+	if err != nil {
+		panic(err)
+	}
+	return io.NopCloser(bytes.NewReader(data[:3076]))
+}
+
+func TestUploadDirectoryMalformedArchive(t *testing.T) {
+	var tests = map[string]io.ReadCloser{
+		"application/x-tar":      newTruncatedTar(),
+		"application/x-tar+gzip": io.NopCloser(bytes.NewBufferString("not a gzip stream")),
+	}
+
+	for contentType, body := range tests {
+		t.Run(contentType, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", body)
+			r.Header.Add("Content-Type", contentType)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+			assert.Equal(t, "invalid archive: the archive is truncated or corrupt\n", w.Body.String())
+			assertDirectoryEmpty(t, wfs.Root)
+		})
+	}
+}
+
+func TestUploadDirectoryValidateArchive(t *testing.T) {
+	for _, archive := range []string{"tar", "tar+gzip"} {
+		t.Run(archive, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.ValidateArchive = true
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			body := newTar()
+			if archive == "tar+gzip" {
+				body = newTarGz()
+			}
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", body)
+			r.Header.Add("Content-Type", "application/x-"+archive)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, w.Code)
+
+			assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt")
+			entries, err := os.ReadDir(wfs.Root)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestUploadDirectoryValidateArchiveTruncated(t *testing.T) {
+	var opened int
+	original := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (writableFile, error) {
+		opened++
+		return original(name, flag, perm)
+	}
+	t.Cleanup(func() { openFile = original })
+
+	wfs := newTestWritableFileServer(t)
+	wfs.ValidateArchive = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTruncatedTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assert.Equal(t, "invalid archive: the archive is truncated or corrupt\n", w.Body.String())
+
+	// No entry was extracted and the spool is gone
+	assert.Equal(t, 0, opened)
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestUploadDirectoryValidateArchiveMemoryBuffer(t *testing.T) {
+	var spooled []string
+	original := createSpool
+	createSpool = func(name string, perm os.FileMode) (*os.File, error) {
+		spooled = append(spooled, name)
+		return original(name, perm)
+	}
+	t.Cleanup(func() { createSpool = original })
+
+	wfs := newTestWritableFileServer(t)
+	wfs.ValidateArchive = true
+	wfs.MemoryBufferMB = 1
+
+	// Small archives stay in memory
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/small/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	assertFileExist(t, wfs.Root+"/small/tested/with-file/deep.txt")
+	assert.Empty(t, spooled)
+
+	// Large ones spill to disk, next to the target
+	content := strings.Repeat("a", 2<<20)
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/large/", newTarWith(
+		tarEntry{&tar.Header{Name: "large.txt", Typeflag: tar.TypeReg, Mode: 0644}, content},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	data, err := os.ReadFile(wfs.Root + "/large/large.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	if assert.Len(t, spooled, 1) {
+		assert.Equal(t, wfs.Root, filepath.Dir(spooled[0]))
+		assert.NoFileExists(t, spooled[0])
+	}
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestValidateNegativeMemoryBuffer(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MemoryBufferMB = -1
+	assert.ErrorContains(t, wfs.Validate(), "memory_buffer_mb")
+}
+
+func TestUploadDirectoryUnsafeEntries(t *testing.T) {
+	var tests = map[string]*tar.Header{
+		"absolute":  {Typeflag: tar.TypeReg, Name: "/etc/cron.d/job", Mode: 0644},
+		"traversal": {Typeflag: tar.TypeReg, Name: "../escaped.txt", Mode: 0644},
+		"char":      {Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		"block":     {Typeflag: tar.TypeBlock, Name: "sda", Mode: 0660, Devmajor: 8},
+		"fifo":      {Typeflag: tar.TypeFifo, Name: "pipe", Mode: 0644},
+		"newline":   {Typeflag: tar.TypeReg, Name: "forged\nlog.txt", Mode: 0644},
+		"escape":    {Typeflag: tar.TypeReg, Name: "\x1b[31mred.txt", Mode: 0644},
+	}
+
+	for name, hdr := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(tarEntry{hdr, ""}))
+			r.Header.Add("Content-Type", "application/x-tar")
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+			assert.Contains(t, w.Body.String(), "invalid archive")
+			assert.NoDirExists(t, wfs.Root+"/site")
+			assert.NoFileExists(t, wfs.Root+"/escaped.txt")
+		})
+	}
+}
+
+func TestUploadDirectoryNulInEntryName(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	// archive/tar refuses to write a NUL in a name, it is patched in the PAX record
+	// written for the non-ASCII name
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "evil_é.txt", Mode: 0644, Size: 1}))
+	tw.Write([]byte("x"))
+	assert.NoError(t, tw.Close())
+	archive := bytes.Replace(buf.Bytes(), []byte("path=evil_"), []byte("path=evil\x00"), 1)
+	assert.NotEqual(t, buf.Bytes(), archive)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", bytes.NewReader(archive))
+	r.Header.Add("Content-Type", "application/x-tar")
 
 	w := httptest.NewRecorder()
 
 	err := wfs.ServeHTTP(w, r, &MockHandler{})
 	errHandler, ok := err.(caddyhttp.HandlerError)
 
-	assert.NotNil(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+	assert.Contains(t, w.Body.String(), "invalid archive")
+	assert.NoDirExists(t, wfs.Root+"/site")
 }
 
-// ╔══════════════════════════════════════════════════════════════════════════════╗
-// ║                                 Upload File                                  ║
-// ╚══════════════════════════════════════════════════════════════════════════════╝
-
-func TestUploadFile(t *testing.T) {
+func TestUploadDirectorySanitizeEntryNames(t *testing.T) {
 	wfs := newTestWritableFileServer(t)
+	wfs.SanitizeEntryNames = true
 
 	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
-	r.Header.Add("Content-Type", "application/octet-stream")
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "forged\nlog.txt", Mode: 0644}, "forged"},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "dir\t/index.html", Mode: 0644}, "index"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
 
 	w := httptest.NewRecorder()
 
 	err := wfs.ServeHTTP(w, r, &MockHandler{})
 	assert.NoError(t, err)
-
-	data, err := os.ReadFile(wfs.Root + "/test.txt")
-	assert.NoError(t, err)
-	assert.Equal(t, "Hi. What are you doing here?\n", string(data))
+	assertFileExist(t, wfs.Root+"/site/forged_log.txt")
+	assertFileExist(t, wfs.Root+"/site/dir_/index.html")
 }
 
-func TestUploadFileWithEmptyBody(t *testing.T) {
+func TestUploadNormalizeUnicode(t *testing.T) {
 	wfs := newTestWritableFileServer(t)
+	wfs.NormalizeUnicode = true
 
+	// "é" decomposed as "e" and a combining acute accent, like macOS does
 	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", bytes.NewBuffer([]byte{}))
-	r.Header.Add("Content-Type", "application/octet-stream")
-
-	w := httptest.NewRecorder()
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "cafe\u0301/menu.txt", Mode: 0644}, "menu"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
 
-	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
 	assert.NoError(t, err)
+	assertFileExist(t, wfs.Root+"/site/caf\u00e9/menu.txt")
+	assert.NoDirExists(t, wfs.Root+"/site/cafe\u0301")
 
-	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/cafe%CC%81/tea.txt", newFile())
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
 	assert.NoError(t, err)
-	assert.Equal(t, len(data), 0)
-}
-
-func TestUploadFilePBT(t *testing.T) {
-	rapid.Check(t, func(t *rapid.T) {
-		var (
-			path = GenetatorUrlPath().Draw(t, "path")
-			body = rapid.SliceOf(rapid.Byte()).Draw(t, "body")
-		)
-		wfs := newTestWritableFileServer(t)
-
-		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-		r, _ := http.NewRequestWithContext(ctx, "PUT", "/"+path, bytes.NewBuffer(body))
-		r.Header.Add("Content-Type", "application/octet-stream")
-
-		w := httptest.NewRecorder()
-
-		err := wfs.ServeHTTP(w, r, &MockHandler{})
-		if err != nil {
-			errHandler, ok := err.(caddyhttp.HandlerError)
-
-			assert.NotNil(t, err)
-			assert.True(t, ok)
-			assert.True(t, errHandler.StatusCode < 500)
-		}
-	})
+	assertFileExist(t, wfs.Root+"/site/caf\u00e9/tea.txt")
 }
 
-// ╔══════════════════════════════════════════════════════════════════════════════╗
-// ║                               Upload Directory                               ║
-// ╚══════════════════════════════════════════════════════════════════════════════╝
-
-func TestUploadDirectoryTar(t *testing.T) {
+func TestUploadDirectoryRequireFiles(t *testing.T) {
 	wfs := newTestWritableFileServer(t)
+	wfs.RequireFiles = []string{"tested/tested.txt", "index.html"}
+
+	os.MkdirAll(wfs.Root+"/site", 0755)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("live"), 0644)
 
 	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTar())
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
 	r.Header.Add("Content-Type", "application/x-tar")
 
 	w := httptest.NewRecorder()
 
 	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnprocessableEntity, errHandler.StatusCode)
+	assert.Equal(t, "missing required files: index.html\n", w.Body.String())
+
+	// The live site is untouched and the temporary directory is gone
+	data, err := os.ReadFile(wfs.Root + "/site/index.html")
 	assert.NoError(t, err)
+	assert.Equal(t, "live", string(data))
+	assert.NoDirExists(t, wfs.Root+"/site/tested")
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Merged deploys only need the files once merged
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Deploy-Mode", "merge")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	assertFileExist(t, wfs.Root+"/site/tested/tested.txt")
 }
 
-func TestUploadDirectoryTarGz(t *testing.T) {
-	wfs := newTestWritableFileServer(t)
+func TestUploadDirectoryNestedArchive(t *testing.T) {
+	inner, err := io.ReadAll(newTarGz())
+	assert.NoError(t, err)
 
-	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTarGz())
-	r.Header.Add("Content-Type", "application/x-tar+gzip")
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprint(reject), func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.RejectNestedArchives = reject
 
-	w := httptest.NewRecorder()
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+				tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "index.html", Mode: 0644}, "index"},
+				tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "assets/bundle.tar.gz", Mode: 0644}, string(inner)},
+			))
+			r.Header.Add("Content-Type", "application/x-tar")
 
-	err := wfs.ServeHTTP(w, r, &MockHandler{})
-	assert.NoError(t, err)
+			w := httptest.NewRecorder()
 
-	// Check directory structure
-	assertDirectoryExist(t, wfs.Root+"/tested/with-file/")
-	assertDirectoryExist(t, wfs.Root+"/tested/empty-file/")
-	assertDirectoryExist(t, wfs.Root+"/tested/no-file/")
-	assertDirectoryEmpty(t, wfs.Root+"/tested/no-file/")
-	assertFileExist(t, wfs.Root+"/tested/empty-file/empty.txt")
-	assertFileExist(t, wfs.Root+"/tested/with-file/deep.txt")
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			if reject {
+				errHandler, ok := err.(caddyhttp.HandlerError)
+				assert.True(t, ok)
+				assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+				assert.Equal(t, "invalid archive: nested archives are not allowed\n", w.Body.String())
+				assert.NoDirExists(t, wfs.Root+"/site")
+				return
+			}
 
-	// Check files content
-	data, err := os.ReadFile(wfs.Root + "/tested/empty-file/empty.txt")
-	assert.NoError(t, err)
-	assert.Equal(t, len(data), 0)
+			// The inner archive is an opaque file
+			assert.NoError(t, err)
+			data, err := os.ReadFile(wfs.Root + "/site/assets/bundle.tar.gz")
+			assert.NoError(t, err)
+			assert.Equal(t, inner, data)
+			assert.NoDirExists(t, wfs.Root+"/site/assets/bundle")
+			assert.NoFileExists(t, wfs.Root+"/site/assets/tested/tested.txt")
+		})
+	}
+}
 
-	data, err = os.ReadFile(wfs.Root + "/tested/with-file/deep.txt")
-	assert.NoError(t, err)
-	assert.Equal(t, "deeeep!\n", string(data))
+func TestIsArchiveName(t *testing.T) {
+	var tests = map[string]bool{
+		"bundle.tar":        true,
+		"bundle.tar.gz":     true,
+		"BUNDLE.TGZ":        true,
+		"a/b/release.zip":   true,
+		"style.css.gz":      false,
+		"index.html":        false,
+		"tarball/index.htm": false,
+	}
 
+	for name, expected := range tests {
+		assert.Equal(t, expected, isArchiveName(name), name)
+	}
 }
 
-func TestUploadDirectoryWithEmptyBody(t *testing.T) {
+func TestUploadDirectoryDotEntry(t *testing.T) {
 	wfs := newTestWritableFileServer(t)
 
 	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
-	r, _ := http.NewRequestWithContext(ctx, "PUT", "/tested/", bytes.NewBuffer([]byte{}))
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755}, ""},
+		tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: "./index.html", Mode: 0644}, "index"},
+	))
 	r.Header.Add("Content-Type", "application/x-tar")
 
 	w := httptest.NewRecorder()
 
 	err := wfs.ServeHTTP(w, r, &MockHandler{})
 	assert.NoError(t, err)
-
-	assertDirectoryExist(t, wfs.Root+"/tested/")
-	assertDirectoryEmpty(t, wfs.Root+"/tested/")
+	assertFileExist(t, wfs.Root+"/site/index.html")
 }
 
-func TesUploadDirectoryTarPBT(t *testing.T) {
+func TestUploadDirectoryTarPBT(t *testing.T) {
 	rapid.Check(t, func(t *rapid.T) {
 		var (
 			path = GenetatorUrlPath().Draw(t, "path")
@@ -319,7 +2938,7 @@ func TesUploadDirectoryTarPBT(t *testing.T) {
 	})
 }
 
-func TesUploadDirectoryTarGzPBT(t *testing.T) {
+func TestUploadDirectoryTarGzPBT(t *testing.T) {
 	rapid.Check(t, func(t *rapid.T) {
 		var (
 			path = GenetatorUrlPath().Draw(t, "path")
@@ -364,6 +2983,7 @@ func TestDeleteFile(t *testing.T) {
 
 	err = wfs.ServeHTTP(w, r, &MockHandler{})
 	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
 
 	_, err = os.Stat(wfs.Root + "/test.txt")
 	assert.ErrorIs(t, err, os.ErrNotExist, wfs.Root+"/test.txt")
@@ -409,3 +3029,365 @@ func TestDeleteSubDirectory(t *testing.T) {
 	_, err = os.Stat(wfs.Root + wfs.Root + "/tested/")
 	assert.ErrorIs(t, err, os.ErrNotExist, wfs.Root+"/test.txt")
 }
+
+func TestDeleteNonEmptyDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.MkdirAll(wfs.Root+"/tested/nested/", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/tested/", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	assertDirectoryExist(t, wfs.Root+"/tested/nested/")
+}
+
+func TestDeleteNonEmptyDirectoryRecursively(t *testing.T) {
+	var tests = map[string]string{
+		"X-Recursive": "true",
+		"Depth":       "infinity",
+	}
+
+	for header, value := range tests {
+		t.Run(header, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			if err := os.MkdirAll(wfs.Root+"/tested/nested/", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "DELETE", "/tested/", nil)
+			r.Header.Add(header, value)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			_, err = os.Stat(wfs.Root + "/tested/")
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestDeleteDepth(t *testing.T) {
+	var tests = []struct {
+		headers  map[string]string
+		empty    int
+		nonEmpty int
+	}{
+		{map[string]string{}, http.StatusNoContent, http.StatusConflict},
+		{map[string]string{"Depth": "0"}, http.StatusNoContent, http.StatusConflict},
+		{map[string]string{"Depth": "0", "X-Recursive": "true"}, http.StatusNoContent, http.StatusConflict},
+		{map[string]string{"Depth": "infinity"}, http.StatusNoContent, http.StatusNoContent},
+		{map[string]string{"Depth": "Infinity"}, http.StatusNoContent, http.StatusNoContent},
+		{map[string]string{"Depth": "1"}, http.StatusBadRequest, http.StatusBadRequest},
+		{map[string]string{"Depth": "deep"}, http.StatusBadRequest, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.headers), func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			if err := os.MkdirAll(wfs.Root+"/empty/", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(wfs.Root+"/full/nested/", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			for path, expected := range map[string]int{"/empty/": test.empty, "/full/": test.nonEmpty} {
+				ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+				r, _ := http.NewRequestWithContext(ctx, "DELETE", path, nil)
+				for header, value := range test.headers {
+					r.Header.Add(header, value)
+				}
+
+				w := httptest.NewRecorder()
+
+				wfs.ServeHTTP(w, r, &MockHandler{})
+				assert.Equal(t, expected, w.Code, path)
+
+				_, err := os.Stat(wfs.Root + path)
+				if expected == http.StatusNoContent {
+					assert.ErrorIs(t, err, os.ErrNotExist, path)
+				} else {
+					assert.NoError(t, err, path)
+				}
+			}
+		})
+	}
+}
+
+// A body that panics once it has been read up to limit bytes
+type panickingReader struct {
+	io.Reader
+	read  int
+	limit int
+}
+
+func (p *panickingReader) Read(b []byte) (int, error) {
+	if p.read >= p.limit {
+		panic("injected reader panic")
+	}
+	n, err := p.Reader.Read(b[:min(len(b), p.limit-p.read)])
+	p.read += n
+	return n, err
+}
+
+func TestUploadPanicCleansUp(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("original"), FILE_PERM)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", io.NopCloser(&panickingReader{Reader: newTar(), limit: 1024}))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+		assert.ErrorContains(t, err.(caddyhttp.HandlerError).Err, "injected reader panic")
+	}
+
+	data, err := os.ReadFile(wfs.Root + "/site/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadPanicRollsBack(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("original"), FILE_PERM)
+
+	// The target is already moved to its backup when the swap panics
+	original := rename
+	rename = func(oldpath string, newpath string) error {
+		if strings.HasSuffix(oldpath, "-tmp/") {
+			panic("injected swap panic")
+		}
+		return original(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = original })
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+	}
+
+	data, err := os.ReadFile(wfs.Root + "/site/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// The lock is released
+	rename = original
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt")
+}
+
+func TestUploadAbortedFileCleansUp(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+
+	// The client goes away in the middle of the body
+	body := io.MultiReader(io.LimitReader(newFile(), 10), iotest.ErrReader(errors.New("connection reset")))
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", body)
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+	}
+
+	data, _ := os.ReadFile(wfs.Root + "/test.txt")
+	assert.Equal(t, "original", string(data))
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadAbortedDirectoryCleansUp(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	body := io.MultiReader(io.LimitReader(newTar(), 1024), iotest.ErrReader(errors.New("connection reset")))
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", body)
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.Error(t, err)
+
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadPartialTempPathIsKept(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(getTempPath("partial", wfs.Root+"/test.txt"), []byte("partial"), FILE_PERM)
+
+	// Requests would get a fresh id, a deploy reusing this one leaves the partial file alone
+	err := wfs.Deploy("partial", "/test.txt", newFile(), "", false)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.StatusCode)
+	}
+
+	data, errRead := os.ReadFile(getTempPath("partial", wfs.Root+"/test.txt"))
+	assert.NoError(t, errRead)
+	assert.Equal(t, "partial", string(data))
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+}
+
+func TestUploadCollidingArtifacts(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+
+	// Leftovers of a crashed deploy with the same id
+	ids := []string{"collision-1", "collision-2", "fresh-id-00"}
+	original := newId
+	newId = func() string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	t.Cleanup(func() { newId = original })
+	os.WriteFile(getTempPath("collision-1", wfs.Root+"/test.txt"), []byte("stale temp"), FILE_PERM)
+	os.WriteFile(getBackupPath("collision-2", wfs.Root+"/test.txt"), []byte("stale backup"), FILE_PERM)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "fresh-id-00", w.Header().Get("X-Deploy-Id"))
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi. What are you doing here?\n", string(data))
+
+	// The leftovers are untouched
+	data, err = os.ReadFile(getTempPath("collision-1", wfs.Root+"/test.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stale temp", string(data))
+	data, err = os.ReadFile(getBackupPath("collision-2", wfs.Root+"/test.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stale backup", string(data))
+}
+
+func TestUploadCollidingArtifactsRetries(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	original := newId
+	newId = func() string { return "always-used" }
+	t.Cleanup(func() { newId = original })
+	os.WriteFile(getTempPath("always-used", wfs.Root+"/test.txt"), []byte("stale temp"), FILE_PERM)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+}
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                              Programmatic Deploy                             ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestDeployFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	err := wfs.Deploy(GetId(), "/docs/test.txt", newFile(), "", false)
+	assert.Nil(t, err)
+
+	data, errRead := os.ReadFile(wfs.Root + "/docs/test.txt")
+	assert.NoError(t, errRead)
+	assert.Equal(t, "Hi. What are you doing here?\n", string(data))
+
+	// A second deploy replaces the file
+	err = wfs.Deploy(GetId(), "docs/test.txt", strings.NewReader("replaced"), "", false)
+	assert.Nil(t, err)
+	data, _ = os.ReadFile(wfs.Root + "/docs/test.txt")
+	assert.Equal(t, "replaced", string(data))
+
+	entries, _ := os.ReadDir(wfs.Root + "/docs")
+	assert.Len(t, entries, 1)
+}
+
+func TestDeployDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/stale", DIR_PERM)
+
+	err := wfs.Deploy(GetId(), "/site", newTar(), "application/x-tar", true)
+	assert.Nil(t, err)
+
+	assertDirectoryExist(t, wfs.Root+"/site/tested/no-file/")
+	assertFileExist(t, wfs.Root+"/site/tested/with-file/deep.txt")
+	assert.NoDirExists(t, wfs.Root+"/site/stale")
+
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestDeployErrors(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxSizeMB = 1
+	os.WriteFile(wfs.Root+"/file", []byte("file"), FILE_PERM)
+
+	err := wfs.Deploy(GetId(), "/file", newTar(), "application/x-tar", true)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusConflict, err.StatusCode)
+	}
+
+	err = wfs.Deploy(GetId(), "/site", strings.NewReader("not an archive"), "application/x-tar", true)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.StatusCode)
+	}
+
+	err = wfs.Deploy(GetId(), "/large.txt", bytes.NewReader(make([]byte, 2<<20)), "", false)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, err.StatusCode)
+	}
+
+	err = wfs.Deploy(GetId(), "/", newFile(), "", false)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusConflict, err.StatusCode)
+	}
+
+	// Paths cannot escape the root
+	err = wfs.Deploy(GetId(), "../escaped.txt", newFile(), "", false)
+	assert.Nil(t, err)
+	assertFileExist(t, wfs.Root+"/escaped.txt")
+
+	// Nothing is left behind by the failed deploys
+	entries, _ := os.ReadDir(wfs.Root)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{"file", "escaped.txt"}, names)
+}
@@ -0,0 +1,407 @@
+package caddy_writable_file_server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Content type of the PUT requests applying a batch of operations to a directory
+const MANIFEST_CONTENT_TYPE = "application/deploy-manifest+json"
+
+// Operations of a manifest
+const (
+	MANIFEST_OP_PUT    = "put"
+	MANIFEST_OP_DELETE = "delete"
+	MANIFEST_OP_MOVE   = "move"
+	MANIFEST_OP_COPY   = "copy"
+)
+
+// Body of manifest requests
+type manifest struct {
+	Operations []manifestOperation `json:"operations"`
+}
+
+// An operation of a manifest. Paths are relative to the target of the request.
+type manifestOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Where `move` and `copy` put path
+	Destination string `json:"destination,omitempty"`
+	// The base64 content written by `put`
+	Content string `json:"content,omitempty"`
+}
+
+// Outcome of an operation of a manifest
+type manifestResult struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// Body of the responses of manifest requests
+type manifestResponse struct {
+	Results []manifestResult `json:"results"`
+}
+
+// Return true if the body of r is a manifest
+func isManifest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == MANIFEST_CONTENT_TYPE
+}
+
+// Apply the operations of the manifest in the body of r to the directory target, all or
+// nothing: they are applied in order to a copy of target which is then swapped with it.
+// On success the response is a 207 Multi-Status listing the status of each operation,
+// written here. The first failing operation fails the request. Like uploads, the result
+// is owned by FileOwner and must hold RequireFiles.
+func (wfs *WritableFileServer) HandleManifest(id string, root string, target string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if !strings.HasSuffix(target, "/") {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("manifest sent to the file %s", target),
+			"manifests can only be applied to directories",
+		}
+	}
+
+	var m manifest
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&m); err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("invalid manifest: %w", err),
+				"invalid manifest: malformed JSON",
+			}
+		}
+	}
+	if len(m.Operations) == 0 {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			errors.New("manifest without operations"),
+			"invalid manifest: no operations",
+		}
+	}
+
+	// Check the state of the target
+	target = filepath.Clean(target)
+	info, err := os.Stat(target)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return 0, errFileParent(root, target, err)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+	exists := err == nil
+	if exists && !info.IsDir() {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to apply a manifest to the file %s", target),
+			"target is a file: cannot apply a manifest to it",
+		}
+	}
+
+	if errPrecondition := checkPreconditions(r, exists); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+	if errPrecondition := checkUnmodifiedSince(r, info); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+	if errOverwrite := checkOverwrite(r, exists); errOverwrite != nil {
+		if exists {
+			errOverwrite.Public = "target already exists"
+		}
+		return 0, errOverwrite
+	}
+
+	// The operations are applied to a copy of target
+	staging := wfs.tempPath(id, root, target)
+	if err := os.MkdirAll(staging, wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create staging directory %s: %w", staging, err),
+			"",
+		}
+	}
+	if exists {
+		if err := copyTree(target, staging, wfs.reservedPaths(root)...); err != nil {
+			os.RemoveAll(staging)
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to copy %s to %s: %w", target, staging, err),
+				"",
+			}
+		}
+	}
+
+	results := make([]manifestResult, 0, len(m.Operations))
+	for i, op := range m.Operations {
+		status, errOp := wfs.applyOperation(root, target, staging, op)
+		if errOp != nil {
+			os.RemoveAll(staging)
+			public := errOp.Public
+			if public == "" {
+				public = http.StatusText(errOp.StatusCode)
+			}
+			errOp.Private = fmt.Errorf("operation %d (%s %s) failed: %w", i+1, op.Op, op.Path, errOp.Private)
+			errOp.Public = fmt.Sprintf("operation %d (%s %s) failed: %s", i+1, op.Op, op.Path, public)
+			return 0, errOp
+		}
+		results = append(results, manifestResult{op.Op, op.Path, status})
+	}
+
+	// Moves and copies can take a symlink where it climbs out of the root
+	if errLinks := checkRelocatedSymlinks(root, staging, target, true); errLinks != nil {
+		os.RemoveAll(staging)
+		return 0, errLinks
+	}
+
+	if err := wfs.chownTree(staging); err != nil {
+		os.RemoveAll(staging)
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to change the owner of %s: %w", staging, err),
+			"",
+		}
+	}
+	if errRequired := wfs.checkRequiredFiles(staging); errRequired != nil {
+		os.RemoveAll(staging)
+		return 0, errRequired
+	}
+
+	replaced := ""
+	if exists {
+		replaced = target
+	}
+	if errQuota := wfs.checkQuota(id, root, replaced, staging); errQuota != nil {
+		os.RemoveAll(staging)
+		return 0, errQuota
+	}
+
+	// We backup target if it already exist
+	backup := wfs.backupPath(id, root, target)
+	if exists {
+		if err := rename(target, backup); err != nil {
+			os.RemoveAll(staging)
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to backup target directory %s: %w", target, err),
+				"",
+			}
+		}
+	}
+
+	// Swap target with the staging directory using atomic `Rename`
+	if err := rename(staging, target); err != nil {
+		os.RemoveAll(staging)
+		err = fmt.Errorf("failed to swap staging directory (%s) with target (%s): %w", staging, target, err)
+		if errRollback := rollback(backup, target); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	// The directories of the handler outlast the versions of the root, if they cannot
+	// be moved the backup still holds them
+	keepBackup := false
+	if exists && filepath.Clean(target) == filepath.Clean(root) {
+		if err := wfs.carryOverReserved(root, backup); err != nil {
+			wfs.logger.Log(zapcore.ErrorLevel, "failed to carry over the directories of the handler", zap.String("backup", backup), zap.Error(err))
+			keepBackup = true
+		}
+	}
+	if exists {
+		if keepBackup {
+			wfs.logger.Log(zapcore.WarnLevel, "backup kept after manifest", zap.String("backup", backup))
+		} else if wfs.KeepBackups > 0 {
+			if err := wfs.retainBackup(root, backup, target); err != nil {
+				wfs.logger.Log(zapcore.WarnLevel, "failed to retain backup", zap.String("backup", backup), zap.Error(err))
+			}
+		} else if err := os.RemoveAll(backup); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after manifest", zap.String("backup", backup), zap.Error(err))
+		}
+	} else {
+		w.Header().Set("Location", r.URL.Path)
+	}
+
+	setLastModified(w, target)
+	writeJSON(w, http.StatusMultiStatus, manifestResponse{results})
+	return http.StatusMultiStatus, nil
+}
+
+// Apply op to staging, the copy of target. Return 201 Created if op created its path
+// or destination and 204 No Content otherwise.
+func (wfs *WritableFileServer) applyOperation(root string, target string, staging string, op manifestOperation) (int, *ErrorDeployement) {
+	path, errPath := wfs.manifestPath(root, target, staging, op.Path)
+	if errPath != nil {
+		return 0, errPath
+	}
+
+	switch op.Op {
+	case MANIFEST_OP_PUT:
+		content, err := base64.StdEncoding.DecodeString(op.Content)
+		if err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusBadRequest,
+				fmt.Errorf("invalid content: %w", err),
+				"invalid manifest: content must be base64",
+			}
+		}
+		if errExtension := wfs.checkExtension(path); errExtension != nil {
+			return 0, errExtension
+		}
+		status, errReplace := replacePath(path)
+		if errReplace != nil {
+			return 0, errReplace
+		}
+		if err := os.MkdirAll(filepath.Dir(path), wfs.dirPerm); err != nil {
+			return 0, errManifestWrite(path, err)
+		}
+		if err := os.WriteFile(path, content, wfs.filePerm); err != nil {
+			return 0, errManifestWrite(path, err)
+		}
+		return status, nil
+
+	case MANIFEST_OP_DELETE:
+		if _, err := os.Lstat(path); err != nil {
+			return 0, errManifestSource(path, err)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return 0, errManifestWrite(path, err)
+		}
+		return http.StatusNoContent, nil
+
+	case MANIFEST_OP_MOVE, MANIFEST_OP_COPY:
+		dest, errDest := wfs.manifestPath(root, target, staging, op.Destination)
+		if errDest != nil {
+			return 0, errDest
+		}
+		if _, err := os.Lstat(path); err != nil {
+			return 0, errManifestSource(path, err)
+		}
+		if path == dest || isWithin(path, dest) || isWithin(dest, path) {
+			return 0, &ErrorDeployement{
+				http.StatusConflict,
+				fmt.Errorf("source %s and destination %s overlap", path, dest),
+				"source and destination overlap",
+			}
+		}
+		if errExtension := wfs.checkExtension(dest); errExtension != nil {
+			return 0, errExtension
+		}
+		status, errReplace := replacePath(dest)
+		if errReplace != nil {
+			return 0, errReplace
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), wfs.dirPerm); err != nil {
+			return 0, errManifestWrite(dest, err)
+		}
+		if op.Op == MANIFEST_OP_MOVE {
+			if err := rename(path, dest); err != nil {
+				return 0, errManifestWrite(dest, err)
+			}
+		} else if err := copyTree(path, dest); err != nil {
+			return 0, errManifestWrite(dest, err)
+		}
+		return status, nil
+
+	default:
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("unknown operation: %s", op.Op),
+			"invalid manifest: op must be 'put', 'delete', 'move' or 'copy'",
+		}
+	}
+}
+
+// Return the path in staging of name, a path of a manifest relative to target. It must
+// not leave target, go through a symlink or be refused by the options limiting writes.
+func (wfs *WritableFileServer) manifestPath(root string, target string, staging string, name string) (string, *ErrorDeployement) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) || filepath.Clean(name) == "." || hasControl(name) {
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid manifest path: %q", name),
+			"invalid manifest: paths must be relative to the target",
+		}
+	}
+
+	live := filepath.Join(target, filepath.FromSlash(name))
+	if errReserved := wfs.checkNotReserved(root, live); errReserved != nil {
+		return "", errReserved
+	}
+	if errProtected := wfs.checkNotProtected(root, live); errProtected != nil {
+		return "", errProtected
+	}
+	if errDepth := wfs.checkPathDepth(root, live); errDepth != nil {
+		return "", errDepth
+	}
+
+	path := filepath.Join(staging, filepath.FromSlash(name))
+	parent, err := symlinkParent(staging, path)
+	if err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to check parents of %s: %w", path, err),
+			"",
+		}
+	}
+	if parent != "" {
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("security error: %s is inside the symlink %s", path, parent),
+			"invalid manifest: a path is inside a symlink",
+		}
+	}
+	return path, nil
+}
+
+// Remove what is at path before it is written. Return 201 Created if there was nothing
+// and 204 No Content otherwise.
+func replacePath(path string) (int, *ErrorDeployement) {
+	if _, err := os.Lstat(path); err != nil {
+		return http.StatusCreated, nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return 0, errManifestWrite(path, err)
+	}
+	return http.StatusNoContent, nil
+}
+
+// Return the error of an operation whose source cannot be found
+func errManifestSource(path string, err error) *ErrorDeployement {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return &ErrorDeployement{http.StatusNotFound, fmt.Errorf("%s does not exist: %w", path, err), "Not Found."}
+	}
+	return &ErrorDeployement{http.StatusInternalServerError, fmt.Errorf("could not stat %s: %w", path, err), ""}
+}
+
+// Return the error of an operation failing to write path
+func errManifestWrite(path string, err error) *ErrorDeployement {
+	if errors.Is(err, syscall.ENOTDIR) {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("failed to write %s: %w", path, err),
+			"a parent of the path is a file",
+		}
+	}
+	return &ErrorDeployement{http.StatusInternalServerError, fmt.Errorf("failed to write %s: %w", path, err), ""}
+}
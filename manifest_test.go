@@ -0,0 +1,205 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a manifest to path
+func putManifest(wfs *WritableFileServer, path string, body string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path, strings.NewReader(body))
+	r.Header.Add("Content-Type", MANIFEST_CONTENT_TYPE)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+// Create a site with a.txt, b.txt and c.txt
+func newManifestSite(t *testing.T, wfs *WritableFileServer) {
+	assert.NoError(t, os.MkdirAll(wfs.Root+"/site", 0755))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		assert.NoError(t, os.WriteFile(wfs.Root+"/site/"+name, []byte(name), 0644))
+	}
+}
+
+func TestManifest(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	newManifestSite(t, wfs)
+
+	content := base64.StdEncoding.EncodeToString([]byte("new"))
+	w, err := putManifest(wfs, "/site/", `{"operations": [
+		{"op": "put", "path": "new/d.txt", "content": "`+content+`"},
+		{"op": "put", "path": "a.txt", "content": "`+content+`"},
+		{"op": "delete", "path": "b.txt"},
+		{"op": "move", "path": "c.txt", "destination": "moved/c.txt"},
+		{"op": "copy", "path": "new", "destination": "copied"}
+	]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var response manifestResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []manifestResult{
+		{"put", "new/d.txt", http.StatusCreated},
+		{"put", "a.txt", http.StatusNoContent},
+		{"delete", "b.txt", http.StatusNoContent},
+		{"move", "c.txt", http.StatusCreated},
+		{"copy", "new", http.StatusCreated},
+	}, response.Results)
+
+	data, err := os.ReadFile(wfs.Root + "/site/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	assertFileExist(t, wfs.Root+"/site/new/d.txt")
+	assertFileExist(t, wfs.Root+"/site/copied/d.txt")
+	assertFileExist(t, wfs.Root+"/site/moved/c.txt")
+	assert.NoFileExists(t, wfs.Root+"/site/b.txt")
+	assert.NoFileExists(t, wfs.Root+"/site/c.txt")
+
+	// No staging or backup directory is left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestManifestRollback(t *testing.T) {
+	var tests = map[string]struct {
+		operation string
+		status    int
+	}{
+		"missing source":  {`{"op": "delete", "path": "missing.txt"}`, http.StatusNotFound},
+		"outside":         {`{"op": "delete", "path": "../other"}`, http.StatusBadRequest},
+		"unknown op":      {`{"op": "chmod", "path": "a.txt"}`, http.StatusBadRequest},
+		"invalid content": {`{"op": "put", "path": "a.txt", "content": "not base64!"}`, http.StatusBadRequest},
+		"overlap":         {`{"op": "copy", "path": "new", "destination": "new/sub"}`, http.StatusConflict},
+		"file parent":     {`{"op": "put", "path": "a.txt/d.txt", "content": ""}`, http.StatusConflict},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			newManifestSite(t, wfs)
+
+			w, err := putManifest(wfs, "/site/", `{"operations": [
+				{"op": "put", "path": "new/d.txt", "content": ""},
+				{"op": "delete", "path": "b.txt"},
+				`+test.operation+`
+			]}`)
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assert.True(t, strings.HasPrefix(w.Body.String(), "operation 3 "), w.Body.String())
+
+			// None of the operations is applied
+			assertFileExist(t, wfs.Root+"/site/b.txt")
+			assert.NoDirExists(t, wfs.Root+"/site/new")
+			entries, err := os.ReadDir(wfs.Root)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestManifestInvalid(t *testing.T) {
+	var tests = map[string]struct {
+		path string
+		body string
+	}{
+		"file target":   {"/site/a.txt", `{"operations": [{"op": "delete", "path": "a.txt"}]}`},
+		"malformed":     {"/site/", `{"operations": [`},
+		"unknown field": {"/site/", `{"operations": [], "atomic": false}`},
+		"empty":         {"/site/", `{"operations": []}`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			newManifestSite(t, wfs)
+
+			_, err := putManifest(wfs, test.path, test.body)
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+			assertFileExist(t, wfs.Root+"/site/a.txt")
+		})
+	}
+}
+
+func TestManifestReplayed(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	newManifestSite(t, wfs)
+
+	bodies := []string{}
+	for range 2 {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", strings.NewReader(`{"operations": [{"op": "delete", "path": "a.txt"}]}`))
+		r.Header.Set("Content-Type", MANIFEST_CONTENT_TYPE)
+		r.Header.Set("Idempotency-Key", "manifest-replayed")
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+		assert.Equal(t, http.StatusMultiStatus, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		bodies = append(bodies, w.Body.String())
+	}
+
+	// The retry gets the results of the operations back
+	assert.Contains(t, bodies[0], `"status":204`)
+	assert.Equal(t, bodies[0], bodies[1])
+
+	entries := readAudit(t, wfs.AuditLog)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, http.StatusMultiStatus, entries[0].Status)
+	}
+}
+
+func TestManifestChecks(t *testing.T) {
+	var tests = map[string]struct {
+		requireFiles []string
+		header       string
+		value        string
+		status       int
+	}{
+		"required file removed": {[]string{"a.txt"}, "", "", http.StatusUnprocessableEntity},
+		"modified since":        {nil, "If-Unmodified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusPreconditionFailed},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.RequireFiles = test.requireFiles
+			newManifestSite(t, wfs)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", strings.NewReader(`{"operations": [{"op": "delete", "path": "a.txt"}]}`))
+			r.Header.Set("Content-Type", MANIFEST_CONTENT_TYPE)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+
+			err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assertFileExist(t, wfs.Root+"/site/a.txt")
+		})
+	}
+}
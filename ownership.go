@@ -0,0 +1,75 @@
+package caddy_writable_file_server
+
+import (
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// Change the owner of a path without following symlinks. It is a variable so that tests
+// can observe the calls without privileges.
+var chown = os.Lchown
+
+// Return the uid of owner, a user name or number, or -1 to keep the owner unchanged
+func lookupUid(owner string) (int, error) {
+	if owner == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// Return the gid of group, a group name or number, or -1 to keep the group unchanged
+func lookupGid(group string) (int, error) {
+	if group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Return false if the process is sure to fail to give files to uid and gid: without
+// root, it can only give them to its own user and to one of its groups. Capabilities
+// like CAP_CHOWN are not detected.
+func canChown(uid int, gid int) bool {
+	euid := os.Geteuid()
+	if euid == 0 {
+		return true
+	}
+	if uid != -1 && uid != euid {
+		return false
+	}
+	if gid == -1 || gid == os.Getegid() {
+		return true
+	}
+	groups, _ := os.Getgroups()
+	return slices.Contains(groups, gid)
+}
+
+// Give path, and everything under it, to FileOwner and FileGroup
+func (wfs *WritableFileServer) chownTree(path string) error {
+	if wfs.uid == -1 && wfs.gid == -1 {
+		return nil
+	}
+	return filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return chown(p, wfs.uid, wfs.gid)
+	})
+}
@@ -0,0 +1,150 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// An owner change recorded instead of applied
+type chownCall struct {
+	name string
+	uid  int
+	gid  int
+}
+
+// Record the owner changes instead of applying them, which needs privileges
+func recordChown(t *testing.T) *[]chownCall {
+	calls := &[]chownCall{}
+	original := chown
+	chown = func(name string, uid int, gid int) error {
+		*calls = append(*calls, chownCall{name, uid, gid})
+		return nil
+	}
+	t.Cleanup(func() { chown = original })
+	return calls
+}
+
+func TestFileOwnerDirectory(t *testing.T) {
+	calls := recordChown(t)
+	wfs := newTestWritableFileServer(t)
+	wfs.FileOwner = "1234"
+	wfs.FileGroup = "5678"
+	provisionTestWritableFileServer(t, wfs)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	// Every path of the tree was given away before the swap, starting with its root
+	if !assert.NotEmpty(t, *calls) {
+		return
+	}
+	temp := (*calls)[0].name
+	owned := []string{}
+	for _, call := range *calls {
+		assert.Equal(t, 1234, call.uid)
+		assert.Equal(t, 5678, call.gid)
+		rel, err := filepath.Rel(temp, call.name)
+		assert.NoError(t, err)
+		owned = append(owned, rel)
+	}
+	live := []string{}
+	filepath.WalkDir(wfs.Root+"/site", func(path string, _ os.DirEntry, _ error) error {
+		rel, _ := filepath.Rel(wfs.Root+"/site", path)
+		live = append(live, rel)
+		return nil
+	})
+	assert.ElementsMatch(t, live, owned)
+}
+
+func TestFileOwnerFile(t *testing.T) {
+	calls := recordChown(t)
+	wfs := newTestWritableFileServer(t)
+	wfs.FileGroup = "5678"
+	wfs.PrecompressGzip = true
+	provisionTestWritableFileServer(t, wfs)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/index.html", strings.NewReader("<html>"))
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	// The file and its compressed copy, only the group changes
+	if assert.Len(t, *calls, 2) {
+		for _, call := range *calls {
+			assert.Equal(t, -1, call.uid)
+			assert.Equal(t, 5678, call.gid)
+		}
+		assert.True(t, strings.HasPrefix(filepath.Base((*calls)[1].name), "index.html.gz-"))
+	}
+}
+
+func TestFileOwnerFailure(t *testing.T) {
+	original := chown
+	chown = func(name string, uid int, gid int) error {
+		return &os.PathError{Op: "lchown", Path: name, Err: os.ErrPermission}
+	}
+	t.Cleanup(func() { chown = original })
+
+	wfs := newTestWritableFileServer(t)
+	wfs.FileOwner = "1234"
+	provisionTestWritableFileServer(t, wfs)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+	}
+
+	data, _ := os.ReadFile(wfs.Root + "/test.txt")
+	assert.Equal(t, "original", string(data))
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestLookupOwner(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("no current user:", err)
+	}
+
+	uid, err := lookupUid(current.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, current.Uid, strconv.Itoa(uid))
+
+	uid, err = lookupUid("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, 1234, uid)
+
+	uid, err = lookupUid("")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, uid)
+
+	_, err = lookupUid("no-such-user-here")
+	assert.Error(t, err)
+	_, err = lookupGid("no-such-group-here")
+	assert.Error(t, err)
+}
+
+func TestValidateInvalidFileOwner(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.FileOwner = "no-such-user-here"
+	assert.ErrorContains(t, wfs.Validate(), "file_owner")
+
+	wfs = newTestWritableFileServer(t)
+	wfs.FileGroup = "no-such-group-here"
+	assert.ErrorContains(t, wfs.Validate(), "file_group")
+}
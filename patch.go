@@ -0,0 +1,173 @@
+package caddy_writable_file_server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const PATCH_MODE_APPEND = "append"
+
+// Append the request body to the existing file target. The result is prepared in a
+// temporary location and then swapped atomically with target. On success it returns
+// 204 No Content.
+func (wfs *WritableFileServer) HandlePatch(id string, root string, target string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	// We make sure tu close the body if it is not empty
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if mode := r.Header.Get("X-Patch-Mode"); mode != PATCH_MODE_APPEND {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid patch mode: %s", mode),
+			"invalid X-Patch-Mode header: must be 'append'",
+		}
+	}
+
+	if strings.HasSuffix(target, "/") {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("trying to append to the directory %s", target),
+			"cannot append to a directory",
+		}
+	}
+
+	// Check the state of the target
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to append to a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+	if info.IsDir() {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to append to the directory %s", target),
+			"target is a directory: cannot append to it",
+		}
+	}
+
+	var body io.Reader = http.NoBody
+	if r.Body != nil {
+		body = r.Body
+	}
+
+	// We prepare the existing content followed by the body in a temporary location
+	targetTemp := wfs.tempPath(id, root, target)
+	etag, errAppend := wfs.appendFile(target, targetTemp, info.Mode().Perm(), body)
+	if errAppend != nil {
+		os.RemoveAll(targetTemp)
+		return 0, errAppend
+	}
+	if errQuota := wfs.checkQuota(id, root, target, targetTemp); errQuota != nil {
+		os.RemoveAll(targetTemp)
+		return 0, errQuota
+	}
+
+	// We backup target before the swap
+	targetBackup := wfs.backupPath(id, root, target)
+	if err := rename(target, targetBackup); err != nil {
+		os.RemoveAll(targetTemp)
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to backup target %s: %w", target, err),
+			"",
+		}
+	}
+
+	// Swap target with the appended copy using atomic `Rename`
+	if err := rename(targetTemp, target); err != nil {
+		os.RemoveAll(targetTemp)
+		err = fmt.Errorf("failed to swap temporary file (%s) with target (%s): %w", targetTemp, target, err)
+		if errRollback := rollback(targetBackup, target); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	// The rename itself is only durable once the parent directory is synced
+	if wfs.Fsync {
+		if err := syncDirectory(filepath.Dir(target)); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to sync parent directory after append", zap.String("target", target), zap.Error(err))
+		}
+	}
+
+	if err := os.RemoveAll(targetBackup); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after append", zap.String("backup", targetBackup), zap.Error(err))
+	}
+
+	w.Header().Set("ETag", etag)
+	setLastModified(w, target)
+	return http.StatusNoContent, nil
+}
+
+// Write the content of src followed by reader into the new file dst. Return the ETag
+// of the resulting content.
+func (wfs *WritableFileServer) appendFile(src string, dst string, perm os.FileMode, reader io.Reader) (string, *ErrorDeployement) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to open target file '%s' for append: %w", src, err),
+			"",
+		}
+	}
+	defer in.Close()
+
+	out, err := openFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to open temporary file '%s' for append: %w", dst, err),
+			"",
+		}
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	writer := io.MultiWriter(out, hash)
+	if _, err := io.Copy(writer, in); err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to copy target file '%s' for append: %w", src, err),
+			"",
+		}
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to append data to file '%s': %w", dst, err),
+			"",
+		}
+	}
+
+	if wfs.Fsync {
+		if err := out.Sync(); err != nil {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to sync file '%s' after append: %w", dst, err),
+				"",
+			}
+		}
+	}
+
+	return formatETag(hash.Sum(nil)), nil
+}
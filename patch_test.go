@@ -0,0 +1,122 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/log.txt", []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PATCH", "/log.txt", bytes.NewBufferString("second\n"))
+	r.Header.Add("X-Patch-Mode", "append")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/log.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	sha := sha256.Sum256(data)
+	assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, w.Header().Get("ETag"))
+
+	// The mode of the file is kept and nothing is left next to it
+	info, err := os.Stat(wfs.Root + "/log.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestAppendFileMissing(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PATCH", "/log.txt", bytes.NewBufferString("second\n"))
+	r.Header.Add("X-Patch-Mode", "append")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestAppendDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.Mkdir(wfs.Root+"/logs", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PATCH", "/logs", bytes.NewBufferString("second\n"))
+	r.Header.Add("X-Patch-Mode", "append")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+}
+
+func TestPatchInvalidMode(t *testing.T) {
+	var tests = []string{"", "prepend"}
+
+	for _, mode := range tests {
+		t.Run(mode, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			if err := os.WriteFile(wfs.Root+"/log.txt", []byte("first\n"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PATCH", "/log.txt", bytes.NewBufferString("second\n"))
+			if mode != "" {
+				r.Header.Add("X-Patch-Mode", mode)
+			}
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+
+			data, err := os.ReadFile(wfs.Root + "/log.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "first\n", string(data))
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package caddy_writable_file_server
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Media types precompressed when PrecompressTypes is not set
+var defaultPrecompressTypes = []string{"text/html", "text/css", "text/javascript", "application/json"}
+
+// A compressed sibling written next to the files of a deploy, like `index.html.gz`
+type precompressor struct {
+	extension string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+// Return the precompressors enabled by the options
+func (wfs *WritableFileServer) precompressors() []precompressor {
+	precompressors := []precompressor{}
+	if wfs.PrecompressGzip {
+		precompressors = append(precompressors, precompressor{".gz", func(w io.Writer) io.WriteCloser {
+			writer, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return writer
+		}})
+	}
+	if wfs.PrecompressBrotli {
+		precompressors = append(precompressors, precompressor{".br", func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, wfs.BrotliQuality)
+		}})
+	}
+	return precompressors
+}
+
+// Return true if the file name has one of the media types of PrecompressTypes
+func (wfs *WritableFileServer) shouldPrecompress(name string) bool {
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	if err != nil {
+		return false
+	}
+	types := wfs.PrecompressTypes
+	if len(types) == 0 {
+		types = defaultPrecompressTypes
+	}
+	return slices.Contains(types, mediaType)
+}
+
+// Write the compressed siblings of the files of dir matching PrecompressTypes. The
+// siblings already present, uploaded by the client, are kept.
+func (wfs *WritableFileServer) precompressTree(dir string) error {
+	precompressors := wfs.precompressors()
+	if len(precompressors) == 0 {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || !wfs.shouldPrecompress(path) {
+			return err
+		}
+		for _, p := range precompressors {
+			if _, err := os.Lstat(path + p.extension); err == nil {
+				continue
+			}
+			if err := precompressFile(path, path+p.extension, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compress the file src into the new file dst, with the same permissions and
+// modification time so that both are served alike
+func precompressFile(src string, dst string, p precompressor) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	writer := p.newWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Replace the compressed siblings of target, a file uploaded alone. They are swapped
+// one by one after target, so a client may briefly get the previous version of one.
+func (wfs *WritableFileServer) precompressSiblings(id string, root string, target string) error {
+	if !wfs.shouldPrecompress(target) {
+		return nil
+	}
+	for _, p := range wfs.precompressors() {
+		temp := wfs.tempPath(id, root, target+p.extension)
+		if err := precompressFile(target, temp, p); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		if err := wfs.chownTree(temp); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		if err := rename(temp, target+p.extension); err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return the decompressed content of the gzip file at path
+func readGzip(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestPrecompressGzipDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PrecompressGzip = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html>"},
+		tarEntry{&tar.Header{Name: "css/style.css", Typeflag: tar.TypeReg, Mode: 0644}, "body {}"},
+		tarEntry{&tar.Header{Name: "app.js", Typeflag: tar.TypeReg, Mode: 0644}, "alert()"},
+		tarEntry{&tar.Header{Name: "data.json", Typeflag: tar.TypeReg, Mode: 0644}, "{}"},
+		tarEntry{&tar.Header{Name: "logo.png", Typeflag: tar.TypeReg, Mode: 0644}, "png"},
+		tarEntry{&tar.Header{Name: "about.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html>"},
+		tarEntry{&tar.Header{Name: "about.html.gz", Typeflag: tar.TypeReg, Mode: 0644}, "uploaded"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+
+	for path, content := range map[string]string{
+		"index.html":    "<html>",
+		"css/style.css": "body {}",
+		"app.js":        "alert()",
+		"data.json":     "{}",
+	} {
+		assert.Equal(t, content, readGzip(t, wfs.Root+"/site/"+path+".gz"), path)
+	}
+	assert.NoFileExists(t, wfs.Root+"/site/logo.png.gz")
+
+	// The compressed copies of the archive are not replaced
+	data, err := os.ReadFile(wfs.Root + "/site/about.html.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "uploaded", string(data))
+}
+
+func TestPrecompressGzipFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PrecompressGzip = true
+	os.WriteFile(wfs.Root+"/page.html.gz", []byte("stale"), FILE_PERM)
+
+	for path, content := range map[string]string{"/page.html": "<html>", "/image.png": "png"} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", path, strings.NewReader(content))
+		assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	}
+
+	assert.Equal(t, "<html>", readGzip(t, wfs.Root+"/page.html.gz"))
+	assert.NoFileExists(t, wfs.Root+"/image.png.gz")
+}
+
+func TestPrecompressTypes(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	assert.True(t, wfs.shouldPrecompress("index.HTML"))
+	assert.True(t, wfs.shouldPrecompress("app.mjs"))
+	assert.False(t, wfs.shouldPrecompress("logo.svg"))
+	assert.False(t, wfs.shouldPrecompress("README"))
+
+	wfs.PrecompressTypes = []string{"image/svg+xml"}
+	assert.True(t, wfs.shouldPrecompress("logo.svg"))
+	assert.False(t, wfs.shouldPrecompress("index.html"))
+}
+
+func TestPrecompressBrotli(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.PrecompressGzip = true
+	wfs.PrecompressBrotli = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html>"},
+		tarEntry{&tar.Header{Name: "logo.png", Typeflag: tar.TypeReg, Mode: 0644}, "png"},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+
+	file, err := os.Open(wfs.Root + "/site/index.html.br")
+	if assert.NoError(t, err) {
+		defer file.Close()
+		content, err := io.ReadAll(brotli.NewReader(file))
+		assert.NoError(t, err)
+		assert.Equal(t, "<html>", string(content))
+	}
+	assert.Equal(t, "<html>", readGzip(t, wfs.Root+"/site/index.html.gz"))
+	assert.NoFileExists(t, wfs.Root+"/site/logo.png.br")
+}
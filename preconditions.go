@@ -0,0 +1,59 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Evaluate the conditional headers of a request (RFC 9110 section 13) against the
+// current state of its target. Only the `*` wildcard is supported: `If-None-Match: *`
+// requires the target to be missing and `If-Match: *` requires it to exist.
+func checkPreconditions(r *http.Request, exists bool) *ErrorDeployement {
+	if strings.TrimSpace(r.Header.Get("If-Match")) == "*" && !exists {
+		return &ErrorDeployement{
+			http.StatusPreconditionFailed,
+			errors.New("if-match precondition failed: target does not exist"),
+			"Precondition Failed: target does not exist",
+		}
+	}
+
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" && exists {
+		return &ErrorDeployement{
+			http.StatusPreconditionFailed,
+			errors.New("if-none-match precondition failed: target already exists"),
+			"Precondition Failed: target already exists",
+		}
+	}
+
+	return nil
+}
+
+// Evaluate the `If-Unmodified-Since` header against the modification time of the target
+// described by info, nil when it does not exist. It pairs with the Last-Modified header
+// of the responses so that a client does not overwrite changes made since it last saw
+// the target. As required by RFC 9110, it is ignored with `If-Match`, an invalid date
+// or a missing target.
+func checkUnmodifiedSince(r *http.Request, info os.FileInfo) *ErrorDeployement {
+	if info == nil || r.Header.Get("If-Match") != "" {
+		return nil
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	if err != nil {
+		return nil
+	}
+
+	// HTTP dates have a precision of one second
+	modified := info.ModTime().Truncate(time.Second)
+	if modified.After(since) {
+		return &ErrorDeployement{
+			http.StatusPreconditionFailed,
+			fmt.Errorf("if-unmodified-since precondition failed: target modified at %s", modified.UTC().Format(http.TimeFormat)),
+			"Precondition Failed: target was modified since " + since.UTC().Format(http.TimeFormat),
+		}
+	}
+	return nil
+}
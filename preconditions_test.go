@@ -0,0 +1,205 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadFileCreateOnly(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("If-None-Match", "*")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
+
+func TestUploadFileCreateOnlyConflict(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("If-None-Match", "*")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusPreconditionFailed, errHandler.StatusCode)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestUploadFileUpdateOnly(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("If-Match", "*")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestUploadFileUpdateOnlyMissing(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/dir/test.txt", newFile())
+	r.Header.Add("Content-Type", "application/octet-stream")
+	r.Header.Add("If-Match", "*")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusPreconditionFailed, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root)
+}
+
+func TestUploadOverwriteHeader(t *testing.T) {
+	var tests = []struct {
+		overwrite string
+		exists    bool
+		status    int
+	}{
+		{"T", false, http.StatusCreated},
+		{"T", true, http.StatusNoContent},
+		{"F", false, http.StatusCreated},
+		{"F", true, http.StatusPreconditionFailed},
+		{"maybe", false, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		for _, path := range []string{"/test.txt", "/site/"} {
+			wfs := newTestWritableFileServer(t)
+			if test.exists {
+				os.MkdirAll(wfs.Root+"/site", 0755)
+				os.WriteFile(wfs.Root+"/site/original.txt", []byte("original"), FILE_PERM)
+				os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", path, newTar())
+			r.Header.Add("Content-Type", "application/x-tar")
+			r.Header.Add("Overwrite", test.overwrite)
+
+			w := httptest.NewRecorder()
+
+			wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.Equal(t, test.status, w.Code, "%s with Overwrite: %s", path, test.overwrite)
+
+			if test.status == http.StatusPreconditionFailed {
+				assert.Equal(t, "target already exists\n", w.Body.String())
+				data, err := os.ReadFile(wfs.Root + "/test.txt")
+				assert.NoError(t, err)
+				assert.Equal(t, "original", string(data))
+				assertFileExist(t, wfs.Root+"/site/original.txt")
+				assert.NoDirExists(t, wfs.Root+"/site/tested")
+			}
+		}
+	}
+}
+
+func TestUploadFileUnmodifiedSince(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(wfs.Root+"/test.txt", modified, modified)
+
+	// The target was modified after the version the client has
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("If-Unmodified-Since", modified.Add(-time.Minute).Format(http.TimeFormat))
+
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusPreconditionFailed, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	data, _ := os.ReadFile(wfs.Root + "/test.txt")
+	assert.Equal(t, "original", string(data))
+
+	// The client has the current version
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Add("If-Unmodified-Since", modified.Format(http.TimeFormat))
+
+	w := httptest.NewRecorder()
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	data, _ = os.ReadFile(wfs.Root + "/test.txt")
+	assert.Equal(t, "Hi. What are you doing here?\n", string(data))
+
+	// Missing targets have no modification time to compare
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/new.txt", newFile())
+	r.Header.Add("If-Unmodified-Since", modified.Add(-time.Minute).Format(http.TimeFormat))
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+}
+
+func TestDeleteUnmodifiedSince(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(wfs.Root+"/test.txt", modified, modified)
+
+	_, err := deletePath(wfs, "/test.txt", map[string]string{
+		"If-Unmodified-Since": modified.Add(-time.Second).Format(http.TimeFormat),
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusPreconditionFailed, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assertFileExist(t, wfs.Root+"/test.txt")
+
+	// Invalid dates are ignored
+	w, err := deletePath(wfs, "/test.txt", map[string]string{"If-Unmodified-Since": "yesterday"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+	w, err = deletePath(wfs, "/test.txt", map[string]string{
+		"If-Unmodified-Since": time.Now().Add(time.Minute).UTC().Format(http.TimeFormat),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+}
@@ -0,0 +1,153 @@
+package caddy_writable_file_server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// WebDAV method querying the properties of resources (RFC 4918)
+const METHOD_PROPFIND = "PROPFIND"
+
+// Body of PROPFIND responses. The elements are written with the `D:` prefix bound to
+// the `DAV:` namespace, like most WebDAV servers do.
+type multistatus struct {
+	XMLName   xml.Name       `xml:"D:multistatus"`
+	Namespace string         `xml:"xmlns:D,attr"`
+	Responses []propResponse `xml:"D:response"`
+}
+
+type propResponse struct {
+	Href     string   `xml:"D:href"`
+	Propstat propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+type prop struct {
+	ResourceType  resourceType `xml:"D:resourcetype"`
+	ContentLength *int64       `xml:"D:getcontentlength,omitempty"`
+	LastModified  string       `xml:"D:getlastmodified"`
+}
+
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+// Answer a PROPFIND request with a 207 Multi-Status listing the size, modification time
+// and type of target, and of its entries when it is a directory and the `Depth` header
+// is 1. A missing `Depth` is taken as 1 since infinite depths are not supported. The
+// requested properties are ignored, all of them are always returned.
+func (wfs *WritableFileServer) HandlePropfind(target string, w http.ResponseWriter, r *http.Request) *ErrorDeployement {
+	depth := r.Header.Get("Depth")
+	switch {
+	case depth == "" || depth == "0" || depth == "1":
+	case strings.EqualFold(depth, "infinity"):
+		return &ErrorDeployement{
+			http.StatusForbidden,
+			errors.New("propfind with an infinite depth"),
+			"Depth: infinity is not supported, use 0 or 1",
+		}
+	default:
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid depth header: %s", depth),
+			"invalid Depth header: must be '0' or '1'",
+		}
+	}
+
+	// The body only selects properties
+	if r.Body != nil {
+		io.Copy(io.Discard, r.Body)
+	}
+
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to propfind a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+
+	href := r.URL.Path
+	if info.IsDir() && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	body := multistatus{Namespace: "DAV:", Responses: []propResponse{newPropResponse(href, info)}}
+
+	if info.IsDir() && depth != "0" {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to read target directory '%s': %w", target, err),
+				"",
+			}
+		}
+		for _, entry := range entries {
+			entryInfo, err := entry.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue // Removed since ReadDir
+			}
+			if err != nil {
+				return &ErrorDeployement{
+					http.StatusInternalServerError,
+					fmt.Errorf("could not stat entry '%s': %w", entry.Name(), err),
+					"",
+				}
+			}
+			entryHref := path.Join(href, entry.Name())
+			if entryInfo.IsDir() {
+				entryHref += "/"
+			}
+			body.Responses = append(body.Responses, newPropResponse(entryHref, entryInfo))
+		}
+	}
+
+	encoded, err := xml.Marshal(body)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to encode properties of '%s': %w", target, err),
+			"",
+		}
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(encoded)
+	return nil
+}
+
+// Return the properties of the resource at the URL path href
+func newPropResponse(href string, info os.FileInfo) propResponse {
+	p := prop{LastModified: info.ModTime().UTC().Format(http.TimeFormat)}
+	if info.IsDir() {
+		p.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		p.ContentLength = &size
+	}
+	return propResponse{
+		Href:     (&url.URL{Path: href}).EscapedPath(),
+		Propstat: propstat{p, "HTTP/1.1 200 OK"},
+	}
+}
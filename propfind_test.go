@@ -0,0 +1,128 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// The parsed body of a PROPFIND response
+type parsedMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			Collection    *struct{} `xml:"resourcetype>collection"`
+			ContentLength string    `xml:"getcontentlength"`
+			LastModified  string    `xml:"getlastmodified"`
+		} `xml:"propstat>prop"`
+		Status string `xml:"propstat>status"`
+	} `xml:"DAV: response"`
+}
+
+// Send a PROPFIND of path with the given Depth header, none if it is empty
+func propfind(t *testing.T, wfs *WritableFileServer, path string, depth string) (*httptest.ResponseRecorder, parsedMultistatus, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PROPFIND", path, nil)
+	if depth != "" {
+		r.Header.Set("Depth", depth)
+	}
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+
+	body := parsedMultistatus{}
+	if w.Code == http.StatusMultiStatus {
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w, body, err
+}
+
+func newPropfindWritableFileServer(t *testing.T) *WritableFileServer {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	if err := os.MkdirAll(wfs.Root+"/site/docs", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/site/index.html", []byte("content"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	return wfs
+}
+
+func TestPropfindDirectory(t *testing.T) {
+	wfs := newPropfindWritableFileServer(t)
+
+	w, body, err := propfind(t, wfs, "/site", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/xml")
+	assert.Contains(t, w.Body.String(), `<D:multistatus xmlns:D="DAV:">`)
+
+	if assert.Len(t, body.Responses, 3) {
+		site := body.Responses[0]
+		assert.Equal(t, "/site/", site.Href)
+		assert.NotNil(t, site.Prop.Collection)
+		assert.Empty(t, site.Prop.ContentLength)
+		assert.Equal(t, "HTTP/1.1 200 OK", site.Status)
+
+		docs := body.Responses[1]
+		assert.Equal(t, "/site/docs/", docs.Href)
+		assert.NotNil(t, docs.Prop.Collection)
+
+		index := body.Responses[2]
+		assert.Equal(t, "/site/index.html", index.Href)
+		assert.Nil(t, index.Prop.Collection)
+		assert.Equal(t, "7", index.Prop.ContentLength)
+		assert.NotEmpty(t, index.Prop.LastModified)
+	}
+}
+
+func TestPropfindDepth(t *testing.T) {
+	wfs := newPropfindWritableFileServer(t)
+
+	_, body, err := propfind(t, wfs, "/site/", "0")
+	assert.NoError(t, err)
+	assert.Len(t, body.Responses, 1)
+
+	_, body, err = propfind(t, wfs, "/site/", "")
+	assert.NoError(t, err)
+	assert.Len(t, body.Responses, 3)
+
+	_, body, err = propfind(t, wfs, "/site/index.html", "1")
+	assert.NoError(t, err)
+	assert.Len(t, body.Responses, 1)
+
+	var tests = map[string]int{"infinity": http.StatusForbidden, "2": http.StatusBadRequest}
+	for depth, expected := range tests {
+		_, _, err := propfind(t, wfs, "/site/", depth)
+		errHandler, ok := err.(caddyhttp.HandlerError)
+		assert.True(t, ok, depth)
+		assert.Equal(t, expected, errHandler.StatusCode, depth)
+	}
+}
+
+func TestPropfindNotFound(t *testing.T) {
+	wfs := newPropfindWritableFileServer(t)
+
+	_, _, err := propfind(t, wfs, "/missing", "0")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+}
+
+func TestPropfindWithoutRead(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	_, _, err := propfind(t, wfs, "/", "0")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusMethodNotAllowed, errHandler.StatusCode)
+}
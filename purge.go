@@ -0,0 +1,289 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// A path removed by a DELETE with the `glob` query, relative to the target
+type purgeResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// Body of the responses of DELETE requests with the `glob` query
+type purgeResponse struct {
+	Results []purgeResult `json:"results"`
+}
+
+// Delete the entries of the directory target matching the glob pattern of the `glob`
+// query, like `app.*.js`. Patterns with a `/` match deeper entries (`js/*.map`) but
+// never leave target. Non-empty directories are only deleted with the same headers as
+// a regular DELETE. Every match is checked before anything is deleted. On success the
+// response is a 207 Multi-Status listing the deleted paths, written here.
+func (wfs *WritableFileServer) HandleDeleteGlob(id string, root string, target string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	pattern := r.URL.Query().Get("glob")
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid glob query %q: %w", pattern, err),
+			"invalid glob query: must be a glob pattern",
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(pattern)) || strings.Contains(pattern, "\\") {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("glob outside of the target: %s", pattern),
+			"invalid glob query: must be relative to the target",
+		}
+	}
+	recursive, errDepth := isRecursiveDelete(r)
+	if errDepth != nil {
+		return 0, errDepth
+	}
+	soft, errSoft := isSoftDelete(r)
+	if errSoft != nil {
+		return 0, errSoft
+	}
+
+	target = filepath.Clean(target)
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to delete in a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+	if !info.IsDir() {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to delete by glob in the file %s", target),
+			"target is a file: glob deletions apply to directories",
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(target, filepath.FromSlash(pattern)))
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to match %s in %s: %w", pattern, target, err),
+			"",
+		}
+	}
+
+	// Refuse the whole request rather than deleting part of the matches
+	selected := []string{}
+	for _, match := range matches {
+		if !isWithin(target, match) || match == target {
+			continue
+		}
+		// The directories of the handler are never purged
+		if wfs.isReserved(root, match) {
+			continue
+		}
+		if errProtected := wfs.checkNotProtected(root, match); errProtected != nil {
+			return 0, errProtected
+		}
+		if !recursive {
+			if entries, err := os.ReadDir(match); err == nil && len(entries) > 0 {
+				return 0, &ErrorDeployement{
+					http.StatusConflict,
+					fmt.Errorf("trying to delete the non-empty directory %s without recursion", match),
+					"a matching directory is not empty: set 'X-Recursive: true' or 'Depth: infinity' to delete it",
+				}
+			}
+		}
+		selected = append(selected, match)
+	}
+
+	results := []purgeResult{}
+	for _, match := range selected {
+		if soft || wfs.TrashDir != "" {
+			if errTrash := wfs.moveToTrash(root, match); errTrash != nil {
+				return 0, errTrash
+			}
+		} else if err := os.RemoveAll(match); err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to delete %s: %w", match, err),
+				"",
+			}
+		}
+		deployments.forget(match)
+		rel, _ := filepath.Rel(target, match)
+		results = append(results, purgeResult{filepath.ToSlash(rel), http.StatusNoContent})
+	}
+
+	writeJSON(w, http.StatusMultiStatus, purgeResponse{results})
+	return http.StatusMultiStatus, nil
+}
+
+// Delete the entries of the directory target, with the `contents_only=1` query, but not
+// the directory itself. An empty directory with the same permissions is swapped with
+// target so that clients never see it partially emptied. The emptied directory follows
+// the rules of a regular DELETE: with the `soft=1` query or TrashDir it goes to the trash
+// as a deleted version of target. On success it returns 204 No Content.
+func (wfs *WritableFileServer) HandleDeleteContents(id string, root string, target string, r *http.Request) (int, *ErrorDeployement) {
+	if contentsOnly := r.URL.Query().Get("contents_only"); contentsOnly != "1" {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid contents_only query: %s", contentsOnly),
+			"invalid contents_only query: must be '1'",
+		}
+	}
+	recursive, errDepth := isRecursiveDelete(r)
+	if errDepth != nil {
+		return 0, errDepth
+	}
+	soft, errSoft := isSoftDelete(r)
+	if errSoft != nil {
+		return 0, errSoft
+	}
+
+	// The trash and the other directories of the handler live in the root
+	target = filepath.Clean(target)
+	if target == filepath.Clean(root) {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to delete the contents of the root %s", target),
+			"the root cannot be emptied: delete its entries instead",
+		}
+	}
+	for _, reserved := range wfs.reservedPaths(root) {
+		if isWithin(target, reserved) {
+			return 0, &ErrorDeployement{
+				http.StatusConflict,
+				fmt.Errorf("trying to delete the contents of %s holding the reserved directory %s", target, reserved),
+				"the directory holds the trash or another directory of the handler: it cannot be emptied",
+			}
+		}
+	}
+
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to delete the contents of a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+	if !info.IsDir() {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to delete the contents of the file %s", target),
+			"target is a file: only the contents of directories can be deleted",
+		}
+	}
+	if errPrecondition := checkUnmodifiedSince(r, info); errPrecondition != nil {
+		return 0, errPrecondition
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not read target directory: %w", err),
+			"",
+		}
+	}
+	if len(entries) == 0 {
+		return http.StatusNoContent, nil
+	}
+	// Refuse the whole request rather than deleting part of the entries
+	for _, entry := range entries {
+		path := filepath.Join(target, entry.Name())
+		if errProtected := wfs.checkNotProtected(root, path); errProtected != nil {
+			return 0, errProtected
+		}
+		if !recursive && entry.IsDir() {
+			if children, err := os.ReadDir(path); err == nil && len(children) > 0 {
+				return 0, &ErrorDeployement{
+					http.StatusConflict,
+					fmt.Errorf("trying to delete the non-empty directory %s without recursion", path),
+					"a directory is not empty: set 'X-Recursive: true' or 'Depth: infinity' to delete it",
+				}
+			}
+		}
+	}
+
+	temp := wfs.tempPath(id, root, target)
+	if err := os.Mkdir(temp, info.Mode().Perm()); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create empty directory %s: %w", temp, err),
+			"",
+		}
+	}
+	// Mkdir applies the umask of the process
+	if err := errors.Join(os.Chmod(temp, info.Mode().Perm()), wfs.chownTree(temp)); err != nil {
+		os.RemoveAll(temp)
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to prepare empty directory %s: %w", temp, err),
+			"",
+		}
+	}
+
+	backup := wfs.backupPath(id, root, target)
+	if err := rename(target, backup); err != nil {
+		os.RemoveAll(temp)
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to backup target directory %s: %w", target, err),
+			"",
+		}
+	}
+	if err := rename(temp, target); err != nil {
+		os.RemoveAll(temp)
+		err := fmt.Errorf("failed to swap empty directory (%s) with target (%s): %w", temp, target, err)
+		if errRollback := rollback(backup, target); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+	if wfs.Fsync {
+		if err := syncDirectory(filepath.Dir(target)); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to sync parent directory after delete", zap.String("target", target), zap.Error(err))
+		}
+	}
+
+	// A deletion that cannot be restored is not done at all
+	if soft || wfs.TrashDir != "" {
+		if errTrash := wfs.trashAs(root, backup, target); errTrash != nil {
+			if errRollback := rollback(backup, target); errRollback != nil {
+				errTrash.Private = fmt.Errorf("%w AND failed to rollback: %w", errTrash.Private, errRollback)
+			}
+			return 0, errTrash
+		}
+	} else if err := os.RemoveAll(backup); err != nil {
+		// The directory is already empty for clients, the leftovers are only logged
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove contents after delete", zap.String("id", id), zap.String("backup", backup), zap.Error(err))
+	}
+
+	wfs.logger.Log(zapcore.DebugLevel, "target contents deleted", zap.String("id", id), zap.String("target", target), zap.Int("entries", len(entries)))
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,212 @@
+package caddy_writable_file_server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteGlob(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/js", DIR_PERM)
+	for _, name := range []string{"app.js", "app.1a2b.js", "app.3c4d.js", "main.css", "js/app.5e6f.js"} {
+		os.WriteFile(wfs.Root+"/site/"+name, []byte("teeest"), FILE_PERM)
+	}
+
+	w, err := deletePath(wfs, "/site/?glob=app.*.js", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var response purgeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []purgeResult{
+		{"app.1a2b.js", http.StatusNoContent},
+		{"app.3c4d.js", http.StatusNoContent},
+	}, response.Results)
+
+	assert.NoFileExists(t, wfs.Root+"/site/app.1a2b.js")
+	assert.NoFileExists(t, wfs.Root+"/site/app.3c4d.js")
+	assertFileExist(t, wfs.Root+"/site/app.js")
+	assertFileExist(t, wfs.Root+"/site/main.css")
+	assertFileExist(t, wfs.Root+"/site/js/app.5e6f.js")
+
+	// Nothing matching is not an error
+	w, err = deletePath(wfs, "/site/?glob=*.map", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.JSONEq(t, `{"results":[]}`, w.Body.String())
+}
+
+func TestDeleteGlobReplayed(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/app.1a2b.js", []byte("teeest"), FILE_PERM)
+
+	headers := map[string]string{"Idempotency-Key": "glob-replayed"}
+	first, err := deletePath(wfs, "/site/?glob=app.*.js", headers)
+	assert.NoError(t, err)
+	retry, err := deletePath(wfs, "/site/?glob=app.*.js", headers)
+	assert.NoError(t, err)
+
+	// The retry gets the deleted paths back
+	assert.Equal(t, http.StatusMultiStatus, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Contains(t, first.Body.String(), "app.1a2b.js")
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	entries := readAudit(t, wfs.AuditLog)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, http.StatusMultiStatus, entries[0].Status)
+	}
+}
+
+func TestDeleteGlobDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/v1", DIR_PERM)
+	os.MkdirAll(wfs.Root+"/site/v2", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/v1/index.html", []byte("teeest"), FILE_PERM)
+
+	_, err := deletePath(wfs, "/site/?glob=v*", nil)
+	assert.Equal(t, http.StatusConflict, err.(caddyhttp.HandlerError).StatusCode)
+	assertDirectoryExist(t, wfs.Root+"/site/v1")
+	assertDirectoryExist(t, wfs.Root+"/site/v2")
+
+	w, err := deletePath(wfs, "/site/?glob=v*", map[string]string{"X-Recursive": "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.NoDirExists(t, wfs.Root+"/site/v1")
+	assert.NoDirExists(t, wfs.Root+"/site/v2")
+}
+
+func TestDeleteGlobInvalid(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("teeest"), FILE_PERM)
+	os.WriteFile(wfs.Root+"/other.html", []byte("teeest"), FILE_PERM)
+
+	for path, status := range map[string]int{
+		"/site/?glob=../*.html":     http.StatusBadRequest,
+		"/site/?glob=%2Fother.html": http.StatusBadRequest,
+		"/site/?glob=":              http.StatusBadRequest,
+		"/site/?glob=[":             http.StatusBadRequest,
+		"/site/index.html?glob=*":   http.StatusConflict,
+		"/missing/?glob=*":          http.StatusNotFound,
+	} {
+		_, err := deletePath(wfs, path, nil)
+		if assert.Error(t, err, path) {
+			assert.Equal(t, status, err.(caddyhttp.HandlerError).StatusCode, path)
+		}
+	}
+	assertFileExist(t, wfs.Root+"/site/index.html")
+	assertFileExist(t, wfs.Root+"/other.html")
+}
+
+func TestDeleteGlobTrash(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/old.html", []byte("teeest"), FILE_PERM)
+
+	w, err := deletePath(wfs, "/site/?glob=*.html&soft=1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.NoFileExists(t, wfs.Root+"/site/old.html")
+
+	trashed, err := listTrashed(wfs.Root, wfs.trashPath(wfs.Root), wfs.Root+"/site/old.html")
+	assert.NoError(t, err)
+	assert.Len(t, trashed, 1)
+}
+
+func TestDeleteContents(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/css", DIR_PERM)
+	os.Chmod(wfs.Root+"/site", 0750)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("teeest"), FILE_PERM)
+	os.WriteFile(wfs.Root+"/site/css/style.css", []byte("teeest"), FILE_PERM)
+
+	w, err := deletePath(wfs, "/site/?contents_only=1", map[string]string{"X-Recursive": "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	assertDirectoryEmpty(t, wfs.Root+"/site")
+	info, err := os.Stat(wfs.Root + "/site")
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+
+	// An empty directory stays as it is
+	_, err = deletePath(wfs, "/site/?contents_only=1", nil)
+	assert.NoError(t, err)
+	assertDirectoryEmpty(t, wfs.Root+"/site")
+}
+
+func TestDeleteContentsInvalid(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/css", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/css/style.css", []byte("teeest"), FILE_PERM)
+
+	for path, status := range map[string]int{
+		"/site/?contents_only=1":              http.StatusConflict,
+		"/site/?contents_only=true":           http.StatusBadRequest,
+		"/site/css/style.css?contents_only=1": http.StatusConflict,
+		"/missing/?contents_only=1":           http.StatusNotFound,
+		"/?contents_only=1":                   http.StatusConflict,
+	} {
+		_, err := deletePath(wfs, path, nil)
+		if assert.Error(t, err, path) {
+			assert.Equal(t, status, err.(caddyhttp.HandlerError).StatusCode, path)
+		}
+	}
+	assertFileExist(t, wfs.Root+"/site/css/style.css")
+}
+
+func TestDeleteContentsRollback(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("teeest"), FILE_PERM)
+
+	// The empty directory cannot take the place of the target
+	original := rename
+	t.Cleanup(func() { rename = original })
+	rename = func(oldpath string, newpath string) error {
+		if newpath == wfs.Root+"/site" && !strings.Contains(oldpath, "-backup") {
+			return errors.New("injected rename failure")
+		}
+		return original(oldpath, newpath)
+	}
+
+	_, err := deletePath(wfs, "/site/?contents_only=1", nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.(caddyhttp.HandlerError).StatusCode)
+	}
+
+	assertFileExist(t, wfs.Root+"/site/index.html")
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestDeleteContentsTrash(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("teeest"), FILE_PERM)
+
+	_, err := deletePath(wfs, "/site/?contents_only=1&soft=1", nil)
+	assert.NoError(t, err)
+	assertDirectoryEmpty(t, wfs.Root+"/site")
+
+	// The contents are kept as a deleted version of the directory
+	trashed, err := listTrashed(wfs.Root, wfs.trashPath(wfs.Root), wfs.Root+"/site")
+	assert.NoError(t, err)
+	if assert.Len(t, trashed, 1) {
+		assertFileExist(t, trashed[0]+"/index.html")
+	}
+}
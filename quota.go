@@ -0,0 +1,191 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Disk usage of roots, shared by every instance of the handler like the locks
+var usages = newUsageCache()
+
+// Cache the disk usage of roots so that the whole tree is only walked again after a
+// write, and hold the bytes reserved by the deploys in progress: requests on different
+// entries of a root run concurrently, each must see the space promised to the others.
+type usageCache struct {
+	mu    sync.Mutex
+	roots map[string]*rootUsage
+}
+
+// Usage of a root, its mutex serializes the quota checks of its deploys
+type rootUsage struct {
+	mu       sync.Mutex
+	size     int64
+	known    bool
+	reserved map[string]int64 // By request id
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{roots: map[string]*rootUsage{}}
+}
+
+// Return the usage of root, created on first use
+func (c *usageCache) of(root string) *rootUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage, ok := c.roots[root]
+	if !ok {
+		usage = &rootUsage{reserved: map[string]int64{}}
+		c.roots[root] = usage
+	}
+	return usage
+}
+
+// Forget the disk usage of root and the bytes reserved by the request id, to be called
+// after each write once its result is on disk
+func (c *usageCache) settle(root string, id string) {
+	usage := c.of(root)
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.known = false
+	delete(usage.reserved, id)
+}
+
+// Return the disk usage of root, walking it if it is not cached. Must be called with
+// u.mu held.
+func (u *rootUsage) walk(root string, skip []string) (int64, error) {
+	if u.known {
+		return u.size, nil
+	}
+	size, err := diskUsage(root, skip...)
+	if err != nil {
+		return 0, err
+	}
+	u.size, u.known = size, true
+	return size, nil
+}
+
+// Return the bytes reserved by the requests other than id. Must be called with u.mu
+// held.
+func (u *rootUsage) pending(id string) int64 {
+	var pending int64
+	for other, size := range u.reserved {
+		if other != id {
+			pending += size
+		}
+	}
+	return pending
+}
+
+// Return the total size of the regular files under path. The temporary and backup
+// paths of deploys in progress and the directories of skip are skipped, and a missing
+// path has no size.
+func diskUsage(path string, skip ...string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // Removed during the walk
+		}
+		if err != nil {
+			return err
+		}
+		if p != path && (artifactPattern.MatchString(entry.Name()) || slices.Contains(skip, p)) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Check that swapping incoming in place of replaced keeps root within the quota and
+// reserve the added bytes for the request id until it settles. replaced is empty when
+// nothing is freed by the swap.
+func (wfs *WritableFileServer) checkQuota(id string, root string, replaced string, incoming string) *ErrorDeployement {
+	if wfs.QuotaMB == 0 {
+		return nil
+	}
+
+	added, err := diskUsage(incoming)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to compute disk usage of %s: %w", incoming, err),
+			"",
+		}
+	}
+	return wfs.checkQuotaSize(id, root, replaced, added)
+}
+
+// Check that writing added bytes in place of replaced keeps root within the quota,
+// for uploads whose size is known before they are received
+func (wfs *WritableFileServer) checkQuotaSize(id string, root string, replaced string, added int64) *ErrorDeployement {
+	if wfs.QuotaMB == 0 {
+		return nil
+	}
+
+	var freed int64
+	if replaced != "" {
+		var err error
+		// The directories of the handler are carried over when the root is replaced
+		freed, err = diskUsage(replaced, wfs.reservedPaths(root)...)
+		if err != nil {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to compute disk usage of %s: %w", replaced, err),
+				"",
+			}
+		}
+	}
+
+	usage := usages.of(filepath.Clean(root))
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	used, err := usage.walk(filepath.Clean(root), wfs.uncountedPaths(root))
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to compute disk usage of root %s: %w", root, err),
+			"",
+		}
+	}
+	pending := usage.pending(id)
+	if used+pending-freed+added > int64(wfs.QuotaMB)<<20 {
+		return &ErrorDeployement{
+			http.StatusInsufficientStorage,
+			fmt.Errorf("quota exceeded: %d bytes used, %d bytes reserved, %d bytes freed, %d bytes added", used, pending, freed, added),
+			fmt.Sprintf("upload exceeds the quota of %d MB", wfs.QuotaMB),
+		}
+	}
+	// Space freed is only available once the swap is done
+	usage.reserved[id] = max(added-freed, 0)
+	return nil
+}
+
+// Return the directories of root whose files do not count in its usage: the chunks of
+// resumable uploads are counted once the upload is committed, and retained backups are
+// not part of the site
+func (wfs *WritableFileServer) uncountedPaths(root string) []string {
+	return []string{wfs.partialsPath(root), wfs.backupsPath(root)}
+}
@@ -0,0 +1,182 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return a server with a quota of 1 MB and a root holding a file leaving free bytes
+func newFullWritableFileServer(t *testing.T, free int) *WritableFileServer {
+	wfs := newTestWritableFileServer(t)
+	wfs.QuotaMB = 1
+
+	if err := os.WriteFile(wfs.Root+"/big.bin", make([]byte, 1<<20-free), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	return wfs
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+	assert.Equal(t, "upload exceeds the quota of 1 MB\n", w.Body.String())
+
+	// Nothing is left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestQuotaExceededDirectory(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTar())
+	r.Header.Add("content-type", "application/x-tar")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+	assert.NoDirExists(t, wfs.Root+"/site")
+}
+
+func TestQuotaNotExceeded(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 100)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestQuotaReplaceFreesSpace(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	// The replaced file does not count
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/big.bin", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestQuotaAfterDelete(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.Error(t, err)
+
+	// The cached usage is invalidated by the delete
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/big.bin", nil)
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	w := httptest.NewRecorder()
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestQuotaExceededAppend(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PATCH", "/big.bin", bytes.NewBufferString("more than ten bytes"))
+	r.Header.Add("X-Patch-Mode", "append")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+
+	info, err := os.Stat(wfs.Root + "/big.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20-10), info.Size())
+}
+
+func TestDiskUsageSkipsArtifacts(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/index.html", make([]byte, 100), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getTempPath(GetId(), wfs.Root+"/page.html"), make([]byte, 1000), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := diskUsage(wfs.Root)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), size)
+}
+
+func TestQuotaReservedByConcurrentDeploys(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 100)
+
+	// The bytes of a deploy in progress count for the others until it settles
+	assert.Nil(t, wfs.checkQuotaSize("first", wfs.Root, "", 60))
+	errQuota := wfs.checkQuotaSize("second", wfs.Root, "", 60)
+	if assert.NotNil(t, errQuota) {
+		assert.Equal(t, http.StatusInsufficientStorage, errQuota.StatusCode)
+	}
+
+	// A deploy checking again replaces its own reservation
+	assert.Nil(t, wfs.checkQuotaSize("first", wfs.Root, "", 80))
+
+	usages.settle(wfs.Root, "first")
+	assert.Nil(t, wfs.checkQuotaSize("second", wfs.Root, "", 60))
+	usages.settle(wfs.Root, "second")
+}
+
+func TestQuotaExceededRestoreTrashed(t *testing.T) {
+	wfs := newFullWritableFileServer(t, 10)
+
+	_, err := deletePath(wfs, "/big.bin?soft=1", nil)
+	assert.NoError(t, err)
+
+	// The root crossed the quota since the deletion
+	if err := os.WriteFile(wfs.Root+"/other.bin", make([]byte, 100), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = restoreFromTrash(wfs, "/big.bin")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+	assert.NoFileExists(t, wfs.Root+"/big.bin")
+}
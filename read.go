@@ -0,0 +1,104 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// An entry of a directory listing
+type listingEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// Answer GET and HEAD requests with the content of the file target or a JSON listing of
+// the directory target. HEAD requests only get the headers.
+func (wfs *WritableFileServer) HandleGet(target string, w http.ResponseWriter, r *http.Request) *ErrorDeployement {
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to read a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+
+	if info.IsDir() {
+		return wfs.listDirectory(target, w, r)
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to open target file '%s' for reading: %w", target, err),
+			"",
+		}
+	}
+	defer file.Close()
+
+	// ServeContent takes care of HEAD, ranges and conditional requests
+	http.ServeContent(w, r, filepath.Base(target), info.ModTime(), file)
+	return nil
+}
+
+// Write the entries of the directory target as a JSON array
+func (wfs *WritableFileServer) listDirectory(target string, w http.ResponseWriter, r *http.Request) *ErrorDeployement {
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to read target directory '%s': %w", target, err),
+			"",
+		}
+	}
+
+	listing := make([]listingEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Removed since ReadDir
+		}
+		if err != nil {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("could not stat entry '%s': %w", entry.Name(), err),
+				"",
+			}
+		}
+		listing = append(listing, listingEntry{entry.Name(), info.Size(), info.ModTime().UTC(), entry.IsDir()})
+	}
+
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(listing); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to encode listing of '%s': %w", target, err),
+			"",
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body.Bytes())
+	}
+	return nil
+}
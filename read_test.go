@@ -0,0 +1,118 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/test.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "content\n", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+}
+
+func TestReadFileHead(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "HEAD", "/test.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "8", w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.String())
+}
+
+func TestReadDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	if err := os.Mkdir(wfs.Root+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/dir/test.txt", []byte("content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(wfs.Root+"/dir/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/dir/", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var listing []listingEntry
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	assert.Len(t, listing, 2)
+	assert.Equal(t, "sub", listing[0].Name)
+	assert.True(t, listing[0].IsDir)
+	assert.Equal(t, "test.txt", listing[1].Name)
+	assert.Equal(t, int64(8), listing[1].Size)
+	assert.False(t, listing[1].IsDir)
+}
+
+func TestReadNotFound(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/missing.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+}
+
+func TestOptionsWithRead(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "OPTIONS", "/test.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, "OPTIONS, GET, HEAD, PROPFIND, PUT, PATCH, DELETE, MOVE, COPY", w.Header().Get("Allow"))
+}
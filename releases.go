@@ -0,0 +1,144 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// How a directory upload is put in place, chosen per request with the
+// `X-Deploy-Strategy` header
+const (
+	DEPLOY_STRATEGY_SWAP    = "swap"
+	DEPLOY_STRATEGY_SYMLINK = "symlink"
+)
+
+// Names of the entries managed by the symlink strategy inside its target
+const (
+	RELEASES_DIR = "releases"
+	CURRENT_LINK = "current"
+)
+
+// Return the deploy strategy of r, `swap` by default
+func deployStrategy(r *http.Request) (string, *ErrorDeployement) {
+	strategy := r.Header.Get("X-Deploy-Strategy")
+	switch strategy {
+	case "":
+		return DEPLOY_STRATEGY_SWAP, nil
+	case DEPLOY_STRATEGY_SWAP, DEPLOY_STRATEGY_SYMLINK:
+		return strategy, nil
+	default:
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid deploy strategy: %s", strategy),
+			"invalid X-Deploy-Strategy header: must be 'swap' or 'symlink'",
+		}
+	}
+}
+
+// Move the extracted directory release into the releases of target and atomically
+// repoint the `current` symlink of target to it. The previous releases are kept for
+// rollback: KeepBackups of them, and at least one. On success it returns 201 Created
+// if target had no current release and 204 No Content otherwise.
+func (wfs *WritableFileServer) publishRelease(id string, target string, release string) (int, *ErrorDeployement) {
+	target = filepath.Clean(target)
+	releases := filepath.Join(target, RELEASES_DIR)
+	current := filepath.Join(target, CURRENT_LINK)
+
+	info, err := os.Lstat(current)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat current release: %w", err),
+			"",
+		}
+	}
+	exists := err == nil
+	if exists && info.Mode()&os.ModeSymlink == 0 {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("%s is not a symlink", current),
+			"the 'current' entry of the target is not a symlink",
+		}
+	}
+
+	if err := os.MkdirAll(releases, wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create releases directory %s: %w", releases, err),
+			"",
+		}
+	}
+
+	// Names sort chronologically, like retained backups
+	name := time.Now().UTC().Format(BACKUP_TIME_LAYOUT) + "-" + id
+	if err := rename(filepath.Clean(release), filepath.Join(releases, name)); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to move release %s into %s: %w", release, releases, err),
+			"",
+		}
+	}
+
+	// A symlink cannot be replaced in place, the new one is renamed over it
+	link := getTempPath(id, current)
+	if err := os.Symlink(filepath.Join(RELEASES_DIR, name), link); err != nil {
+		os.RemoveAll(filepath.Join(releases, name))
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create symlink %s: %w", link, err),
+			"",
+		}
+	}
+	if err := rename(link, current); err != nil {
+		os.Remove(link)
+		os.RemoveAll(filepath.Join(releases, name))
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to repoint %s to release %s: %w", current, name, err),
+			"",
+		}
+	}
+
+	// The previous release is always kept so that there is something to roll back to
+	if err := pruneReleases(releases, name, max(wfs.KeepBackups, 1)); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to prune releases", zap.String("releases", releases), zap.Error(err))
+	}
+
+	if !exists {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+// Remove the oldest releases other than current so that at most keep of them remain
+func pruneReleases(releases string, current string, keep int) error {
+	entries, err := os.ReadDir(releases)
+	if err != nil {
+		return err
+	}
+
+	previous := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != current && !strings.HasPrefix(entry.Name(), ".") {
+			previous = append(previous, entry.Name())
+		}
+	}
+	slices.Sort(previous)
+
+	for len(previous) > keep {
+		if err := os.RemoveAll(filepath.Join(releases, previous[0])); err != nil {
+			return fmt.Errorf("failed to prune release %s: %w", previous[0], err)
+		}
+		previous = previous[1:]
+	}
+	return nil
+}
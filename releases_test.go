@@ -0,0 +1,125 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Deploy the test archive to path with the symlink strategy
+func putRelease(wfs *WritableFileServer, path string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path, newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	r.Header.Add("X-Deploy-Strategy", "symlink")
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestDeployRelease(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	first, err := putRelease(wfs, "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	firstRelease, err := os.Readlink(wfs.Root + "/current")
+	assert.NoError(t, err)
+
+	second, err := putRelease(wfs, "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, second.Code)
+	secondRelease, err := os.Readlink(wfs.Root + "/current")
+	assert.NoError(t, err)
+
+	// current points to the newer release and the previous one is kept
+	assert.NotEqual(t, firstRelease, secondRelease)
+	assert.Equal(t, "releases", filepath.Dir(secondRelease))
+	assert.Greater(t, secondRelease, firstRelease)
+	assertDirectoryExist(t, filepath.Join(wfs.Root, firstRelease))
+	assertFileExist(t, wfs.Root+"/current/tested/tested.txt")
+
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestDeployReleasePrune(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.KeepBackups = 2
+
+	for i := 0; i < 5; i++ {
+		_, err := putRelease(wfs, "/site/")
+		assert.NoError(t, err)
+	}
+
+	// The current release and 2 previous ones
+	entries, err := os.ReadDir(wfs.Root + "/site/releases")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	current, err := os.Readlink(wfs.Root + "/site/current")
+	assert.NoError(t, err)
+	assert.Equal(t, entries[2].Name(), filepath.Base(current))
+}
+
+func TestDeployReleaseInvalid(t *testing.T) {
+	var tests = map[string]map[string]string{
+		"file":           {"X-Deploy-Strategy": "symlink"},
+		"merge":          {"X-Deploy-Strategy": "symlink", "X-Deploy-Mode": "merge"},
+		"merge default":  {"X-Deploy-Strategy": "symlink"},
+		"unknown header": {"X-Deploy-Strategy": "blue-green"},
+	}
+
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			if name == "merge default" {
+				wfs.DeployMode = DEPLOY_MODE_MERGE
+			}
+
+			path := "/site/"
+			if name == "file" {
+				path = "/test.txt"
+			}
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", path, newTar())
+			r.Header.Add("Content-Type", "application/x-tar")
+			for header, value := range headers {
+				r.Header.Add(header, value)
+			}
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+			assertDirectoryEmpty(t, wfs.Root)
+		})
+	}
+}
+
+func TestDeployReleaseCurrentNotSymlink(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.MkdirAll(wfs.Root+"/current", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := putRelease(wfs, "/")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	assertDirectoryEmpty(t, wfs.Root+"/current")
+}
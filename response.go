@@ -0,0 +1,140 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Body of error responses in JSON
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// Body of upload responses in JSON
+type uploadResponse struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`
+}
+
+// Return true if the `Accept` header of the request includes `application/json`
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Write body as the JSON response of the request
+func writeJSON(w http.ResponseWriter, status int, body any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
+
+// Set the Last-Modified header to the modification time of the written path. It is
+// omitted if path cannot be stat, the upload has succeeded anyway.
+func setLastModified(w http.ResponseWriter, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+}
+
+// Announce trailers summarizing an upload, the bytes written to disk and the number of
+// files and directories extracted, and set them. The response has no body to wait for
+// so they follow the headers immediately. Only responses that can have a body can have
+// trailers, see successHasBody.
+func setSummaryTrailers(w http.ResponseWriter, progress *extractProgress) {
+	w.Header().Set("Trailer", "X-Bytes-Written, X-Entries")
+	w.Header().Set(http.TrailerPrefix+"X-Bytes-Written", strconv.FormatInt(progress.bytes, 10))
+	w.Header().Set(http.TrailerPrefix+"X-Entries", strconv.Itoa(progress.entries))
+}
+
+// Return true if the response of a successful request with status can have a body. A
+// 204 No Content is replaced by 200 OK for the body of SuccessTemplate or a JSON body.
+func (wfs *WritableFileServer) successHasBody(r *http.Request, status int) bool {
+	switch status {
+	case 0, http.StatusNotModified:
+		return false
+	case http.StatusNoContent:
+		return wfs.SuccessTemplate != "" || acceptsJSON(r) && (r.Method == http.MethodPut || r.Method == http.MethodPatch)
+	}
+	return true
+}
+
+// Write the status of a successful write request, with a JSON body for uploads when
+// the client asks for it
+func writeSuccess(w http.ResponseWriter, r *http.Request, status int) error {
+	// Only the handler knows the results listed by a 207 Multi-Status, it writes it
+	if status == 0 || status == http.StatusMultiStatus {
+		return nil
+	}
+	// A 304 Not Modified cannot have a body either
+	if acceptsJSON(r) && status != http.StatusNotModified && (r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		return writeUploadResponse(w, r, status)
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// Write the response of a successful request with the body of SuccessTemplate. Like the
+// JSON responses, 204 No Content is replaced by 200 OK.
+func (wfs *WritableFileServer) writeSuccessTemplate(w http.ResponseWriter, r *http.Request, status int) error {
+	if status == 0 || status == http.StatusNotModified || status == http.StatusMultiStatus {
+		return writeSuccess(w, r, status)
+	}
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	body := repl.ReplaceAll(wfs.SuccessTemplate, "")
+	if json.Valid([]byte(body)) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(body))
+	return err
+}
+
+// Write the response of a successful upload. A JSON body cannot be sent with
+// 204 No Content so it is replaced by 200 OK.
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, status int) error {
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+	return writeJSON(w, status, uploadResponse{"ok", r.URL.Path})
+}
+
+// Keep a copy of the body written by a handler, so that the retries of its request can
+// get it back. Everything is passed through to the wrapped writer.
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
+}
+
+// Let http.ResponseController reach the wrapped writer, for the read deadlines
+func (b *bodyRecorder) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
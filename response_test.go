@@ -0,0 +1,214 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	var tests = map[string]bool{
+		"":                                    false,
+		"text/plain":                          false,
+		"*/*":                                 false,
+		"application/json":                    true,
+		"text/html, application/json;q=0.9":   true,
+		"application/json; charset=utf-8":     true,
+		"application/jsonp, text/plain;q=0.5": false,
+	}
+
+	for accept, expected := range tests {
+		t.Run(accept, func(t *testing.T) {
+			r, _ := http.NewRequest("PUT", "/", nil)
+			if accept != "" {
+				r.Header.Add("Accept", accept)
+			}
+			assert.Equal(t, expected, acceptsJSON(r))
+		})
+	}
+}
+
+func TestErrorResponseJSON(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+	r.Header.Add("Accept", "application/json")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	body := errorResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, errorResponse{"Not Found.", http.StatusNotFound}, body)
+}
+
+func TestErrorResponsePlainText(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+	r.Header.Add("Accept", "text/plain")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotEqual(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Not Found.\n", w.Body.String())
+}
+
+func TestUploadResponseJSON(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+		r.Header.Add("Content-Type", "application/octet-stream")
+		r.Header.Add("Accept", "application/json")
+
+		w := httptest.NewRecorder()
+
+		err := wfs.ServeHTTP(w, r, &MockHandler{})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		body := uploadResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, uploadResponse{"ok", "/test.txt"}, body)
+	}
+}
+
+func TestUploadLastModified(t *testing.T) {
+	var tests = map[string]struct {
+		path        string
+		contentType string
+		newBody     func() io.ReadCloser
+	}{
+		"file":      {"/test.txt", "application/octet-stream", newFile},
+		"directory": {"/site/", "application/x-tar", newTar},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "PUT", test.path, test.newBody())
+			r.Header.Add("Content-Type", test.contentType)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+			assert.NoError(t, err)
+
+			info, err := os.Stat(wfs.Root + test.path)
+			assert.NoError(t, err)
+			assert.Equal(t, info.ModTime().Truncate(time.Second), lastModified.Local())
+		})
+	}
+}
+
+func TestUploadSummaryTrailers(t *testing.T) {
+	var tests = map[string]struct {
+		path        string
+		contentType string
+		body        io.ReadCloser
+		overwrite   bool
+		template    string
+		status      int
+		bytes       string
+		entries     string
+	}{
+		"file": {"/test.txt", "application/octet-stream", newFile(), false, "", http.StatusCreated, "29", "1"},
+		"directory": {"/site/", "application/x-tar", newTarWith(
+			tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+			tarEntry{&tar.Header{Name: "a/b.txt", Typeflag: tar.TypeReg, Mode: 0644}, "hello"},
+			tarEntry{&tar.Header{Name: "c.txt", Typeflag: tar.TypeReg, Mode: 0644}, "world!"},
+		), false, "", http.StatusCreated, "11", "3"},
+		"overwrite":          {"/test.txt", "application/octet-stream", newFile(), true, "", http.StatusNoContent, "", ""},
+		"overwrite template": {"/test.txt", "application/octet-stream", newFile(), true, "ok", http.StatusOK, "29", "1"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.SuccessTemplate = test.template
+			if test.overwrite {
+				os.WriteFile(wfs.Root+test.path, []byte("previous"), FILE_PERM)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			r, _ := http.NewRequestWithContext(ctx, "PUT", test.path, test.body)
+			r.Header.Add("Content-Type", test.contentType)
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			assert.NoError(t, err)
+
+			res := w.Result()
+			assert.Equal(t, test.status, res.StatusCode)
+			if test.bytes == "" {
+				// A 204 No Content cannot carry trailers
+				assert.Empty(t, res.Header.Get("Trailer"))
+				assert.Empty(t, res.Trailer)
+				return
+			}
+			assert.Equal(t, "X-Bytes-Written, X-Entries", res.Header.Get("Trailer"))
+			assert.Equal(t, test.bytes, res.Trailer.Get("X-Bytes-Written"))
+			assert.Equal(t, test.entries, res.Trailer.Get("X-Entries"))
+		})
+	}
+}
+
+func TestSuccessTemplate(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.SuccessTemplate = `\{"id": "{deploy.id}", "url": "https://{http.request.host}{deploy.path}", "bytes": {deploy.bytes}\}`
+
+	repl := caddy.NewReplacer()
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "https://example.com/docs/test.txt", newFile())
+	repl.Set("http.request.host", r.Host)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	id := w.Header().Get("X-Deploy-Id")
+	assert.NotEmpty(t, id)
+	assert.Equal(t, `{"id": "`+id+`", "url": "https://example.com/docs/test.txt", "bytes": 29}`, w.Body.String())
+
+	// Not JSON, and replacing 204 No Content since there is a body
+	wfs.SuccessTemplate = "deployed {deploy.path}"
+	repl = caddy.NewReplacer()
+	ctx = context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+	r, _ = http.NewRequestWithContext(ctx, "DELETE", "/docs/test.txt", nil)
+
+	w = httptest.NewRecorder()
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "deployed /docs/test.txt", w.Body.String())
+}
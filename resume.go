@@ -0,0 +1,458 @@
+package caddy_writable_file_server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Status of incomplete resumable uploads, with the received bytes in the Range header
+const STATUS_RESUME_INCOMPLETE = http.StatusPermanentRedirect
+
+const PARTIAL_TTL = 24 * time.Hour
+
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// Progress of a resumable upload, stored next to its partial file
+type partialState struct {
+	Total  int64      `json:"total"`
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+// Directory of the resumable uploads of a root without staging directory
+const PARTIALS_DIR = ".partials"
+
+// Return the directory of the resumable uploads of root: its staging directory when one
+// is configured, PARTIALS_DIR otherwise. Half-uploaded files never sit in the served
+// tree, like the temporary paths.
+func (wfs *WritableFileServer) partialsPath(root string) string {
+	if staging := wfs.stagingPath(root); staging != "" {
+		return staging
+	}
+	return filepath.Join(root, PARTIALS_DIR)
+}
+
+// Return the path of the file receiving the chunks of a resumable upload of target.
+// Unlike the temporary paths it is shared by every request of the upload. The
+// directory of the uploads is flat: targets with the same name in different
+// directories are told apart by a hash of their path in the root.
+func (wfs *WritableFileServer) partialPath(root string, target string) string {
+	rel, _ := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	name := filepath.Base(target) + "-" + hex.EncodeToString(sum[:8]) + ".partial"
+	return filepath.Join(wfs.partialsPath(root), name)
+}
+
+// Parse a `Content-Range: bytes start-end/total` header
+func parseContentRange(header string) (int64, int64, int64, *ErrorDeployement) {
+	errInvalid := &ErrorDeployement{
+		http.StatusBadRequest,
+		fmt.Errorf("invalid content-range header: %s", header),
+		"invalid Content-Range header: must be 'bytes start-end/total'",
+	}
+
+	match := contentRangePattern.FindStringSubmatch(header)
+	if match == nil {
+		return 0, 0, 0, errInvalid
+	}
+	start, errStart := strconv.ParseInt(match[1], 10, 64)
+	end, errEnd := strconv.ParseInt(match[2], 10, 64)
+	total, errTotal := strconv.ParseInt(match[3], 10, 64)
+	if errStart != nil || errEnd != nil || errTotal != nil || start > end || end >= total {
+		return 0, 0, 0, errInvalid
+	}
+	return start, end, total, nil
+}
+
+// Write the body of a chunk of a resumable upload at its offset in the partial file of
+// target. Once every byte is received the partial file is swapped with target and it
+// returns 201 Created or 204 No Content, until then it returns 308 with the received
+// ranges in the `Range` header.
+func (wfs *WritableFileServer) HandleRangePut(id string, root string, target string, exists bool, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	if strings.HasSuffix(target, "/") {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("content-range on the directory %s", target),
+			"Content-Range is only supported for files",
+		}
+	}
+
+	start, end, total, errRange := parseContentRange(r.Header.Get("Content-Range"))
+	if errRange != nil {
+		return 0, errRange
+	}
+
+	partial := wfs.partialPath(root, target)
+	state, err := readPartialState(partial)
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to read the state of %s: %w", partial, err),
+			"",
+		}
+	}
+	if state.Total == 0 {
+		// A new upload: leave no abandoned one behind and refuse it before receiving
+		// bytes that could never be committed
+		wfs.removeExpiredPartials(filepath.Dir(partial))
+		if errSize := wfs.checkPartialSize(id, root, target, exists, total); errSize != nil {
+			return 0, errSize
+		}
+		state.Total = total
+	}
+	if state.Total != total {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("resumable upload of %s has a total of %d, got %d", target, state.Total, total),
+			fmt.Sprintf("an upload of this target with a total of %d bytes is in progress", state.Total),
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(partial), wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create the directory of resumable uploads %s: %w", filepath.Dir(partial), err),
+			"",
+		}
+	}
+	if errWrite := wfs.writeChunk(partial, start, end, r.Body); errWrite != nil {
+		return 0, errWrite
+	}
+
+	state.add(start, end)
+	if !state.complete() {
+		if err := writePartialState(partial, state); err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to write the state of %s: %w", partial, err),
+				"",
+			}
+		}
+		w.Header().Set("Range", state.rangeHeader())
+		return STATUS_RESUME_INCOMPLETE, nil
+	}
+
+	return wfs.commitPartial(id, root, target, partial, exists, w)
+}
+
+// Check that an upload of total bytes to target fits in MaxSizeMB and in the quota
+func (wfs *WritableFileServer) checkPartialSize(id string, root string, target string, exists bool, total int64) *ErrorDeployement {
+	limit := int64(wfs.MaxSizeMB) << 20
+	if wfs.MaxSizeMB > 0 && total > limit {
+		return &ErrorDeployement{
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("content-range total %d is too large: %w", total, &http.MaxBytesError{Limit: limit}),
+			"", // Set by handleError
+		}
+	}
+
+	replaced := ""
+	if exists {
+		replaced = target
+	}
+	// The other uploads in progress are not counted in the usage of the root yet
+	return wfs.checkQuotaSize(id, root, replaced, total+wfs.pendingPartials(root))
+}
+
+// Return the total size announced by the resumable uploads in progress in root
+func (wfs *WritableFileServer) pendingPartials(root string) int64 {
+	entries, err := os.ReadDir(wfs.partialsPath(root))
+	if err != nil {
+		return 0
+	}
+	var pending int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".partial.json") {
+			continue
+		}
+		partial := strings.TrimSuffix(filepath.Join(wfs.partialsPath(root), entry.Name()), ".json")
+		if state, err := readPartialState(partial); err == nil {
+			pending += state.Total
+		}
+	}
+	return pending
+}
+
+// Write exactly the bytes start to end of reader at their offset in partial
+func (wfs *WritableFileServer) writeChunk(partial string, start int64, end int64, reader io.Reader) *ErrorDeployement {
+	if reader == nil {
+		reader = http.NoBody
+	}
+
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, wfs.filePerm)
+	if err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to open partial file '%s': %w", partial, err),
+			"",
+		}
+	}
+	defer file.Close()
+
+	length := end - start + 1
+	written, err := io.CopyN(io.NewOffsetWriter(file, start), reader, length)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to write chunk to partial file '%s': %w", partial, err),
+			"",
+		}
+	}
+	// A body longer than announced is told from an exact one by one extra byte, read
+	// aside: written at end+1 it could overwrite a byte received by another chunk
+	if written == length {
+		extra, errExtra := io.ReadFull(reader, make([]byte, 1))
+		if errExtra != nil && !errors.Is(errExtra, io.EOF) {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to read chunk for partial file '%s': %w", partial, errExtra),
+				"",
+			}
+		}
+		written += int64(extra)
+	}
+	if written != length {
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("chunk of %d bytes announced as %d bytes", written, length),
+			"the body length does not match the Content-Range header",
+		}
+	}
+
+	if wfs.Fsync {
+		if err := file.Sync(); err != nil {
+			return &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to sync partial file '%s': %w", partial, err),
+				"",
+			}
+		}
+	}
+	return nil
+}
+
+// Swap the complete partial file with target
+func (wfs *WritableFileServer) commitPartial(id string, root string, target string, partial string, exists bool, w http.ResponseWriter) (int, *ErrorDeployement) {
+	etag, err := hashFile(partial)
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to hash partial file '%s': %w", partial, err),
+			"",
+		}
+	}
+
+	replaced := ""
+	if exists {
+		replaced = target
+	}
+	// The partial file is not counted in the usage of the root until now
+	info, err := os.Stat(partial)
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to stat partial file '%s': %w", partial, err),
+			"",
+		}
+	}
+	if errQuota := wfs.checkQuotaSize(id, root, replaced, info.Size()); errQuota != nil {
+		return 0, errQuota
+	}
+
+	// The parents of target are only created once the upload is complete
+	if err := os.MkdirAll(filepath.Dir(target), wfs.dirPerm); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			return 0, errFileParent(root, target, err)
+		}
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create target directory %s: %w", target, err),
+			"",
+		}
+	}
+
+	// We backup target if it already exist
+	targetBackup := wfs.backupPath(id, root, target)
+	if exists {
+		if err := rename(target, targetBackup); err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to backup target %s: %w", target, err),
+				"",
+			}
+		}
+	}
+
+	// Swap target with the partial file using atomic `Rename`
+	if err := rename(partial, target); err != nil {
+		err = fmt.Errorf("failed to swap partial file (%s) with target (%s): %w", partial, target, err)
+		if errRollback := rollback(targetBackup, target); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	if err := os.Remove(partialStatePath(partial)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove state of resumable upload", zap.String("partial", partial), zap.Error(err))
+	}
+
+	// The rename itself is only durable once the parent directory is synced
+	if wfs.Fsync {
+		if err := syncDirectory(filepath.Dir(target)); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to sync parent directory after resumable upload", zap.String("target", target), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	setLastModified(w, target)
+	if !exists {
+		return http.StatusCreated, nil
+	}
+
+	if wfs.KeepBackups > 0 {
+		if err := wfs.retainBackup(root, targetBackup, target); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to retain backup", zap.String("targetBackup", targetBackup), zap.Error(err))
+		}
+	} else if err := os.RemoveAll(targetBackup); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after resumable upload", zap.String("backup", targetBackup), zap.Error(err))
+	}
+	return http.StatusNoContent, nil
+}
+
+// Return the ETag of the content of path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return formatETag(hash.Sum(nil)), nil
+}
+
+// Remove the resumable uploads of dir whose last chunk is older than PartialTTL.
+// Failures are only logged: they must not fail the upload that triggered the sweep.
+func (wfs *WritableFileServer) removeExpiredPartials(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to list abandoned resumable uploads", zap.String("dir", dir), zap.Error(err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".partial.json") {
+			continue
+		}
+		partial := strings.TrimSuffix(filepath.Join(dir, entry.Name()), ".json")
+		if removed, err := wfs.removeExpiredPartial(partial); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to remove abandoned resumable upload", zap.String("partial", partial), zap.Error(err))
+		} else if removed {
+			wfs.logger.Log(zapcore.InfoLevel, "removed abandoned resumable upload", zap.String("partial", partial))
+		}
+	}
+}
+
+// Remove partial and its state if its last chunk is older than PartialTTL. A file
+// that merely looks like a state, like one uploaded by a client, is left alone.
+func (wfs *WritableFileServer) removeExpiredPartial(partial string) (bool, error) {
+	info, err := os.Stat(partialStatePath(partial))
+	if err != nil {
+		return false, nil
+	}
+	if time.Since(info.ModTime()) < time.Duration(wfs.PartialTTL) {
+		return false, nil
+	}
+	state, err := readPartialState(partial)
+	if err != nil || state.Total <= 0 {
+		return false, nil
+	}
+
+	if err := os.Remove(partial); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if err := os.Remove(partialStatePath(partial)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+func partialStatePath(partial string) string {
+	return partial + ".json"
+}
+
+// Return the state of the upload of partial, empty if it has not started
+func readPartialState(partial string) (*partialState, error) {
+	data, err := os.ReadFile(partialStatePath(partial))
+	if errors.Is(err, os.ErrNotExist) {
+		return &partialState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &partialState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func writePartialState(partial string, state *partialState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partialStatePath(partial), data, FILE_PERM)
+}
+
+// Record the bytes start to end as received, merging overlapping and adjacent ranges
+func (s *partialState) add(start int64, end int64) {
+	ranges := append(s.Ranges, [2]int64{start, end})
+	slices.SortFunc(ranges, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+
+	merged := [][2]int64{ranges[0]}
+	for _, current := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if current[0] <= last[1]+1 {
+			last[1] = max(last[1], current[1])
+		} else {
+			merged = append(merged, current)
+		}
+	}
+	s.Ranges = merged
+}
+
+// Return true once every byte of the upload is received
+func (s *partialState) complete() bool {
+	return len(s.Ranges) == 1 && s.Ranges[0][0] == 0 && s.Ranges[0][1] == s.Total-1
+}
+
+// Return the received ranges like `bytes=0-99,200-299`
+func (s *partialState) rangeHeader() string {
+	ranges := make([]string, len(s.Ranges))
+	for i, r := range s.Ranges {
+		ranges[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+	}
+	return "bytes=" + strings.Join(ranges, ",")
+}
@@ -0,0 +1,315 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func putRange(wfs *WritableFileServer, target string, contentRange string, body string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", target, bytes.NewBufferString(body))
+	r.Header.Add("Content-Range", contentRange)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestResumableUploadOutOfOrder(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	w, err := putRange(wfs, "/test.txt", "bytes 6-11/12", "world!")
+	assert.NoError(t, err)
+	assert.Equal(t, STATUS_RESUME_INCOMPLETE, w.Code)
+	assert.Equal(t, "bytes=6-11", w.Header().Get("Range"))
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+
+	w, err = putRange(wfs, "/test.txt", "bytes 0-5/12", "Hello ")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world!", string(data))
+
+	sha := sha256.Sum256(data)
+	assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, w.Header().Get("ETag"))
+
+	// The partial file and its state are gone
+	assertDirectoryEmpty(t, wfs.Root+"/"+PARTIALS_DIR)
+}
+
+func TestResumableUploadReplace(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := putRange(wfs, "/test.txt", "bytes 0-2/6", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, STATUS_RESUME_INCOMPLETE, w.Code)
+
+	// The target is untouched until the upload is complete
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+
+	w, err = putRange(wfs, "/test.txt", "bytes 3-5/6", "est")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	data, err = os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "newest", string(data))
+	assertDirectoryEmpty(t, wfs.Root+"/"+PARTIALS_DIR)
+}
+
+func TestResumableUploadRanges(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	w, err := putRange(wfs, "/test.txt", "bytes 0-1/10", "ab")
+	assert.NoError(t, err)
+	assert.Equal(t, "bytes=0-1", w.Header().Get("Range"))
+
+	w, err = putRange(wfs, "/test.txt", "bytes 6-7/10", "gh")
+	assert.NoError(t, err)
+	assert.Equal(t, "bytes=0-1,6-7", w.Header().Get("Range"))
+
+	// Adjacent ranges are merged
+	w, err = putRange(wfs, "/test.txt", "bytes 2-5/10", "cdef")
+	assert.NoError(t, err)
+	assert.Equal(t, "bytes=0-7", w.Header().Get("Range"))
+}
+
+func TestResumableUploadInvalid(t *testing.T) {
+	var tests = map[string]struct {
+		target       string
+		contentRange string
+		body         string
+		status       int
+	}{
+		"malformed":       {"/test.txt", "bytes=0-4/5", "hello", http.StatusBadRequest},
+		"unknown total":   {"/test.txt", "bytes 0-4/*", "hello", http.StatusBadRequest},
+		"end after total": {"/test.txt", "bytes 0-5/5", "hello!", http.StatusBadRequest},
+		"short body":      {"/test.txt", "bytes 0-4/5", "hell", http.StatusBadRequest},
+		"long body":       {"/test.txt", "bytes 0-4/5", "hello!", http.StatusBadRequest},
+		"directory":       {"/site/", "bytes 0-4/5", "hello", http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			_, err := putRange(wfs, test.target, test.contentRange, test.body)
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assert.NoFileExists(t, wfs.Root+"/test.txt")
+		})
+	}
+}
+
+func TestResumableUploadTotalMismatch(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	_, err := putRange(wfs, "/test.txt", "bytes 0-1/10", "ab")
+	assert.NoError(t, err)
+
+	_, err = putRange(wfs, "/test.txt", "bytes 2-3/20", "cd")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+}
+
+func TestResumableUploadStaging(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.StagingDir = ".deploy-staging"
+	assert.NoError(t, os.Mkdir(wfs.Root+"/a", DIR_PERM))
+	assert.NoError(t, os.Mkdir(wfs.Root+"/b", DIR_PERM))
+
+	// Uploads of targets with the same name do not share their partial file
+	w, err := putRange(wfs, "/a/index.html", "bytes 0-1/4", "aa")
+	assert.NoError(t, err)
+	assert.Equal(t, STATUS_RESUME_INCOMPLETE, w.Code)
+
+	w, err = putRange(wfs, "/b/index.html", "bytes 0-2/6", "bbb")
+	assert.NoError(t, err)
+	assert.Equal(t, STATUS_RESUME_INCOMPLETE, w.Code)
+
+	w, err = putRange(wfs, "/a/index.html", "bytes 2-3/4", "AA")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w, err = putRange(wfs, "/b/index.html", "bytes 3-5/6", "BBB")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/a/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "aaAA", string(data))
+	data, err = os.ReadFile(wfs.Root + "/b/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "bbbBBB", string(data))
+	assertDirectoryEmpty(t, wfs.Root+"/.deploy-staging")
+}
+
+func TestResumableUploadExpired(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	old := wfs.partialPath(wfs.Root, wfs.Root+"/old.txt")
+	recent := wfs.partialPath(wfs.Root, wfs.Root+"/recent.txt")
+
+	_, err := putRange(wfs, "/old.txt", "bytes 0-1/10", "ab")
+	assert.NoError(t, err)
+	_, err = putRange(wfs, "/recent.txt", "bytes 0-1/10", "ab")
+	assert.NoError(t, err)
+
+	lastChunk := time.Now().Add(-PARTIAL_TTL - time.Minute)
+	assert.NoError(t, os.Chtimes(partialStatePath(old), lastChunk, lastChunk))
+
+	// Starting another upload removes the abandoned one only
+	_, err = putRange(wfs, "/new.txt", "bytes 0-1/10", "ab")
+	assert.NoError(t, err)
+	assert.NoFileExists(t, old)
+	assert.NoFileExists(t, partialStatePath(old))
+	assert.FileExists(t, recent)
+	assert.FileExists(t, partialStatePath(recent))
+
+	// As does provisioning
+	assert.NoError(t, os.Chtimes(partialStatePath(recent), lastChunk, lastChunk))
+	provisionTestWritableFileServer(t, wfs)
+	assert.NoFileExists(t, recent)
+}
+
+func TestResumableUploadHidden(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+
+	// Nothing is written to the served tree before the upload is complete
+	_, err := putRange(wfs, "/dir/test.txt", "bytes 0-1/4", "ab")
+	assert.NoError(t, err)
+	assert.NoDirExists(t, wfs.Root+"/dir")
+
+	partial := wfs.partialPath(wfs.Root, wfs.Root+"/dir/test.txt")
+	rel, err := filepath.Rel(wfs.Root, partial)
+	assert.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/"+filepath.ToSlash(rel), nil)
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, errHandler.StatusCode)
+
+	w, err := putRange(wfs, "/dir/test.txt", "bytes 2-3/4", "cd")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/dir/test.txt")
+}
+
+func TestResumableUploadTooLarge(t *testing.T) {
+	var tests = map[string]struct {
+		maxSizeMB int
+		quotaMB   int
+		status    int
+	}{
+		"max size": {1, 0, http.StatusRequestEntityTooLarge},
+		"quota":    {0, 1, http.StatusInsufficientStorage},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			wfs.MaxSizeMB = test.maxSizeMB
+			wfs.QuotaMB = test.quotaMB
+
+			// Refused with the first chunk, before anything is written
+			_, err := putRange(wfs, "/test.txt", "bytes 0-1/2097152", "ab")
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assertDirectoryEmpty(t, wfs.Root)
+		})
+	}
+}
+
+func TestResumableUploadReportedOnce(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+
+	_, err := putRange(wfs, "/test.txt", "bytes 0-1/4", "ab")
+	assert.NoError(t, err)
+	_, err = putRange(wfs, "/test.txt", "bytes 2-3/4", "cd")
+	assert.NoError(t, err)
+
+	// Only the chunk completing the upload is a deploy
+	entries := readAudit(t, wfs.AuditLog)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, http.StatusCreated, entries[0].Status)
+	}
+}
+
+func TestResumableUploadLongChunk(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	_, err := putRange(wfs, "/test.txt", "bytes 2-3/4", "cd")
+	assert.NoError(t, err)
+
+	// The extra byte of a refused chunk does not land on the received ones
+	_, err = putRange(wfs, "/test.txt", "bytes 0-1/4", "abX")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, errHandler.StatusCode)
+
+	w, err := putRange(wfs, "/test.txt", "bytes 0-1/4", "ab")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+}
+
+func TestResumableUploadQuota(t *testing.T) {
+	for _, staging := range []string{"", ".deploy-staging"} {
+		t.Run("staging "+staging, func(t *testing.T) {
+			wfs := newFullWritableFileServer(t, 100)
+			wfs.StagingDir = staging
+
+			_, err := putRange(wfs, "/first.bin", "bytes 0-1/60", "ab")
+			assert.NoError(t, err)
+
+			// The upload in progress counts for the next ones
+			_, err = putRange(wfs, "/second.bin", "bytes 0-1/60", "ab")
+			errHandler, ok := err.(caddyhttp.HandlerError)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+
+			// And the space it is committed into is checked again
+			if err := os.WriteFile(wfs.Root+"/other.bin", make([]byte, 50), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+			_, err = putRange(wfs, "/first.bin", "bytes 2-59/60", strings.Repeat("c", 58))
+			errHandler, ok = err.(caddyhttp.HandlerError)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusInsufficientStorage, errHandler.StatusCode)
+			assert.NoFileExists(t, wfs.Root+"/first.bin")
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Create the spool file of an archive. It is a variable so that tests can observe which
+// uploads spill to disk.
+var createSpool = func(name string, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_RDWR, perm)
+}
+
+// A copy of an archive kept in memory up to limit bytes. Past it, the copy spills to the
+// spool file at path, on the file system of the target.
+type spoolBuffer struct {
+	path  string
+	perm  os.FileMode
+	limit int64
+
+	memory bytes.Buffer
+	file   *os.File
+	// Set by rewind
+	reader io.Reader
+}
+
+func (s *spoolBuffer) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.memory.Len()+len(p)) > s.limit {
+		file, err := createSpool(s.path, s.perm)
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.memory.WriteTo(file); err != nil {
+			return 0, err
+		}
+		s.memory = bytes.Buffer{}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.memory.Write(p)
+}
+
+// Read the copy from its start, once it is rewound
+func (s *spoolBuffer) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// Stop writing the copy and go back to its start for reading
+func (s *spoolBuffer) rewind() error {
+	if s.file == nil {
+		s.reader = bytes.NewReader(s.memory.Bytes())
+		return nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader = s.file
+	return nil
+}
+
+// Release the memory of the copy and remove its spool file
+func (s *spoolBuffer) Close() error {
+	s.memory = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.path)
+}
@@ -13,6 +13,9 @@ if [ ! -f "$CADDY_PATH" ]; then
     exit 1
 fi
 
+# The root must exist for caddy to accept the config
+mkdir -p tests/root/
+
 # Start caddy in the backgound
 ./caddy run --config tests/assets/config.json > tests/caddy-stdout.log 2> tests/caddy-stderr.log &
 CADDY_PID=$!
@@ -67,7 +70,7 @@ assert_success "04-delete-file"
 
 # TEST 5: Delete directory
 tar -xf tests/assets/test.tar  -C tests/root/
-curl -XDELETE ${API}/tested/with-file/
+curl -XDELETE -H "X-Recursive: true" ${API}/tested/with-file/
 assert_success "05-delete-directory"
 
 if [ "$OUTPUT" -eq 0 ]; then
@@ -0,0 +1,76 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Cause of the cancellation of bodies read for longer than ReadTimeout
+var errReadTimeout = errors.New("request body read timed out")
+
+// Cause of the cancellation of deploys lasting longer than their X-Deploy-Timeout
+var errDeployTimeout = errors.New("deploy timed out")
+
+// Fail the reads of a body once ctx is done. It only checks between reads, a read
+// blocked on the connection is interrupted by its read deadline.
+type timeoutReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if err := context.Cause(t.ctx); err != nil {
+		return 0, err
+	}
+	return t.ReadCloser.Read(p)
+}
+
+// Bound the time spent reading the body of r to ReadTimeout so that a client trickling
+// bytes cannot hold the locks of its targets forever. The returned function releases
+// the timer.
+func (wfs *WritableFileServer) limitReadTime(w http.ResponseWriter, r *http.Request) func() {
+	if wfs.ReadTimeout <= 0 || r.Body == nil {
+		return func() {}
+	}
+	timeout := time.Duration(wfs.ReadTimeout)
+
+	// Not every ResponseWriter supports deadlines, the context still bounds the reads
+	_ = http.NewResponseController(w).SetReadDeadline(time.Now().Add(timeout))
+
+	ctx, cancel := context.WithTimeoutCause(r.Context(), timeout, errReadTimeout)
+	r.Body = &timeoutReader{r.Body, ctx}
+	return cancel
+}
+
+// Return the duration the client gives to the extraction of its upload with the
+// `X-Deploy-Timeout` header, capped to MaxDeployTimeout, or 0 if it did not set one
+func (wfs *WritableFileServer) deployTimeout(r *http.Request) (time.Duration, *ErrorDeployement) {
+	header := r.Header.Get("X-Deploy-Timeout")
+	if header == "" {
+		return 0, nil
+	}
+	timeout, err := caddy.ParseDuration(header)
+	if err != nil || timeout <= 0 {
+		return 0, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid deploy timeout %q: %v", header, err),
+			"invalid X-Deploy-Timeout header: must be a positive duration like '30s'",
+		}
+	}
+	if wfs.MaxDeployTimeout > 0 {
+		timeout = min(timeout, time.Duration(wfs.MaxDeployTimeout))
+	}
+	return timeout, nil
+}
+
+// Return true if err comes from a body read interrupted by limitReadTime
+func isReadTimeout(err error) bool {
+	return errors.Is(err, errReadTimeout) || errors.Is(err, os.ErrDeadlineExceeded)
+}
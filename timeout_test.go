@@ -0,0 +1,187 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Trickle one byte at a time, forever
+type slowReader struct {
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	p[0] = 'a'
+	return 1, nil
+}
+
+func TestReadTimeout(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ReadTimeout = caddy.Duration(100 * time.Millisecond)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", &slowReader{10 * time.Millisecond})
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusRequestTimeout, errHandler.StatusCode)
+	assert.Equal(t, "request body was not received within 100ms\n", w.Body.String())
+
+	// Nothing is left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestReadTimeoutReleasesLock(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ReadTimeout = caddy.Duration(100 * time.Millisecond)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", &slowReader{10 * time.Millisecond})
+	assert.Error(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+
+	// A later upload of the same path goes through
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestReadTimeoutNotReached(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.ReadTimeout = caddy.Duration(time.Second)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestMaxLockWait(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxLockWait = caddy.Duration(100 * time.Millisecond)
+
+	// A long deploy of the same path holds the lock
+	unlock := locks.Lock(wfs.Root, wfs.Root+"/test.txt")
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, errHandler.StatusCode)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, "another deploy of this path is in progress, retry later\n", w.Body.String())
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+
+	// Once the lock is released the upload goes through
+	unlock()
+	r, _ = http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	w = httptest.NewRecorder()
+	assert.NoError(t, wfs.ServeHTTP(w, r, &MockHandler{}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestDeployTimeoutFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("original"), FILE_PERM)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", &slowReader{10 * time.Millisecond})
+	r.Header.Set("X-Deploy-Timeout", "100ms")
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusGatewayTimeout, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.Equal(t, "deploy did not complete within 100ms\n", w.Body.String())
+
+	// The previous version is left in place
+	data, _ := os.ReadFile(wfs.Root + "/test.txt")
+	assert.Equal(t, "original", string(data))
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestDeployTimeoutDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.MaxDeployTimeout = caddy.Duration(100 * time.Millisecond)
+	os.MkdirAll(wfs.Root+"/site", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/index.html", []byte("original"), FILE_PERM)
+
+	// The archive announces a large file whose content trickles in
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "large.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: 1 << 20})
+	body := io.MultiReader(&archive, &slowReader{10 * time.Millisecond})
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", body)
+	r.Header.Set("Content-Type", "application/x-tar")
+	r.Header.Set("X-Deploy-Timeout", "1h")
+
+	start := time.Now()
+	err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusGatewayTimeout, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	// Capped to MaxDeployTimeout
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	data, _ := os.ReadFile(wfs.Root + "/site/index.html")
+	assert.Equal(t, "original", string(data))
+	entries, _ := os.ReadDir(wfs.Root)
+	assert.Len(t, entries, 1)
+}
+
+func TestDeployTimeoutInvalid(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	for _, header := range []string{"soon", "-1s", "0"} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+		r.Header.Set("X-Deploy-Timeout", header)
+
+		err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+		if assert.Error(t, err, header) {
+			assert.Equal(t, http.StatusBadRequest, err.(caddyhttp.HandlerError).StatusCode, header)
+		}
+	}
+	assert.NoFileExists(t, wfs.Root+"/test.txt")
+
+	// A deploy within its timeout goes through
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+	r.Header.Set("X-Deploy-Timeout", "1m")
+	assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}))
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
@@ -0,0 +1,224 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Directory of the root where soft deleted paths are moved when TrashDir is not set
+const TRASH_DIR = ".trash"
+
+// Separator between the name of a trashed path and the time of its deletion
+const TRASH_SUFFIX = ".deleted-"
+
+// Return true if the client asked to move target to the trash instead of removing it,
+// with the `soft=1` query
+func isSoftDelete(r *http.Request) (bool, *ErrorDeployement) {
+	if !r.URL.Query().Has("soft") {
+		return false, nil
+	}
+	if soft := r.URL.Query().Get("soft"); soft != "1" {
+		return false, &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid soft query: %s", soft),
+			"invalid soft query: must be '1'",
+		}
+	}
+	return true, nil
+}
+
+// Return the trash directory of root
+func (wfs *WritableFileServer) trashPath(root string) string {
+	if wfs.TrashDir == "" {
+		return filepath.Join(root, TRASH_DIR)
+	}
+	return filepath.Join(root, wfs.TrashDir)
+}
+
+// Return the path where target, deleted at t, is kept in trash. It has the same path
+// relative to trash as target to root, with a timestamp suffix.
+func getTrashedPath(root string, trash string, target string, t time.Time) string {
+	rel, _ := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	return filepath.Join(trash, rel) + TRASH_SUFFIX + t.UTC().Format(BACKUP_TIME_LAYOUT)
+}
+
+// Return the trashed versions of target, oldest first
+func listTrashed(root string, trash string, target string) ([]string, error) {
+	rel, _ := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	dir := filepath.Dir(filepath.Join(trash, rel))
+	prefix := filepath.Base(rel) + TRASH_SUFFIX
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trashed := []string{}
+	for _, entry := range entries {
+		timestamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(BACKUP_TIME_LAYOUT, timestamp); err != nil {
+			continue
+		}
+		trashed = append(trashed, filepath.Join(dir, entry.Name()))
+	}
+	slices.Sort(trashed)
+	return trashed, nil
+}
+
+// Move target to the trash of root, then prune the trash according to TrashKeep and
+// TrashMaxAge
+func (wfs *WritableFileServer) moveToTrash(root string, target string) *ErrorDeployement {
+	trash := wfs.trashPath(root)
+	target = filepath.Clean(target)
+	if target == filepath.Clean(root) || isWithin(trash, target) {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to move %s to the trash", target),
+			"the root and the trash cannot be moved to the trash",
+		}
+	}
+	return wfs.trashAs(root, target, target)
+}
+
+// Move path to the trash of root as a deleted version of target, then prune the trash
+// according to TrashKeep and TrashMaxAge
+func (wfs *WritableFileServer) trashAs(root string, path string, target string) *ErrorDeployement {
+	trash := wfs.trashPath(root)
+	trashed := getTrashedPath(root, trash, target, time.Now())
+	if err := os.MkdirAll(filepath.Dir(trashed), wfs.dirPerm); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create trash directory for %s: %w", trashed, err),
+			"",
+		}
+	}
+	if err := rename(path, trashed); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		return &ErrorDeployement{status, fmt.Errorf("failed to move %s to the trash: %w", path, err), ""}
+	}
+
+	// The deletion is done, a failed pruning is only retried on the next one
+	if err := wfs.pruneTrash(root, trash, target); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to prune trash", zap.String("trash", trash), zap.Error(err))
+	}
+	return nil
+}
+
+// Keep at most TrashKeep versions of target in trash and remove every trashed path
+// older than TrashMaxAge
+func (wfs *WritableFileServer) pruneTrash(root string, trash string, target string) error {
+	if wfs.TrashKeep > 0 {
+		trashed, err := listTrashed(root, trash, target)
+		if err != nil {
+			return err
+		}
+		for len(trashed) > wfs.TrashKeep {
+			if err := os.RemoveAll(trashed[0]); err != nil {
+				return err
+			}
+			trashed = trashed[1:]
+		}
+	}
+
+	if wfs.TrashMaxAge == 0 {
+		return nil
+	}
+	oldest := time.Now().Add(-time.Duration(wfs.TrashMaxAge))
+	return filepath.WalkDir(trash, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		index := strings.LastIndex(entry.Name(), TRASH_SUFFIX)
+		if index < 0 {
+			return nil
+		}
+		deleted, err := time.Parse(BACKUP_TIME_LAYOUT, entry.Name()[index+len(TRASH_SUFFIX):])
+		if err != nil {
+			return nil
+		}
+		if deleted.Before(oldest) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		// The content of a trashed directory is not trashed on its own
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Bring the newest trashed version of target back into place. On success it returns
+// 201 Created.
+func (wfs *WritableFileServer) restoreTrashed(id string, root string, target string) (int, *ErrorDeployement) {
+	target = filepath.Clean(target)
+	trashed, err := listTrashed(root, wfs.trashPath(root), target)
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to list trashed versions of %s: %w", target, err),
+			"",
+		}
+	}
+	if len(trashed) == 0 {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("no trashed version of %s", target),
+			"nothing to restore from the trash",
+		}
+	}
+
+	// A path deployed since its deletion is not discarded
+	if _, err := os.Lstat(target); err == nil {
+		return 0, &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("trying to restore %s over an existing path", target),
+			"target exists: delete it before restoring it from the trash",
+		}
+	}
+
+	// The trash is inside the root so its bytes are already counted in its usage, but
+	// a root over the quota, lowered since the deletion, gets nothing back
+	if errQuota := wfs.checkQuotaSize(id, root, "", 0); errQuota != nil {
+		return 0, errQuota
+	}
+
+	newest := trashed[len(trashed)-1]
+	if err := os.MkdirAll(filepath.Dir(target), wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create parent of %s: %w", target, err),
+			"",
+		}
+	}
+	if err := rename(newest, target); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to restore %s from the trash: %w", newest, err),
+			"",
+		}
+	}
+
+	wfs.logger.Log(zapcore.InfoLevel, "restored from trash", zap.String("target", target))
+	return http.StatusCreated, nil
+}
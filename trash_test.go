@@ -0,0 +1,216 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a DELETE of path with headers
+func deletePath(wfs *WritableFileServer, path string, headers map[string]string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", path, nil)
+	for header, value := range headers {
+		r.Header.Add(header, value)
+	}
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestSoftDelete(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.MkdirAll(wfs.Root+"/site/nested", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/nested/test.txt", []byte("teeest"), FILE_PERM)
+
+	w, err := deletePath(wfs, "/site/nested/test.txt?soft=1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NoFileExists(t, wfs.Root+"/site/nested/test.txt")
+
+	w, err = deletePath(wfs, "/site/?soft=1", map[string]string{"X-Recursive": "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NoDirExists(t, wfs.Root+"/site")
+
+	// Both are moved to the trash instead of being removed
+	files, _ := filepath.Glob(wfs.Root + "/.trash/site/nested/test.txt.deleted-*")
+	if assert.Len(t, files, 1) {
+		data, err := os.ReadFile(files[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "teeest", string(data))
+	}
+	dirs, _ := filepath.Glob(wfs.Root + "/.trash/site.deleted-*")
+	if assert.Len(t, dirs, 1) {
+		assertDirectoryExist(t, dirs[0]+"/nested")
+	}
+}
+
+func TestSoftDeleteInvalid(t *testing.T) {
+	var tests = map[string]struct {
+		path   string
+		status int
+	}{
+		"invalid query": {"/test.txt?soft=yes", http.StatusBadRequest},
+		"missing":       {"/missing.txt?soft=1", http.StatusNotFound},
+		"trash":         {"/.trash/?soft=1", http.StatusForbidden},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+			os.WriteFile(wfs.Root+"/test.txt", []byte("teeest"), FILE_PERM)
+			os.MkdirAll(wfs.Root+"/.trash", DIR_PERM)
+
+			_, err := deletePath(wfs, test.path, nil)
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+			assertFileExist(t, wfs.Root+"/test.txt")
+			assertDirectoryExist(t, wfs.Root+"/.trash")
+		})
+	}
+}
+
+// Send a PUT restoring path from the trash
+func restoreFromTrash(wfs *WritableFileServer, path string) (*httptest.ResponseRecorder, error) {
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", path+"?restore=trash", nil)
+
+	w := httptest.NewRecorder()
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	return w, err
+}
+
+func TestTrashDir(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.TrashDir = ".deleted"
+
+	for _, content := range []string{"first", "second"} {
+		os.WriteFile(wfs.Root+"/test.txt", []byte(content), FILE_PERM)
+		w, err := deletePath(wfs, "/test.txt", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.NoFileExists(t, wfs.Root+"/test.txt")
+	}
+	files, _ := filepath.Glob(wfs.Root + "/.deleted/test.txt.deleted-*")
+	assert.Len(t, files, 2)
+
+	// A path that exists is never replaced
+	os.WriteFile(wfs.Root+"/test.txt", []byte("third"), FILE_PERM)
+	_, err := restoreFromTrash(wfs, "/test.txt")
+	errHandler, ok := err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	os.Remove(wfs.Root + "/test.txt")
+
+	// The newest version comes back first
+	for _, content := range []string{"second", "first"} {
+		w, err := restoreFromTrash(wfs, "/test.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		data, err := os.ReadFile(wfs.Root + "/test.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data))
+
+		os.Remove(wfs.Root + "/test.txt")
+	}
+
+	_, err = restoreFromTrash(wfs, "/test.txt")
+	errHandler, ok = err.(caddyhttp.HandlerError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, errHandler.StatusCode)
+}
+
+func TestTrashDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.TrashDir = ".deleted"
+	os.MkdirAll(wfs.Root+"/site/nested", DIR_PERM)
+	os.WriteFile(wfs.Root+"/site/nested/test.txt", []byte("teeest"), FILE_PERM)
+
+	_, err := deletePath(wfs, "/site/", map[string]string{"X-Recursive": "true"})
+	assert.NoError(t, err)
+	assert.NoDirExists(t, wfs.Root+"/site")
+
+	w, err := restoreFromTrash(wfs, "/site/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/site/nested/test.txt")
+}
+
+func TestTrashPrune(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.TrashDir = ".deleted"
+	wfs.TrashKeep = 2
+	wfs.TrashMaxAge = caddy.Duration(time.Hour)
+
+	// Expired versions of any path are removed
+	old := getTrashedPath(wfs.Root, wfs.Root+"/.deleted", wfs.Root+"/dir/old.txt", time.Now().Add(-2*time.Hour))
+	os.MkdirAll(filepath.Dir(old), DIR_PERM)
+	os.WriteFile(old, []byte("old"), FILE_PERM)
+
+	for range 3 {
+		os.WriteFile(wfs.Root+"/test.txt", []byte("teeest"), FILE_PERM)
+		_, err := deletePath(wfs, "/test.txt", nil)
+		assert.NoError(t, err)
+	}
+
+	files, _ := filepath.Glob(wfs.Root + "/.deleted/test.txt.deleted-*")
+	assert.Len(t, files, 2)
+	assert.NoFileExists(t, old)
+}
+
+func TestTrashReserved(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	wfs.EnableRead = true
+	os.WriteFile(wfs.Root+"/test.txt", []byte("teeest"), FILE_PERM)
+	_, err := deletePath(wfs, "/test.txt?soft=1", nil)
+	assert.NoError(t, err)
+	files, _ := filepath.Glob(wfs.Root + "/.trash/test.txt.deleted-*")
+	if !assert.Len(t, files, 1) {
+		return
+	}
+
+	// The trash is neither served nor written to
+	rel, _ := filepath.Rel(wfs.Root, files[0])
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, method, "/"+filepath.ToSlash(rel), nil)
+		err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+		errHandler, ok := err.(caddyhttp.HandlerError)
+		assert.True(t, ok, method)
+		assert.Equal(t, http.StatusForbidden, errHandler.StatusCode, method)
+	}
+	assertFileExist(t, files[0])
+}
+
+func TestTrashKeptOnRootDeploy(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	os.WriteFile(wfs.Root+"/test.txt", []byte("teeest"), FILE_PERM)
+	_, err := deletePath(wfs, "/test.txt?soft=1", nil)
+	assert.NoError(t, err)
+
+	// A deploy of the whole site replaces the root but not its trash
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	err = wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+	assert.NoError(t, err)
+	assertDirectoryExist(t, wfs.Root+"/tested")
+
+	w, err := restoreFromTrash(wfs, "/test.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assertFileExist(t, wfs.Root+"/test.txt")
+}
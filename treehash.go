@@ -0,0 +1,194 @@
+package caddy_writable_file_server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Entity tags of live directories, shared by every instance of the handler like the
+// disk usages
+var treeETags = newTreeETagCache()
+
+// A cached entity tag of a directory, valid while the fingerprint of its tree is
+// unchanged
+type treeETag struct {
+	fingerprint string
+	etag        string
+}
+
+// Cache the entity tags of live directories so that a tree is only hashed again after a
+// write
+type treeETagCache struct {
+	mu    sync.Mutex
+	etags map[string]treeETag
+}
+
+func newTreeETagCache() *treeETagCache {
+	return &treeETagCache{etags: map[string]treeETag{}}
+}
+
+// Return the entity tag of the directory dir of root, hashing its tree if it is not
+// cached or if one of its entries was modified since. The tree is hashed without
+// holding the cache, so that the deploys of other directories do not wait on it.
+func (wfs *WritableFileServer) treeETag(root string, dir string) (string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	// Listing the names, sizes and times of the tree is much cheaper than hashing it,
+	// and it catches changes deep in the tree that leave dir itself untouched
+	fingerprint, err := wfs.fingerprintTree(root, dir)
+	if err != nil {
+		return "", err
+	}
+
+	treeETags.mu.Lock()
+	cached, ok := treeETags.etags[dir]
+	treeETags.mu.Unlock()
+	if ok && cached.fingerprint == fingerprint {
+		return cached.etag, nil
+	}
+
+	etag, err := wfs.hashTree(root, dir)
+	if err != nil {
+		return "", err
+	}
+	treeETags.mu.Lock()
+	treeETags.etags[dir] = treeETag{fingerprint, etag}
+	treeETags.mu.Unlock()
+	return etag, nil
+}
+
+// Forget the entity tags of the directories under root, to be called after each write
+func (c *treeETagCache) invalidate(root string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for dir := range c.etags {
+		if isWithin(root, dir) {
+			delete(c.etags, dir)
+		}
+	}
+}
+
+// Call fn for each entry of the tree of dir that came from an upload, with its slash
+// separated name relative to dir. The files written by the handler next to them, the
+// compressed copies of PrecompressGzip and PrecompressBrotli and the checksum manifest
+// of GenerateManifest, are skipped like the directories of the handler.
+func (wfs *WritableFileServer) walkUploaded(root string, dir string, fn func(name string, path string, entry fs.DirEntry) error) error {
+	reserved := wfs.reservedPaths(root)
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		if entry.IsDir() && slices.Contains(reserved, path) {
+			return filepath.SkipDir
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(path, dir+string(os.PathSeparator)))
+		if wfs.GenerateManifest && name == filepath.ToSlash(filepath.Clean(wfs.ManifestFile)) {
+			return nil
+		}
+		if entry.Type().IsRegular() && wfs.isPrecompressed(path) {
+			return nil
+		}
+		return fn(name, path, entry)
+	})
+}
+
+// Return true if path is a compressed copy written by a precompressor next to its file
+func (wfs *WritableFileServer) isPrecompressed(path string) bool {
+	for _, p := range wfs.precompressors() {
+		original, ok := strings.CutSuffix(path, p.extension)
+		if !ok || !wfs.shouldPrecompress(original) {
+			continue
+		}
+		if info, err := os.Lstat(original); err == nil && info.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a digest of the names, types, sizes and modification times of the uploaded
+// entries of the tree of dir
+func (wfs *WritableFileServer) fingerprintTree(root string, dir string) (string, error) {
+	hash := sha256.New()
+	err := wfs.walkUploaded(root, dir, func(name string, path string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%d\x00%d\n", name, info.Mode().Type(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatETag(hash.Sum(nil)), nil
+}
+
+// Return the entity tag of the uploaded entries of the tree of dir, computed like the
+// one of the archive they were extracted from
+func (wfs *WritableFileServer) hashTree(root string, dir string) (string, error) {
+	hashes := entryHashes{}
+	err := wfs.walkUploaded(root, dir, func(name string, path string, entry fs.DirEntry) error {
+		switch {
+		case entry.IsDir():
+			hashes.addDir(name)
+		case entry.Type()&fs.ModeSymlink != 0:
+			linkname, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256([]byte(linkname))
+			hashes.addFile(name, sum[:])
+		case entry.Type().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			hash := sha256.New()
+			if _, err := io.Copy(hash, file); err != nil {
+				return err
+			}
+			hashes.addFile(name, hash.Sum(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hashes.etag(), nil
+}
+
+// Return the entity tag of the directory target if the client announced it with the
+// `X-Content-Digest` header, so that the deploy can be skipped, or "" otherwise. The
+// tag is the one of a previous directory upload, with or without its quotes. In merge
+// mode the files left from previous deploys are not part of the upload, so the tree can
+// never be compared and the deploy always runs.
+func (wfs *WritableFileServer) deployedETag(r *http.Request, root string, target string, mode string) (string, *ErrorDeployement) {
+	digest := strings.TrimSpace(r.Header.Get("X-Content-Digest"))
+	if digest == "" || mode == DEPLOY_MODE_MERGE {
+		return "", nil
+	}
+	etag, err := wfs.treeETag(root, filepath.Clean(target))
+	if err != nil {
+		return "", &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to hash the tree of %s: %w", target, err),
+			"",
+		}
+	}
+	if etag != `"`+strings.Trim(digest, `"`)+`"` {
+		return "", nil
+	}
+	return etag, nil
+}
@@ -5,17 +5,31 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const ID_LENGTH = 8
 
+// Rename a path. It is a variable so that tests can simulate filesystem failures.
+var rename = os.Rename
+
 // Delete any file or directory that was deployed and try to restore backup
-func rollback(id string, target string) error {
+func rollback(targetbackup string, target string) error {
 	// Check backup exist
-	targetbackup := getBackupPath(id, target)
 	_, err := os.Stat(targetbackup)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil // No backup to rollback
@@ -31,7 +45,7 @@ func rollback(id string, target string) error {
 	}
 
 	// Then we restore the original directory
-	err = os.Rename(targetbackup, target)
+	err = rename(targetbackup, target)
 	if err != nil {
 		return fmt.Errorf("could not restore backup during rollback: %w", err)
 	}
@@ -39,12 +53,27 @@ func rollback(id string, target string) error {
 	return nil
 }
 
+// Resolve the URL path of a request to its absolute target under root. The boolean is
+// true if the target denotes a directory, in which case it ends with a slash: the URL
+// path has a trailing slash, or it resolves to the root which can only be a directory.
+//
+// SanitizedPathJoin only keeps the trailing slash for paths below the root, so it is
+// derived here from the URL path instead.
+func resolveTarget(root string, urlPath string) (string, bool) {
+	target := filepath.Clean(caddyhttp.SanitizedPathJoin(root, urlPath))
+	isDir := strings.HasSuffix(urlPath, "/") || target == filepath.Clean(root)
+	if isDir {
+		target = strings.TrimSuffix(target, "/") + "/"
+	}
+	return target, isDir
+}
+
 // Return a backup path next to the target.
 //
 // Using a path next to the target ensure it is on the same file system, allowing us
 // to use os.Rename for atomic update. (/tmp is often on a RAM file system)
 //
-// This function does not check if the temporary path is already used.
+// This function does not check if the path is already used, see freshId.
 func getBackupPath(id string, target string) string {
 	if strings.HasSuffix(target, "/") {
 		return strings.TrimSuffix(target, "/") + "." + id + "-backup/"
@@ -57,7 +86,7 @@ func getBackupPath(id string, target string) string {
 // Using a path next to the target ensure it is on the same file system, allowing us
 // to use os.Rename for atomic update. (/tmp is often on a RAM file system)
 //
-// This function does not check if the temporary path is already used.
+// This function does not check if the path is already used, see freshId.
 func getTempPath(id string, target string) string {
 	if strings.HasSuffix(target, "/") {
 		return strings.TrimSuffix(target, "/") + "-" + id + "-tmp/"
@@ -65,6 +94,483 @@ func getTempPath(id string, target string) string {
 	return target + "-" + id + "-tmp"
 }
 
+// Return the path next to which the artifacts of target are placed: target itself, or
+// its name in the staging directory of root when one is configured. The root cannot be
+// staged inside itself so its artifacts always stay next to it.
+func (wfs *WritableFileServer) stagedPath(root string, target string) string {
+	if wfs.StagingDir == "" || filepath.Clean(target) == filepath.Clean(root) {
+		return target
+	}
+	staged := filepath.Join(wfs.stagingPath(root), filepath.Base(target))
+	if strings.HasSuffix(target, "/") {
+		staged += "/"
+	}
+	return staged
+}
+
+// Return the staging directory of root, or an empty string when it is not configured
+func (wfs *WritableFileServer) stagingPath(root string) string {
+	if wfs.StagingDir == "" {
+		return ""
+	}
+	return filepath.Join(root, wfs.StagingDir)
+}
+
+// Return the backup path of target, see getBackupPath and stagedPath
+func (wfs *WritableFileServer) backupPath(id string, root string, target string) string {
+	return getBackupPath(id, wfs.stagedPath(root, target))
+}
+
+// Return the temporary path of target, see getTempPath and stagedPath
+func (wfs *WritableFileServer) tempPath(id string, root string, target string) string {
+	return getTempPath(id, wfs.stagedPath(root, target))
+}
+
+// Refuse a root outside of BaseRoot, or the base itself, like a root built from a user
+// id containing `..` or from an empty one
+func (wfs *WritableFileServer) checkBaseRoot(root string) *ErrorDeployement {
+	if wfs.BaseRoot == "" {
+		return nil
+	}
+	base, errBase := filepath.Abs(wfs.BaseRoot)
+	abs, errRoot := filepath.Abs(root)
+	if err := errors.Join(errBase, errRoot); err != nil {
+		return &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to resolve root %s under base_root %s: %w", root, wfs.BaseRoot, err),
+			"",
+		}
+	}
+	rel, err := filepath.Rel(base, abs)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return &ErrorDeployement{
+			http.StatusForbidden,
+			fmt.Errorf("root %s outside of base_root %s", root, wfs.BaseRoot),
+			"the root of the request is outside of the base root",
+		}
+	}
+	return nil
+}
+
+// Return the directories of root owned by the handler: the trash, the staging directory
+// and the ones of the resumable uploads and of the retained backups
+func (wfs *WritableFileServer) reservedPaths(root string) []string {
+	paths := []string{wfs.trashPath(root), wfs.partialsPath(root), wfs.backupsPath(root)}
+	if staging := wfs.stagingPath(root); staging != "" {
+		paths = append(paths, staging)
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// Return true if path is inside one of the directories owned by the handler
+func (wfs *WritableFileServer) isReserved(root string, path string) bool {
+	for _, reserved := range wfs.reservedPaths(root) {
+		if isWithin(reserved, filepath.Clean(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse requests on the directories owned by the handler, their content belongs to
+// the deploys and uploads in progress or is only reached through the restore query
+func (wfs *WritableFileServer) checkNotReserved(root string, target string) *ErrorDeployement {
+	if wfs.isReserved(root, target) {
+		return &ErrorDeployement{
+			http.StatusForbidden,
+			fmt.Errorf("target inside a reserved directory: %s", target),
+			"the directories of the handler are reserved",
+		}
+	}
+	return nil
+}
+
+// Refuse writes and deletes of a path matching ProtectedPaths, or inside one
+func (wfs *WritableFileServer) checkNotProtected(root string, target string) *ErrorDeployement {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	if err != nil || rel == "." {
+		return nil
+	}
+	if matchEntry(wfs.ProtectedPaths, filepath.ToSlash(rel)) {
+		return &ErrorDeployement{
+			http.StatusForbidden,
+			fmt.Errorf("target is protected: %s", target),
+			"the target is protected",
+		}
+	}
+	return nil
+}
+
+// Refuse files whose name ends with one of DeniedExtensions
+func (wfs *WritableFileServer) checkExtension(name string) *ErrorDeployement {
+	lower := strings.ToLower(name)
+	for _, ext := range wfs.DeniedExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return &ErrorDeployement{
+				http.StatusForbidden,
+				fmt.Errorf("denied extension %s: %s", ext, name),
+				fmt.Sprintf("files with the extension %s are not allowed", ext),
+			}
+		}
+	}
+	return nil
+}
+
+// Return the number of components of target below root, 0 for the root itself
+func pathDepth(root string, target string) int {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(filepath.ToSlash(rel), "/") + 1
+}
+
+// Refuse targets nested deeper than MaxPathDepth below root
+func (wfs *WritableFileServer) checkPathDepth(root string, target string) *ErrorDeployement {
+	if wfs.MaxPathDepth == 0 || pathDepth(root, target) <= wfs.MaxPathDepth {
+		return nil
+	}
+	return &ErrorDeployement{
+		http.StatusBadRequest,
+		fmt.Errorf("target %s is deeper than %d components", target, wfs.MaxPathDepth),
+		fmt.Sprintf("path exceeds the maximum depth of %d", wfs.MaxPathDepth),
+	}
+}
+
+// Return the error of a write to target failing because one of its parents is a file.
+// The conflicting parent is named relative to root so that the server paths are not
+// leaked.
+func errFileParent(root string, target string, err error) *ErrorDeployement {
+	root = filepath.Clean(root)
+	parent := filepath.Dir(filepath.Clean(target))
+	for isWithin(root, parent) && parent != root {
+		if info, errStat := os.Stat(parent); errStat == nil && !info.IsDir() {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+
+	rel, errRel := filepath.Rel(root, parent)
+	if errRel != nil || rel == "." {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("a parent of target %s is a file: %w", target, err),
+			"a parent of the target is a file",
+		}
+	}
+	return &ErrorDeployement{
+		http.StatusConflict,
+		fmt.Errorf("the parent %s of target %s is a file: %w", parent, target, err),
+		fmt.Sprintf("a parent of the target is a file: /%s", filepath.ToSlash(rel)),
+	}
+}
+
+// Check that a path of staging can be renamed into root, which is only possible on the
+// same file system
+func checkSameFilesystem(root string, staging string) error {
+	file, err := os.CreateTemp(staging, ".rename-check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", staging, err)
+	}
+	file.Close()
+
+	renamed := filepath.Join(root, filepath.Base(file.Name()))
+	if err := rename(file.Name(), renamed); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("%s is not on the same file system as %s: %w", staging, root, err)
+	}
+	return os.Remove(renamed)
+}
+
+// Match the names produced by getTempPath and getBackupPath, and the spool files of
+// temporary paths
+var artifactPattern = regexp.MustCompile(fmt.Sprintf(
+	`^(.+)(-[A-Za-z0-9_-]{%d}-tmp(?:\.spool)?|\.[A-Za-z0-9_-]{%[1]d}-backup)$`,
+	base64.RawURLEncoding.EncodedLen(ID_LENGTH),
+))
+
+// Remove the temporary and backup paths left behind by deploys that were interrupted,
+// both inside root and next to it. Return the removed paths.
+//
+// It must not run while a deploy is in progress.
+func cleanStaleArtifacts(root string) ([]string, error) {
+	root = filepath.Clean(root)
+	removed := []string{}
+
+	// Deploys of the root itself use paths next to it
+	siblings, err := os.ReadDir(filepath.Dir(root))
+	if err != nil {
+		return removed, err
+	}
+	for _, entry := range siblings {
+		match := artifactPattern.FindStringSubmatch(entry.Name())
+		if match == nil || match[1] != filepath.Base(root) {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(root), entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || !artifactPattern.MatchString(entry.Name()) {
+			return nil
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Move the directories of the handler from previous, the version of root set aside by
+// a swap of the whole root, into the new root so that a deploy of the site keeps the
+// trash, the retained backups and the uploads in progress. What the new version holds
+// in their place is discarded.
+func (wfs *WritableFileServer) carryOverReserved(root string, previous string) error {
+	var errs []error
+	for _, reserved := range wfs.reservedPaths(root) {
+		rel, err := filepath.Rel(filepath.Clean(root), reserved)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		old := filepath.Join(previous, rel)
+		if _, err := os.Lstat(old); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := os.RemoveAll(reserved); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(reserved), wfs.dirPerm); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := rename(old, reserved); err != nil {
+			errs = append(errs, fmt.Errorf("failed to carry over %s: %w", old, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Copy the tree at src into dst, keeping the entries that already exist in dst. The
+// paths of skip are not copied.
+//
+// Modes and file modification times are preserved, symlinks are copied as is and other
+// special files are ignored.
+func copyTree(src string, dst string, skip ...string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if slices.Contains(skip, path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		dstInfo, err := os.Lstat(dstPath)
+		if err == nil {
+			// Directories are merged, anything else already in dst wins
+			if entry.IsDir() && !dstInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.Mkdir(dstPath, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			if err := copyFile(path, dstPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dstPath)
+		default:
+			return nil
+		}
+		return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+	})
+}
+
+// Names of the devices of Windows, which are opened instead of a file whatever the
+// directory and extension
+var windowsReservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Return true if a component of the slash separated path p is a Windows device name,
+// like `CON`, `aux.txt` or `nul.tar.gz`
+func hasWindowsReservedName(p string) bool {
+	for _, component := range strings.Split(p, "/") {
+		stem, _, _ := strings.Cut(component, ".")
+		stem = strings.TrimRight(stem, " ") // Windows ignores trailing spaces, sigh
+		for _, reserved := range windowsReservedNames {
+			if strings.EqualFold(stem, reserved) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Copy the content of the regular file src into a new file dst
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Flush the entries of the directory at path to disk
+func syncDirectory(path string) error {
+	// Directories cannot be opened for syncing on Windows
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// Flush the entries of root and of all the directories it contains to disk
+func syncDirectories(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
+		}
+		return syncDirectory(path)
+	})
+}
+
+// Return an error if path is not an existing directory we can write into.
+func checkWritableDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	file, err := os.CreateTemp(path, ".writable-check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", path, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Parse an octal permission string such as "0755".
+func parsePerm(perm string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(perm, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not an octal number", perm)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("'%s' is out of range (0000-0777)", perm)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Generate the id of a request. It is a variable so that tests can force collisions.
+var newId = GetId
+
+// The number of new ids tried when the artifact paths of one are already used
+const ID_RETRIES = 5
+
+// Return id, or a new one if the temporary, spool or backup path it gives to one of the
+// targets already exists, like the leftovers of a crashed deploy with the same id.
+// Reusing them would clobber them or fail confusingly.
+func (wfs *WritableFileServer) freshId(id string, root string, targets ...string) (string, *ErrorDeployement) {
+	for retries := 0; ; retries++ {
+		used := wfs.usedArtifactPath(id, root, targets)
+		if used == "" {
+			return id, nil
+		}
+		if retries == ID_RETRIES {
+			return "", &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("artifact paths already exist after %d new ids, like %s", ID_RETRIES, used),
+				"",
+			}
+		}
+		wfs.logger.Log(zapcore.WarnLevel, "deploy artifact already exists, changing id", zap.String("id", id), zap.String("path", used))
+		id = newId()
+	}
+}
+
+// Return the first artifact path of id for targets that already exists, or ""
+func (wfs *WritableFileServer) usedArtifactPath(id string, root string, targets []string) string {
+	for _, target := range targets {
+		temp := wfs.tempPath(id, root, target)
+		paths := []string{temp, strings.TrimSuffix(temp, "/") + SPOOL_SUFFIX, wfs.backupPath(id, root, target)}
+		for _, path := range paths {
+			if _, err := os.Lstat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
 func GetId() string {
 	b := make([]byte, ID_LENGTH)
 	_, err := rand.Read(b)
@@ -73,3 +579,22 @@ func GetId() string {
 	}
 	return base64.RawURLEncoding.EncodeToString(b)
 }
+
+// Refuse a directory about to go live if one of RequireFiles is missing from it
+func (wfs *WritableFileServer) checkRequiredFiles(dir string) *ErrorDeployement {
+	missing := []string{}
+	for _, file := range wfs.RequireFiles {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil || info.IsDir() {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return &ErrorDeployement{
+		http.StatusUnprocessableEntity,
+		fmt.Errorf("deploy of %s is missing required files: %v", dir, missing),
+		fmt.Sprintf("missing required files: %s", strings.Join(missing, ", ")),
+	}
+}
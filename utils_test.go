@@ -1,11 +1,47 @@
 package caddy_writable_file_server
 
 import (
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func TestResolveTarget(t *testing.T) {
+	var tests = []struct {
+		urlPath string
+		target  string
+		isDir   bool
+	}{
+		{"", "/srv/", true},
+		{"/", "/srv/", true},
+		{"/..", "/srv/", true},
+		{"/foo", "/srv/foo", false},
+		{"/foo/", "/srv/foo/", true},
+		{"/foo/bar/baz.txt", "/srv/foo/bar/baz.txt", false},
+		{"/foo/bar/", "/srv/foo/bar/", true},
+		{"/foo/../bar", "/srv/bar", false},
+		{"//foo//bar//", "/srv/foo/bar/", true},
+	}
+
+	for _, test := range tests {
+		target, isDir := resolveTarget("/srv", test.urlPath)
+		assert.Equal(t, test.target, target, test.urlPath)
+		assert.Equal(t, test.isDir, isDir, test.urlPath)
+	}
+
+	// A root given with a trailing slash resolves the same
+	target, isDir := resolveTarget("/srv/", "/")
+	assert.Equal(t, "/srv/", target)
+	assert.True(t, isDir)
+}
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, pathDepth("/srv", "/srv/"))
+	assert.Equal(t, 1, pathDepth("/srv", "/srv/site/"))
+	assert.Equal(t, 3, pathDepth("/srv/", "/srv/site/docs/index.html"))
+}
+
 func TestGetBackupPathDirectory(t *testing.T) {
 	path := "/path/to/dir/"
 	pathBackup := getBackupPath("tested", path)
@@ -30,6 +66,52 @@ func TestGetTempPathFile(t *testing.T) {
 	assert.Equal(t, "/path/to/file-tested-tmp", pathTmp)
 }
 
+func TestParsePerm(t *testing.T) {
+	perm, err := parsePerm("0755")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), perm)
+
+	perm, err = parsePerm("640")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), perm)
+}
+
+func TestHasWindowsReservedName(t *testing.T) {
+	for _, p := range []string{"/CON", "/con.txt", "/site/aux", "nul.tar.gz", "/COM1/index.html", "/lpt9 .txt"} {
+		assert.True(t, hasWindowsReservedName(p), p)
+	}
+	for _, p := range []string{"/", "/console.txt", "/site/auxiliary", "/COM10", "/icon.png", "/my.con"} {
+		assert.False(t, hasWindowsReservedName(p), p)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	var tests = map[string]string{
+		"dist/index.html":        "index.html",
+		"./dist/pages/":          "pages",
+		"/dist/pages/about.html": "pages/about.html",
+	}
+
+	for name, expected := range tests {
+		stripped, ok := stripComponents(name, 1)
+		assert.True(t, ok, name)
+		assert.Equal(t, expected, stripped, name)
+	}
+
+	_, ok := stripComponents("dist/", 1)
+	assert.False(t, ok)
+}
+
+func TestStagedPath(t *testing.T) {
+	wfs := &WritableFileServer{StagingDir: ".staging"}
+	assert.Equal(t, "/srv/.staging/index.html", wfs.stagedPath("/srv", "/srv/site/index.html"))
+	assert.Equal(t, "/srv/.staging/site/", wfs.stagedPath("/srv", "/srv/site/"))
+	assert.Equal(t, "/srv/", wfs.stagedPath("/srv", "/srv/"))
+
+	wfs.StagingDir = ""
+	assert.Equal(t, "/srv/site/", wfs.stagedPath("/srv", "/srv/site/"))
+}
+
 // TEST: ExtractFile
 
 // TEST: ExtractDirectory
@@ -0,0 +1,325 @@
+package caddy_writable_file_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/unicode/norm"
+)
+
+// WebDAV methods (RFC 4918)
+const (
+	METHOD_MOVE = "MOVE"
+	METHOD_COPY = "COPY"
+)
+
+// Resolve the `Destination` header of a request to a path under root
+func (wfs *WritableFileServer) resolveDestination(root string, r *http.Request) (string, *ErrorDeployement) {
+	header := r.Header.Get("Destination")
+	if header == "" {
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			errors.New("missing destination header"),
+			"missing Destination header",
+		}
+	}
+
+	destination, err := url.Parse(header)
+	if err != nil {
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("malformed destination header: %w", err),
+			"malformed Destination header",
+		}
+	}
+
+	if wfs.NormalizeUnicode {
+		destination.Path = norm.NFC.String(destination.Path)
+	}
+
+	// SanitizedPathJoin would silently keep these in the root, but the client
+	// obviously meant something else
+	if (destination.Host != "" && destination.Host != r.Host) || escapesRoot(destination.Path) {
+		return "", &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("destination outside of the root: %s", header),
+			"destination is outside of the root",
+		}
+	}
+
+	target, _ := resolveTarget(root, destination.Path)
+	return target, nil
+}
+
+// Return true if the `..` segments of urlPath climb above its first segment
+func escapesRoot(urlPath string) bool {
+	depth := 0
+	for _, segment := range strings.Split(urlPath, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// Rename target to destination, replacing destination if it already exists. On success
+// it returns 201 Created if destination did not exist before and 204 No Content if it
+// was replaced.
+func (wfs *WritableFileServer) HandleMove(id string, root string, target string, destination string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	source := filepath.Clean(target)
+	dest := filepath.Clean(destination)
+
+	if errOverlap := checkOverlap(root, source, dest); errOverlap != nil {
+		return 0, errOverlap
+	}
+
+	// Check the state of the source
+	_, err := os.Stat(source)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to move a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+
+	// Check the state of the destination
+	_, err = os.Stat(dest)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return 0, errFileParent(root, dest, err)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat destination: %w", err),
+			"",
+		}
+	}
+	exists := err == nil
+
+	if errOverwrite := checkOverwrite(r, exists); errOverwrite != nil {
+		return 0, errOverwrite
+	}
+	if errLinks := checkRelocatedSymlinks(root, source, dest, true); errLinks != nil {
+		return 0, errLinks
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create destination directory %s: %w", dest, err),
+			"",
+		}
+	}
+
+	// We backup destination if it already exist
+	destBackup := wfs.backupPath(id, root, dest)
+	if exists {
+		if err := rename(dest, destBackup); err != nil {
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to backup destination %s: %w", dest, err),
+				"",
+			}
+		}
+	}
+
+	if err := rename(source, dest); err != nil {
+		err = fmt.Errorf("failed to move %s to %s: %w", source, dest, err)
+		if errRollback := rollback(destBackup, dest); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	if !exists {
+		w.Header().Set("Location", r.Header.Get("Destination"))
+		return http.StatusCreated, nil
+	}
+
+	if err := os.RemoveAll(destBackup); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after move", zap.String("backup", destBackup), zap.Error(err))
+	}
+	return http.StatusNoContent, nil
+}
+
+// Duplicate target to destination, recursively for directories. The copy is done in a
+// temporary location and then swapped atomically with destination. On success it
+// returns 201 Created if destination did not exist before and 204 No Content if it
+// was replaced.
+func (wfs *WritableFileServer) HandleCopy(id string, root string, target string, destination string, w http.ResponseWriter, r *http.Request) (int, *ErrorDeployement) {
+	source := filepath.Clean(target)
+	dest := filepath.Clean(destination)
+
+	if errOverlap := checkOverlap(root, source, dest); errOverlap != nil {
+		return 0, errOverlap
+	}
+
+	// Check the state of the source
+	_, err := os.Stat(source)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusNotFound,
+			fmt.Errorf("trying to copy a target that does not exist: %w", err),
+			"Not Found.",
+		}
+	}
+	if err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat target: %w", err),
+			"",
+		}
+	}
+
+	// Check the state of the destination
+	_, err = os.Stat(dest)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return 0, errFileParent(root, dest, err)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("could not stat destination: %w", err),
+			"",
+		}
+	}
+	exists := err == nil
+
+	if errOverwrite := checkOverwrite(r, exists); errOverwrite != nil {
+		return 0, errOverwrite
+	}
+	if errLinks := checkRelocatedSymlinks(root, source, dest, false); errLinks != nil {
+		return 0, errLinks
+	}
+
+	// We prepare the copy in a temporary location
+	if err := os.MkdirAll(filepath.Dir(dest), wfs.dirPerm); err != nil {
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to create destination directory %s: %w", dest, err),
+			"",
+		}
+	}
+	destTemp := wfs.tempPath(id, root, dest)
+	if err := copyTree(source, destTemp); err != nil {
+		os.RemoveAll(destTemp)
+		return 0, &ErrorDeployement{
+			http.StatusInternalServerError,
+			fmt.Errorf("failed to copy %s to %s: %w", source, destTemp, err),
+			"",
+		}
+	}
+
+	replaced := ""
+	if exists {
+		replaced = dest
+	}
+	if errQuota := wfs.checkQuota(id, root, replaced, destTemp); errQuota != nil {
+		os.RemoveAll(destTemp)
+		return 0, errQuota
+	}
+
+	// We backup destination if it already exist
+	destBackup := wfs.backupPath(id, root, dest)
+	if exists {
+		if err := rename(dest, destBackup); err != nil {
+			os.RemoveAll(destTemp)
+			return 0, &ErrorDeployement{
+				http.StatusInternalServerError,
+				fmt.Errorf("failed to backup destination %s: %w", dest, err),
+				"",
+			}
+		}
+	}
+
+	// Swap destination with the copy using atomic `Rename`
+	if err := rename(destTemp, dest); err != nil {
+		os.RemoveAll(destTemp)
+		err = fmt.Errorf("failed to swap temporary copy (%s) with destination (%s): %w", destTemp, dest, err)
+		if errRollback := rollback(destBackup, dest); errRollback != nil {
+			err = fmt.Errorf("%w AND failed to rollback: %w", err, errRollback)
+		}
+		return 0, &ErrorDeployement{http.StatusInternalServerError, err, ""}
+	}
+
+	if !exists {
+		w.Header().Set("Location", r.Header.Get("Destination"))
+		return http.StatusCreated, nil
+	}
+
+	if err := os.RemoveAll(destBackup); err != nil {
+		wfs.logger.Log(zapcore.WarnLevel, "failed to remove backup after copy", zap.String("backup", destBackup), zap.Error(err))
+	}
+	return http.StatusNoContent, nil
+}
+
+// Honor the `Overwrite` header: when it is `F` an existing destination, or target for
+// PUT, must be left untouched.
+func checkOverwrite(r *http.Request, exists bool) *ErrorDeployement {
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+		return nil
+	case "F":
+		if exists {
+			return &ErrorDeployement{
+				http.StatusPreconditionFailed,
+				errors.New("destination exists and overwrite is disabled"),
+				"destination already exists",
+			}
+		}
+		return nil
+	default:
+		return &ErrorDeployement{
+			http.StatusBadRequest,
+			fmt.Errorf("invalid overwrite header: %s", r.Header.Get("Overwrite")),
+			"invalid Overwrite header: must be 'T' or 'F'",
+		}
+	}
+}
+
+// Refuse to operate on the root or when source and destination contain each other,
+// since the backup of one would carry the other away. Paths must be cleaned.
+func checkOverlap(root string, source string, dest string) *ErrorDeployement {
+	root = filepath.Clean(root)
+	if source == root || dest == root {
+		return &ErrorDeployement{
+			http.StatusForbidden,
+			errors.New("source or destination is the root"),
+			"cannot move or copy the root",
+		}
+	}
+
+	if source == dest ||
+		strings.HasPrefix(dest, source+string(os.PathSeparator)) ||
+		strings.HasPrefix(source, dest+string(os.PathSeparator)) {
+		return &ErrorDeployement{
+			http.StatusConflict,
+			fmt.Errorf("source %s and destination %s overlap", source, dest),
+			"source and destination overlap",
+		}
+	}
+	return nil
+}
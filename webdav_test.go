@@ -0,0 +1,347 @@
+package caddy_writable_file_server
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                                     Move                                     ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestMoveToNew(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.MkdirAll(wfs.Root+"/staging/", DIR_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/staging/index.html", []byte("new"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "MOVE", "/staging/", nil)
+	r.Header.Add("Destination", "/live/site/")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/live/site/", w.Header().Get("Location"))
+
+	data, err := os.ReadFile(wfs.Root + "/live/site/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	_, err = os.Stat(wfs.Root + "/staging")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMoveOverExisting(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/staging.txt", []byte("new"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/live.txt", []byte("old"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "MOVE", "/staging.txt", nil)
+	r.Header.Add("Destination", "http://example.com/live.txt")
+	r.Host = "example.com"
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	data, err := os.ReadFile(wfs.Root + "/live.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	// No backup should be left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMoveInvalid(t *testing.T) {
+	var tests = []struct {
+		name        string
+		path        string
+		destination string
+		status      int
+	}{
+		{"missing source", "/missing.txt", "/live.txt", http.StatusNotFound},
+		{"missing destination", "/staging.txt", "", http.StatusBadRequest},
+		{"destination escaping the root", "/staging.txt", "/../../etc/passwd", http.StatusBadRequest},
+		{"destination on another host", "/staging.txt", "http://other.com/live.txt", http.StatusBadRequest},
+		{"destination is the root", "/staging.txt", "/", http.StatusForbidden},
+		{"destination inside source", "/dir/", "/dir/sub/", http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wfs := newTestWritableFileServer(t)
+
+			if err := os.WriteFile(wfs.Root+"/staging.txt", []byte("new"), FILE_PERM); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(wfs.Root+"/dir", DIR_PERM); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+			r, _ := http.NewRequestWithContext(ctx, "MOVE", test.path, nil)
+			r.Header.Add("Destination", test.destination)
+			r.Host = "example.com"
+
+			w := httptest.NewRecorder()
+
+			err := wfs.ServeHTTP(w, r, &MockHandler{})
+			errHandler, ok := err.(caddyhttp.HandlerError)
+
+			assert.NotNil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, test.status, errHandler.StatusCode)
+
+			// Nothing moved
+			assertFileExist(t, wfs.Root+"/staging.txt")
+			assertDirectoryExist(t, wfs.Root+"/dir")
+		})
+	}
+}
+
+func TestMoveNoOverwrite(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/staging.txt", []byte("new"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/live.txt", []byte("old"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "MOVE", "/staging.txt", nil)
+	r.Header.Add("Destination", "/live.txt")
+	r.Header.Add("Overwrite", "F")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusPreconditionFailed, errHandler.StatusCode)
+
+	data, err := os.ReadFile(wfs.Root + "/live.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+	assertFileExist(t, wfs.Root+"/staging.txt")
+}
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                                     Copy                                     ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+func TestCopyFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/source.txt", []byte("content"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/copy.txt", []byte("old"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "COPY", "/source.txt", nil)
+	r.Header.Add("Destination", "/copy.txt")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, path := range []string{"/source.txt", "/copy.txt"} {
+		data, err := os.ReadFile(wfs.Root + path)
+		assert.NoError(t, err)
+		assert.Equal(t, "content", string(data))
+	}
+
+	// No temporary or backup file should be left behind
+	entries, err := os.ReadDir(wfs.Root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestCopyDirectory(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/source/", newTar())
+	r.Header.Add("Content-Type", "application/x-tar")
+	if err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = http.NewRequestWithContext(ctx, "COPY", "/source/", nil)
+	r.Header.Add("Destination", "/nested/copy/")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/nested/copy/", w.Header().Get("Location"))
+
+	for _, root := range []string{"/source", "/nested/copy"} {
+		assertDirectoryExist(t, wfs.Root+root+"/tested/no-file/")
+		assertDirectoryEmpty(t, wfs.Root+root+"/tested/no-file/")
+		assertFileExist(t, wfs.Root+root+"/tested/empty-file/empty.txt")
+
+		data, err := os.ReadFile(wfs.Root + root + "/tested/with-file/deep.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "deeeep!\n", string(data))
+	}
+}
+
+func TestCopyNoOverwrite(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/source.txt", []byte("content"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/copy.txt", []byte("old"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "COPY", "/source.txt", nil)
+	r.Header.Add("Destination", "/copy.txt")
+	r.Header.Add("Overwrite", "F")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.NotNil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusPreconditionFailed, errHandler.StatusCode)
+
+	data, err := os.ReadFile(wfs.Root + "/copy.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// A missing destination is still allowed
+	r, _ = http.NewRequestWithContext(ctx, "COPY", "/source.txt", nil)
+	r.Header.Add("Destination", "/other.txt")
+	r.Header.Add("Overwrite", "F")
+
+	w = httptest.NewRecorder()
+
+	err = wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestCopyUnderFile(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+
+	if err := os.WriteFile(wfs.Root+"/index.html", []byte("new"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wfs.Root+"/live", []byte("old"), FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "COPY", "/index.html", nil)
+	r.Header.Add("Destination", "/live/index.html")
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	errHandler, ok := err.(caddyhttp.HandlerError)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, errHandler.StatusCode)
+	assert.Equal(t, "a parent of the target is a file: /live\n", w.Body.String())
+}
+
+// ╔══════════════════════════════════════════════════════════════════════════════╗
+// ║                                   Symlinks                                   ║
+// ╚══════════════════════════════════════════════════════════════════════════════╝
+
+// Deploy /site/ with a link that only stays in the root as deep as it is extracted
+func newDeepLinkSite(t *testing.T, wfs *WritableFileServer) {
+	wfs.AllowSymlinks = true
+	// A file next to the root, where the link points from /d2/leak
+	secret := filepath.Base(wfs.Root) + ".secret"
+	os.WriteFile(filepath.Join(filepath.Dir(wfs.Root), secret), []byte("secret"), FILE_PERM)
+	t.Cleanup(func() { os.Remove(filepath.Join(filepath.Dir(wfs.Root), secret)) })
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/site/", newTarWith(
+		tarEntry{&tar.Header{Name: "d1/d2/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "d1/d2/leak", Typeflag: tar.TypeSymlink, Linkname: "../../" + secret}, ""},
+	))
+	r.Header.Add("Content-Type", "application/x-tar")
+	if err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveCopySymlinkEscape(t *testing.T) {
+	for _, method := range []string{"MOVE", "COPY"} {
+		wfs := newTestWritableFileServer(t)
+		newDeepLinkSite(t, wfs)
+
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+		r, _ := http.NewRequestWithContext(ctx, method, "/site/d1/d2/", nil)
+		r.Header.Add("Destination", "/d2/")
+
+		err := wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{})
+		if assert.Error(t, err, method) {
+			assert.Equal(t, http.StatusConflict, err.(caddyhttp.HandlerError).StatusCode, method)
+		}
+		assert.NoDirExists(t, wfs.Root+"/d2", method)
+		_, err = os.Lstat(wfs.Root + "/site/d1/d2/leak")
+		assert.NoError(t, err, method)
+
+		// Moved as a whole the link still points to the same place
+		r, _ = http.NewRequestWithContext(ctx, method, "/site/", nil)
+		r.Header.Add("Destination", "/other/")
+		assert.NoError(t, wfs.ServeHTTP(httptest.NewRecorder(), r, &MockHandler{}), method)
+	}
+}
+
+func TestManifestSymlinkEscape(t *testing.T) {
+	wfs := newTestWritableFileServer(t)
+	newDeepLinkSite(t, wfs)
+
+	_, err := putManifest(wfs, "/site/", `{"operations": [{"op": "move", "path": "d1/d2/leak", "destination": "leak"}]}`)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(caddyhttp.HandlerError).StatusCode)
+	}
+	assert.NoFileExists(t, wfs.Root+"/site/leak")
+	_, err = os.Lstat(wfs.Root + "/site/d1/d2/leak")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,59 @@
+package caddy_writable_file_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Maximum duration of a webhook call
+const WEBHOOK_TIMEOUT = 5 * time.Second
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// Body of the webhook calls
+type webhookPayload struct {
+	Id     string `json:"id"`
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// POST a description of a successful deploy to the configured webhook. The call is
+// done in the background and failures are only logged so that a webhook that is down
+// never fails the deploy.
+func (wfs *WritableFileServer) callWebhook(id string, r *http.Request, bytes int64) {
+	if wfs.Webhook == "" {
+		return
+	}
+
+	payload := webhookPayload{id, r.URL.Path, r.Method, bytes}
+	go func() {
+		if err := postWebhook(wfs.Webhook, payload); err != nil {
+			wfs.logger.Log(zapcore.WarnLevel, "failed to call webhook", zap.String("id", id), zap.String("webhook", wfs.Webhook), zap.Error(err))
+		}
+	}()
+}
+
+func postWebhook(url string, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
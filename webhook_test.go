@@ -0,0 +1,88 @@
+package caddy_writable_file_server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan webhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+	}))
+	t.Cleanup(server.Close)
+
+	wfs := newTestWritableFileServer(t)
+	wfs.Webhook = server.URL
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, "/test.txt", payload.Path)
+		assert.Equal(t, "PUT", payload.Method)
+		assert.NotEmpty(t, payload.Id)
+		assert.Greater(t, payload.Bytes, int64(0))
+	case <-time.After(WEBHOOK_TIMEOUT):
+		t.Fatal("webhook not called")
+	}
+}
+
+func TestWebhookNotCalledOnFailure(t *testing.T) {
+	called := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+
+	wfs := newTestWritableFileServer(t)
+	wfs.Webhook = server.URL
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "DELETE", "/missing.txt", nil)
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.Error(t, err)
+
+	select {
+	case <-called:
+		t.Fatal("webhook called after a failed deploy")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookDownDoesNotFailDeploy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	wfs := newTestWritableFileServer(t)
+	wfs.Webhook = server.URL
+
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	r, _ := http.NewRequestWithContext(ctx, "PUT", "/test.txt", newFile())
+
+	w := httptest.NewRecorder()
+
+	err := wfs.ServeHTTP(w, r, &MockHandler{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}